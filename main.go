@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	stdlog "log"
@@ -10,9 +11,15 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/eachchat/yiqia-push/pkg/health"
 	"github.com/eachchat/yiqia-push/pkg/log"
+	"github.com/eachchat/yiqia-push/pkg/metrics"
 	"github.com/eachchat/yiqia-push/pkg/notify"
+	// register all the providers
+	_ "github.com/eachchat/yiqia-push/pkg/push/all"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
 	"github.com/eachchat/yiqia-push/pkg/push/overall"
+	kitlog "github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"gopkg.in/yaml.v3"
 )
@@ -23,11 +30,22 @@ type config struct {
 	// Default: :80
 	Addr string `yaml:"addr"`
 
+	// AdminAddr is the address to listen on for the admin API, e.g.
+	// 127.0.0.1:8081. It should not be reachable by the homeservers.
+	// The admin API is disabled if it is empty.
+	AdminAddr string `yaml:"admin_addr"`
+
 	// LogLevel is the log level.
 	// Default: info
-	LogLevel string         `yaml:"log_level"`
-	Pusher   overall.Config `yaml:"pusher"`
-	Notify   notify.Config  `yaml:"notify"`
+	LogLevel string `yaml:"log_level"`
+
+	// ShutdownTimeout is the max duration to wait for the server to stop
+	// and the queued notifications to be delivered.
+	// Default: 5s
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Pusher overall.Config `yaml:"pusher"`
+	Notify notify.Config  `yaml:"notify"`
 }
 
 func (c *config) Validate() error {
@@ -39,6 +57,10 @@ func (c *config) Validate() error {
 		c.LogLevel = "info"
 	}
 
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 5 * time.Second
+	}
+
 	err := c.Notify.Validate()
 	if err != nil {
 		return fmt.Errorf("invalid notify config: %v", err)
@@ -87,28 +109,82 @@ func Main(ctx context.Context) func() {
 
 	logger := log.NewLogger(cfg.LogLevel)
 
-	overAll, err := overall.New(&cfg.Pusher)
+	overAll, err := overall.New(&cfg.Pusher, logger)
 	if err != nil {
 		level.Error(logger).Log("msg", "fail new overall", "err", err)
 		os.Exit(1)
 	}
 
+	pusher, err := notify.New(ctx, &cfg.Notify, overAll, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "fail new notify", "err", err)
+		os.Exit(1)
+	}
+
+	prober := health.New(overAll.Checkers(), logger)
+	prober.Start(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health.Healthz())
+	mux.Handle("/readyz", prober)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/", pusher)
+
 	s := http.Server{
 		Addr:    cfg.Addr,
-		Handler: notify.New(ctx, &cfg.Notify, overAll, logger),
+		Handler: mux,
 	}
 
 	level.Info(logger).Log("msg", "start server", "addr", cfg.Addr)
-	go func() {
-		err = s.ListenAndServe()
-		if err != nil {
-			level.Error(logger).Log("msg", "fail listen and serve", "err", err)
-			os.Exit(1)
+	go serve(&s, logger)
+
+	// the admin API exposes the vendor states, it is served apart from
+	// the notify API
+	var admin *http.Server
+	if cfg.AdminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/admin/breakers", breaker.Handler())
+		admin = &http.Server{
+			Addr:    cfg.AdminAddr,
+			Handler: adminMux,
 		}
-	}()
+
+		level.Info(logger).Log("msg", "start admin server", "addr", cfg.AdminAddr)
+		go serve(admin, logger)
+	}
 
 	return func() {
-		_ = s.Shutdown(ctx)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+
+		err := s.Shutdown(ctx)
+		if err != nil {
+			level.Error(logger).Log("msg", "fail shutdown server", "err", err)
+			// the connections are closed to cancel the pushes still running
+			_ = s.Close()
+		}
+
+		if admin != nil {
+			err = admin.Shutdown(ctx)
+			if err != nil {
+				level.Error(logger).Log("msg", "fail shutdown admin server", "err", err)
+			}
+		}
+
+		err = pusher.Close(ctx)
+		if err != nil {
+			level.Error(logger).Log("msg", "fail close notify", "err", err)
+		}
+	}
+}
+
+// serve serves the server until it is shut down, the process exits if
+// the server fails to listen.
+func serve(s *http.Server, logger kitlog.Logger) {
+	err := s.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		level.Error(logger).Log("msg", "fail listen and serve", "addr", s.Addr, "err", err)
+		os.Exit(1)
 	}
 }
 
@@ -122,6 +198,5 @@ func main() {
 	cancel()
 	stop()
 
-	<-time.After(5 * time.Second)
 	fmt.Println("shutdown gracefully")
 }
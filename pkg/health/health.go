@@ -0,0 +1,160 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/log"
+)
+
+const (
+	// probeInterval is the interval between the probes of the providers.
+	probeInterval = 30 * time.Second
+	// retryInterval is the interval between the probes while any provider
+	// is not ready yet.
+	retryInterval = 5 * time.Second
+	// probeTimeout is the max duration to probe a provider.
+	probeTimeout = 10 * time.Second
+)
+
+// Provider is the readiness of a push provider
+type Provider struct {
+	Name      string    `json:"name"`
+	Ready     bool      `json:"ready"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Readiness is the response body of the readiness endpoint
+type Readiness struct {
+	Ready     bool       `json:"ready"`
+	Providers []Provider `json:"providers"`
+}
+
+// Prober probes the credentials of the push providers in the background.
+// The server is ready once every provider has fetched its access token.
+type Prober struct {
+	checkers map[string]push.Checker
+	logger   log.Logger
+	// after waits for the interval between the probes, replaced in tests
+	after func(d time.Duration) <-chan time.Time
+
+	locker    sync.Mutex
+	providers map[string]*Provider
+}
+
+func New(checkers map[string]push.Checker, logger log.Logger) *Prober {
+	providers := make(map[string]*Provider, len(checkers))
+	for name := range checkers {
+		providers[name] = &Provider{
+			Name:  name,
+			Error: "not checked yet",
+		}
+	}
+
+	return &Prober{
+		checkers:  checkers,
+		logger:    logger,
+		after:     time.After,
+		providers: providers,
+	}
+}
+
+// Start probes the providers until ctx is done.
+func (p *Prober) Start(ctx context.Context) {
+	go func() {
+		for {
+			interval := probeInterval
+			if !p.probe(ctx).Ready {
+				interval = retryInterval
+			}
+
+			select {
+			case <-p.after(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// probe checks all the providers concurrently.
+func (p *Prober) probe(ctx context.Context) *Readiness {
+	var wg sync.WaitGroup
+	for name, checker := range p.checkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			err := checker.Check(ctx)
+
+			provider := &Provider{
+				Name:      name,
+				Ready:     err == nil,
+				CheckedAt: time.Now(),
+			}
+			if err != nil {
+				level.Warn(p.logger).Log("msg", "provider not ready", "provider", name, "err", err)
+				provider.Error = err.Error()
+			}
+
+			p.locker.Lock()
+			p.providers[name] = provider
+			p.locker.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return p.Readiness()
+}
+
+// Readiness returns the readiness of the providers, sorted by name.
+func (p *Prober) Readiness() *Readiness {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	readiness := &Readiness{
+		Ready:     true,
+		Providers: make([]Provider, 0, len(p.providers)),
+	}
+	for _, provider := range p.providers {
+		readiness.Ready = readiness.Ready && provider.Ready
+		readiness.Providers = append(readiness.Providers, *provider)
+	}
+
+	sort.Slice(readiness.Providers, func(i, j int) bool {
+		return readiness.Providers[i].Name < readiness.Providers[j].Name
+	})
+	return readiness
+}
+
+// ServeHTTP reports the readiness, the status is 503 until every provider
+// is ready.
+func (p *Prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	readiness := p.Readiness()
+
+	code := http.StatusOK
+	if !readiness.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(readiness)
+}
+
+// Healthz returns the http handler reporting the process is alive.
+func Healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}` + "\n"))
+	})
+}
@@ -0,0 +1,113 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/log"
+)
+
+// fakeChecker fails the checks while err is set
+type fakeChecker struct {
+	locker sync.Mutex
+	err    error
+}
+
+func (c *fakeChecker) Check(ctx context.Context) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.err
+}
+
+func (c *fakeChecker) fail(err error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.err = err
+}
+
+// clock hands the intervals waited by the prober to the test
+type clock struct {
+	intervals chan time.Duration
+	ticks     chan time.Time
+}
+
+func newClock() *clock {
+	return &clock{intervals: make(chan time.Duration), ticks: make(chan time.Time)}
+}
+
+func (c *clock) after(d time.Duration) <-chan time.Time {
+	c.intervals <- d
+	return c.ticks
+}
+
+// next waits for the prober to wait for the next probe, and returns the
+// interval it waits.
+func (c *clock) next(t *testing.T) time.Duration {
+	t.Helper()
+	select {
+	case d := <-c.intervals:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("probe not finished")
+		return 0
+	}
+}
+
+func status(p *Prober) int {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	return w.Code
+}
+
+func TestReadiness(t *testing.T) {
+	checker := &fakeChecker{err: errors.New("unauthorized")}
+	p := New(map[string]push.Checker{"huawei": checker}, log.NewNopLogger())
+	c := newClock()
+	p.after = c.after
+
+	// not ready until the first probe
+	if code := status(p); code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d before the probe, want 503", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx)
+
+	// the failed provider is probed again soon
+	if d := c.next(t); d != retryInterval {
+		t.Errorf("interval = %v after a failed probe, want %v", d, retryInterval)
+	}
+	if code := status(p); code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d after a failed probe, want 503", code)
+	}
+
+	checker.fail(nil)
+	c.ticks <- time.Now()
+	if d := c.next(t); d != probeInterval {
+		t.Errorf("interval = %v after a passed probe, want %v", d, probeInterval)
+	}
+	if code := status(p); code != http.StatusOK {
+		t.Errorf("status = %d after a passed probe, want 200", code)
+	}
+
+	// the readiness flips back when a re-probe fails
+	checker.fail(errors.New("unauthorized"))
+	c.ticks <- time.Now()
+	if d := c.next(t); d != retryInterval {
+		t.Errorf("interval = %v after a failed re-probe, want %v", d, retryInterval)
+	}
+	if code := status(p); code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d after a failed re-probe, want 503", code)
+	}
+	readiness := p.Readiness()
+	if provider := readiness.Providers[0]; provider.Ready || provider.Error != "unauthorized" {
+		t.Errorf("provider = %+v, want not ready with the error", provider)
+	}
+}
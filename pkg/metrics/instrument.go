@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// Middleware returns a push middleware which counts the pushed device tokens
+// of the provider instance of the vendor by their status. The tokens of a
+// failed push are counted as retryable or failed according to the failure.
+func Middleware(vendor, instance string) push.Middleware {
+	return func(next push.Push) push.Push {
+		return &instrument{
+			vendor:   vendor,
+			instance: instance,
+			next:     next,
+		}
+	}
+}
+
+type instrument struct {
+	vendor   string
+	instance string
+	next     push.Push
+}
+
+func (i *instrument) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	result, err := i.next.PushNotice(ctx, message)
+
+	counted := result
+	if err != nil {
+		counted = push.FailedResult(message.DeviceTokens, err)
+	}
+
+	counts := make(map[push.Status]int)
+	for _, token := range counted.Tokens {
+		counts[token.Status]++
+	}
+	for status, n := range counts {
+		Pushes.With("vendor", i.vendor, "instance", i.instance, "outcome", status.String()).Add(float64(n))
+	}
+	return result, err
+}
+
+// EndpointMiddleware returns an endpoint middleware which observes the
+// latency of the vendor api.
+func EndpointMiddleware(vendor, api string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			begin := time.Now()
+			response, err := next(ctx, request)
+			VendorLatency.With("vendor", vendor, "api", api, "outcome", outcome(err)).Observe(time.Since(begin).Seconds())
+			return response, err
+		}
+	}
+}
+
+// TokenMiddleware returns an endpoint middleware which counts the access
+// token refreshes of the vendor, and observes the latency of the token api.
+func TokenMiddleware(vendor string) endpoint.Middleware {
+	latency := EndpointMiddleware(vendor, "token")
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		next = latency(next)
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			result := "success"
+			if err != nil {
+				result = "failure"
+			}
+			TokenRefreshes.With("vendor", vendor, "result", result).Add(1)
+			return response, err
+		}
+	}
+}
+
+// outcome returns the outcome label of the vendor api request.
+func outcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+	return push.KindOf(err).String()
+}
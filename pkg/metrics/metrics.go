@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"net/http"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace is the prefix of all the metric names.
+const namespace = "yiqia_push"
+
+var (
+	// NotifyRequests counts the notify requests by the response status code.
+	NotifyRequests = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "notify",
+		Name:      "requests_total",
+		Help:      "Number of the notify requests by the response status code.",
+	}, []string{"code"})
+
+	// RejectedPushKeys counts the pushkeys reported to the homeservers as rejected.
+	RejectedPushKeys = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "notify",
+		Name:      "rejected_pushkeys_total",
+		Help:      "Number of the pushkeys reported to the homeservers as rejected.",
+	}, []string{})
+
+	// Pushes counts the pushed device tokens by the vendor, the provider
+	// instance and the push status. The instance is labeled instead of the
+	// pusher app id, which is sent by the homeservers and is unbounded.
+	Pushes = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "push",
+		Name:      "tokens_total",
+		Help:      "Number of the pushed device tokens by vendor, provider instance and outcome.",
+	}, []string{"vendor", "instance", "outcome"})
+
+	// VendorLatency observes the duration of the vendor api requests.
+	VendorLatency = kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "vendor",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the vendor api requests by vendor, api and outcome.",
+		Buckets:   stdprometheus.DefBuckets,
+	}, []string{"vendor", "api", "outcome"})
+
+	// TokenRefreshes counts the access token refreshes of the vendors.
+	TokenRefreshes = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "vendor",
+		Name:      "token_refreshes_total",
+		Help:      "Number of the access token refreshes by vendor and result.",
+	}, []string{"vendor", "result"})
+
+	// QueueDepth is the number of the jobs waiting for delivery.
+	QueueDepth = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "depth",
+		Help:      "Number of the jobs waiting for delivery.",
+	}, []string{})
+
+	// QueueRetries counts the jobs left in the queue for redelivery.
+	QueueRetries = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "retries_total",
+		Help:      "Number of the jobs left for redelivery by vendor.",
+	}, []string{"vendor"})
+)
+
+// Handler returns the http handler exposing the metrics to Prometheus.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -29,8 +29,7 @@ type Counts struct {
 	MissedCalls int `json:"missed_calls"`
 	Unread      int `json:"unread"`
 }
-type Data struct {
-}
+type Data map[string]interface{}
 type Tweaks struct {
 	Sound string `json:"sound"`
 }
@@ -4,12 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/pool"
 	"github.com/eachchat/yiqia-push/pkg/push"
 	"github.com/eachchat/yiqia-push/pkg/push/overall"
+	"github.com/eachchat/yiqia-push/pkg/queue"
 	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/log"
 	"github.com/google/uuid"
@@ -20,36 +27,137 @@ type Pusher struct {
 	logger log.Logger
 
 	overall overall.OverAll
+	pool    *pool.Pool
+	queue   *queue.Queue
 }
 
 type Config struct {
 	PmrConfig `yaml:"pmr"`
+
+	// Pool limits the number of vendor pushes running at the same time.
+	Pool pool.Config `yaml:"pool"`
+
+	// Queue delivers the notifications asynchronously if it is enabled.
+	Queue queue.Config `yaml:"queue"`
+
+	// Timeout is the max duration to push the notification of a request
+	// delivered synchronously, the push is also canceled when the
+	// homeserver disconnects.
+	// Default: 60s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *Config) Validate() error {
+	if c.Timeout == 0 {
+		c.Timeout = 60 * time.Second
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+
+	err := c.PmrConfig.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid pmr config: %v", err)
+	}
+
+	err = c.Pool.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid pool config: %v", err)
+	}
+
+	err = c.Queue.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid queue config: %v", err)
+	}
+	return nil
 }
 
-func New(ctx context.Context, cfg *Config, overall *overall.OverAll, logger log.Logger) *Pusher {
-	return &Pusher{
+func New(ctx context.Context, cfg *Config, overall *overall.OverAll, logger log.Logger) (*Pusher, error) {
+	p := &Pusher{
 		cfg:     cfg,
 		logger:  logger,
 		overall: *overall,
+		pool:    pool.New(&cfg.Pool),
+	}
+
+	if cfg.Queue.Enabled() {
+		q, err := queue.New(&cfg.Queue, p.deliver, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed create queue: %v", err)
+		}
+		q.Start()
+		p.queue = q
+	}
+	return p, nil
+}
+
+// Close waits for the queued notifications to be delivered until ctx is done.
+func (p *Pusher) Close(ctx context.Context) error {
+	if p.queue == nil {
+		return nil
 	}
+	return p.queue.Close(ctx)
 }
 
+// notifyPath is the path of the Push Gateway notify API.
+// more info: https://spec.matrix.org/v1.9/push-gateway-api/#post_matrixpushv1notify
+const notifyPath = "/_matrix/push/v1/notify"
+
+// Matrix standard error codes.
+const (
+	errCodeUnrecognized = "M_UNRECOGNIZED"
+	errCodeNotJSON      = "M_NOT_JSON"
+	errCodeBadJSON      = "M_BAD_JSON"
+	errCodeTooLarge     = "M_TOO_LARGE"
+	errCodeUnknown      = "M_UNKNOWN"
+)
+
+// maxBodySize is the max size of the notify request body.
+const maxBodySize = 1024 * 1024 * 5
+
+// ServeHTTP routes the request to the Push Gateway API.
 func (p *Pusher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+	defer func() {
+		metrics.NotifyRequests.With("code", strconv.Itoa(sw.code)).Add(1)
+	}()
+	w = sw
+
+	if r.URL.Path != notifyPath {
+		errorW(w, http.StatusNotFound, errCodeUnrecognized, "Unrecognized request")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		errorW(w, http.StatusMethodNotAllowed, errCodeUnrecognized, "Unrecognized request")
+		return
+	}
+
+	p.notify(w, r)
+}
+
+// notify handles the notify request of the homeserver.
+func (p *Pusher) notify(w http.ResponseWriter, r *http.Request) {
 	u := uuid.New()
 	requestID := u.String()
 
 	logger := log.With(p.logger, "requestID", requestID)
 
-	rr, _, err := newReusableRequest(r, 1024*1024*5)
+	rr, _, err := newReusableRequest(r, maxBodySize)
 	if err != nil {
 		level.Error(logger).Log("msg", "fail new reusable request", "err", err)
-		errorW(w, http.StatusBadRequest, "Fail new reusable request")
+		if errors.Is(err, errBodyTooLarge) {
+			errorW(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Request body too large")
+			return
+		}
+		errorW(w, http.StatusBadRequest, errCodeUnknown, "Fail read request body")
 		return
 	}
 
 	if len(rr.body) == 0 {
 		level.Error(logger).Log("msg", "body is missing")
-		errorW(w, http.StatusBadRequest, "body is missing")
+		errorW(w, http.StatusBadRequest, errCodeNotJSON, "Body is missing")
 		return
 	}
 
@@ -57,7 +165,7 @@ func (p *Pusher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(rr.body, params)
 	if err != nil {
 		level.Error(logger).Log("msg", "fail unmarshal request body", "err", err)
-		errorW(w, http.StatusBadRequest, "Fail unmarshal request body")
+		errorW(w, http.StatusBadRequest, errCodeNotJSON, "Content not JSON")
 		return
 	}
 
@@ -65,74 +173,275 @@ func (p *Pusher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	level.Info(logger).Log("msg", "receive request", "sender", params.Notification.SenderDisplayName)
 	if len(params.Notification.Devices) == 0 {
 		level.Error(logger).Log("msg", "devices field is missing")
-		errorW(w, http.StatusBadRequest, "Devices field  is missing")
+		errorW(w, http.StatusBadRequest, errCodeBadJSON, "Devices field is missing")
 		return
 	}
 
-	if params.Notification.Sender == "" {
-		w.Write([]byte("{}"))
-		w.Header().Set("Content-Type", "application/json")
+	// 按照路由的 provider 和 app id 分组
+	deviceMap := make(map[routeKey][]Devices)
+	for i, device := range params.Notification.Devices {
+		tag, ok := p.overall.Route(device.AppID, device.Data)
+		if !ok {
+			level.Warn(logger).Log("msg", "no provider for device", "appID", device.AppID, "pushKey", device.PushKey)
+			continue
+		}
+		// the notification without a sender, e.g. the update of the unread
+		// counts, is pushed only by the providers forwarding it
+		if params.Notification.Sender == "" && !p.overall.Forwards(tag) {
+			continue
+		}
+
+		key := routeKey{tag: tag, appID: device.AppID}
+		deviceMap[key] = append(deviceMap[key], params.Notification.Devices[i])
+	}
+
+	ctx := r.Context()
+
+	// the notification is forwarded as received without the devices, the
+	// providers forwarding it add the device of every pushkey
+	rawNotification, err := withoutDevices(rr.body)
+	if err != nil {
+		level.Error(logger).Log("msg", "fail marshal notification", "err", err)
+		errorW(w, http.StatusInternalServerError, errCodeUnknown, "Fail marshal notification")
 		return
 	}
 
-	// 按照设备类型分组
-	deviceMap := make(map[string][]Devices)
-	for i, device := range params.Notification.Devices {
-		tag := "default"
-		if strings.HasPrefix(device.AppID, "android_") {
-			tag = strings.TrimPrefix(device.AppID, "android_")
+	// the devices of an app id are pushed in one message, the push client
+	// splits them into batches according to the vendor limits
+	messages := make([]*routedMessage, 0, len(deviceMap))
+	for key, devices := range deviceMap {
+		message := &push.Message{
+			ID:           uuid.New().String(),
+			AppID:        key.appID,
+			DeviceTokens: make([]string, 0, len(devices)),
+			Payload: &push.Payload{
+				BusinessID:   requestID,
+				Notification: rawNotification,
+			},
 		}
-
-		devices, ok := deviceMap[tag]
-		if !ok {
-			devices = make([]Devices, 0)
+		for _, device := range devices {
+			message.DeviceTokens = append(message.DeviceTokens, device.PushKey)
+			if len(device.Data) > 0 {
+				if message.DeviceData == nil {
+					message.DeviceData = make(map[string]map[string]interface{})
+				}
+				message.DeviceData[device.PushKey] = device.Data
+			}
 		}
 
-		devices = append(devices, params.Notification.Devices[i])
-		deviceMap[tag] = devices
+		parseMessage(ctx, params.Notification, message, &p.cfg.PmrConfig)
+		messages = append(messages, &routedMessage{tag: key.tag, message: message})
 	}
 
-	for tag, devices := range deviceMap {
-		level.Info(logger).Log("msg", "try to push message", "tag", tag)
-		for _, device := range devices {
-			pusher, err := p.overall.GetPushClient(tag)
+	if p.queue != nil {
+		rejected, err := p.enqueue(logger, messages)
+		if err != nil {
+			level.Error(logger).Log("msg", "fail enqueue push message", "err", err)
+			errorW(w, http.StatusInternalServerError, errCodeUnknown, "Fail enqueue notification")
+			return
+		}
+		metrics.RejectedPushKeys.Add(float64(len(rejected)))
+		writeJSON(w, http.StatusOK, &Response{Rejected: rejected})
+		return
+	}
+
+	// the messages are pushed concurrently, the results are collected
+	// before responding to the homeserver
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	var locker sync.Mutex
+	rejected := make([]string, 0)
+	group := p.pool.Group()
+	for _, routed := range messages {
+		group.Go(ctx, p.overall.Vendor(routed.tag), func(ctx context.Context) {
+			result, err := p.push(ctx, logger, routed.tag, routed.message)
 			if err != nil {
-				level.Error(logger).Log("msg", "fail get push client", "err", err, "tag", tag)
-				continue
+				return
 			}
 
-			ctx := context.Background()
+			locker.Lock()
+			rejected = append(rejected, result.Rejected()...)
+			locker.Unlock()
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		level.Error(logger).Log("msg", "fail dispatch push message", "err", err)
+	}
+
+	metrics.RejectedPushKeys.Add(float64(len(rejected)))
+	writeJSON(w, http.StatusOK, &Response{Rejected: rejected})
+}
+
+// withoutDevices returns the raw notification of the request body without
+// the devices, the fields unknown to the gateway are kept.
+func withoutDevices(body []byte) (json.RawMessage, error) {
+	raw := new(struct {
+		Notification map[string]json.RawMessage `json:"notification"`
+	})
+	err := json.Unmarshal(body, raw)
+	if err != nil {
+		return nil, err
+	}
+	delete(raw.Notification, "devices")
+	return json.Marshal(raw.Notification)
+}
+
+// routeKey groups the devices routed to the same provider instance
+type routeKey struct {
+	tag   string
+	appID string
+}
+
+// routedMessage is the message pushed by the provider instance of the tag
+type routedMessage struct {
+	tag     string
+	message *push.Message
+}
+
+// push pushes the message with the push client of the tag.
+func (p *Pusher) push(ctx context.Context, logger log.Logger, tag string, message *push.Message) (*push.Result, error) {
+	level.Info(logger).Log("msg", "try to push message", "tag", tag, "devices", len(message.DeviceTokens))
+	pusher, err := p.overall.GetPushClient(tag)
+	if err != nil {
+		level.Error(logger).Log("msg", "fail get push client", "err", err, "tag", tag)
+		return nil, err
+	}
+
+	result, err := pusher.PushNotice(ctx, message)
+
+	level.Info(logger).Log("msg", "push message", "tag", tag, "deviceTokens", strings.Join(message.DeviceTokens, ","))
+	if err != nil {
+		level.Error(logger).Log("msg", "fail push message", "err", err, "tag", tag)
+		return nil, err
+	}
+
+	for _, token := range result.Tokens {
+		if token.Status != push.StatusDelivered && token.Status != push.StatusSuppressed {
+			level.Warn(logger).Log("msg", "push message not delivered", "deviceToken", token.Token,
+				"status", token.Status, "code", token.Code, "reason", token.Reason)
+		}
+	}
+	return result, nil
+}
+
+// enqueue persists the messages for the background delivery. It returns the
+// pushkeys rejected by the previous deliveries, which are not enqueued again.
+func (p *Pusher) enqueue(logger log.Logger, messages []*routedMessage) ([]string, error) {
+	pushKeys := make([]string, 0)
+	for _, routed := range messages {
+		pushKeys = append(pushKeys, routed.message.DeviceTokens...)
+	}
+
+	rejected, err := p.queue.Rejected(pushKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed get rejected pushkeys: %v", err)
+	}
+
+	rejectedSet := make(map[string]struct{}, len(rejected))
+	for _, pushKey := range rejected {
+		rejectedSet[pushKey] = struct{}{}
+	}
 
-			message := &push.Message{
-				DeviceTokens: []string{
-					device.PushKey,
-				},
-				Payload: &push.Payload{
-					BusinessID: requestID,
-				},
+	jobs := make([]*queue.Job, 0, len(messages))
+	for _, routed := range messages {
+		message := routed.message
+		tokens := message.DeviceTokens[:0]
+		for _, token := range message.DeviceTokens {
+			if _, ok := rejectedSet[token]; !ok {
+				tokens = append(tokens, token)
 			}
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		message.DeviceTokens = tokens
+
+		jobs = append(jobs, &queue.Job{
+			Vendor:    routed.tag,
+			Message:   message,
+			CreatedAt: time.Now(),
+		})
+	}
 
-			parseMessage(ctx, params.Notification, message, &p.cfg.PmrConfig)
+	level.Info(logger).Log("msg", "enqueue push message", "jobs", len(jobs), "rejected", len(rejected))
+	return rejected, p.queue.Enqueue(jobs...)
+}
 
-			err = pusher.PushNotice(ctx, message)
+// deliver pushes the queued message in the background. The job is left
+// in the queue for retry with the retryable tokens, e.g. when the vendor
+// is failing fast with an open circuit breaker.
+func (p *Pusher) deliver(ctx context.Context, job *queue.Job) bool {
+	logger := log.With(p.logger, "requestID", job.Message.Payload.BusinessID, "jobID", job.ID, "attempts", job.Attempts)
 
-			level.Info(logger).Log("msg", "push message", "deviceToken", device.PushKey)
-			if err != nil {
-				level.Error(logger).Log("msg", "fail push message", "err", err)
-				continue
+	retryable := make([]string, 0)
+	group := p.pool.Group()
+	group.Go(ctx, p.overall.Vendor(job.Vendor), func(ctx context.Context) {
+		result, err := p.push(ctx, logger, job.Vendor, job.Message)
+		if err != nil {
+			if push.KindOf(err) != push.KindPermanent {
+				retryable = job.Message.DeviceTokens
 			}
+			return
 		}
+
+		err = p.queue.Reject(result.Rejected())
+		if err != nil {
+			level.Error(logger).Log("msg", "fail remember rejected pushkeys", "err", err)
+		}
+		retryable = result.Filter(push.StatusRetryable)
+	})
+
+	if err := group.Wait(); err != nil {
+		level.Error(logger).Log("msg", "fail dispatch push message", "err", err)
+		return true
 	}
 
-	w.Write([]byte("{}"))
-	w.Header().Set("Content-Type", "application/json")
+	if len(retryable) == 0 {
+		return false
+	}
+
+	level.Info(logger).Log("msg", "leave push message for retry", "deviceTokens", strings.Join(retryable, ","))
+	job.Message.DeviceTokens = retryable
+	return true
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
 
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Response is the response body of the notify API.
+type Response struct {
+	// Rejected is the list of pushkeys that the homeserver should remove.
+	Rejected []string `json:"rejected"`
+}
+
+// Error is the standard Matrix error response body.
+type Error struct {
+	ErrCode string `json:"errcode"`
+	Err     string `json:"error"`
+}
+
+// writeJSON writes the given body as JSON with the status code.
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
 }
 
-func errorW(w http.ResponseWriter, code int, message string) {
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"code":    code,
-		"message": message,
+// errorW writes a Matrix error response.
+func errorW(w http.ResponseWriter, code int, errCode string, message string) {
+	writeJSON(w, code, &Error{
+		ErrCode: errCode,
+		Err:     message,
 	})
 }
 
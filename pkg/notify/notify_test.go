@@ -0,0 +1,160 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/overall"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+	"gopkg.in/yaml.v3"
+)
+
+// recorderConfig is the config of the recorder provider
+type recorderConfig struct {
+	// Forward makes the recorder a forwarder of the notification
+	Forward bool `yaml:"forward"`
+}
+
+func (c *recorderConfig) Validate() error {
+	return nil
+}
+
+// recorder records the pushed messages of the instance
+type recorder struct {
+	cfg  *recorderConfig
+	name string
+}
+
+var (
+	recordedLocker sync.Mutex
+	recorded       = make(map[string][]*push.Message)
+)
+
+func init() {
+	provider.Register("recorder", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(recorderConfig)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return &recorder{cfg: cfg.(*recorderConfig), name: opts.Name}, nil
+	})
+}
+
+func (r *recorder) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	recordedLocker.Lock()
+	recorded[r.name] = append(recorded[r.name], message)
+	recordedLocker.Unlock()
+	return push.NewResult(message.DeviceTokens, push.StatusDelivered, "", "", ""), nil
+}
+
+func (r *recorder) Forwards() bool {
+	return r.cfg.Forward
+}
+
+func newPusher(t *testing.T) *Pusher {
+	t.Helper()
+	recordedLocker.Lock()
+	recorded = make(map[string][]*push.Message)
+	recordedLocker.Unlock()
+
+	overallCfg := new(overall.Config)
+	err := yaml.Unmarshal([]byte(`
+providers:
+  - name: vendor
+    type: recorder
+    app_ids: [com.example.vendor]
+  - name: forwarder
+    type: recorder
+    forward: true
+    app_ids: [com.example.forwarder]
+`), overallCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := overallCfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	o, err := overall.New(overallCfg, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{PmrConfig: PmrConfig{DefaultTitle: "title", DefaultContent: "content"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(context.Background(), cfg, o, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func notify(t *testing.T, p *Pusher, body string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, notifyPath, strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("code = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+const devices = `"devices": [
+	{"app_id": "com.example.vendor", "pushkey": "vendor-key"},
+	{"app_id": "com.example.forwarder", "pushkey": "forwarder-key"}
+]`
+
+func TestNotifyWithoutSender(t *testing.T) {
+	p := newPusher(t)
+	notify(t, p, `{"notification": {"counts": {"unread": 2}, `+devices+`}}`)
+
+	if len(recorded["vendor"]) != 0 {
+		t.Errorf("vendor pushed %d messages, want none without sender", len(recorded["vendor"]))
+	}
+	if len(recorded["forwarder"]) != 1 {
+		t.Fatalf("forwarder pushed %d messages, want 1", len(recorded["forwarder"]))
+	}
+}
+
+func TestNotifyForwardsRawNotification(t *testing.T) {
+	p := newPusher(t)
+	notify(t, p, `{"notification": {
+		"event_id": "$event",
+		"room_id": "!room:example.org",
+		"sender": "@alice:example.org",
+		"type": "m.room.message",
+		"content": {"msgtype": "m.text", "body": "hello", "format": "org.matrix.custom.html"},
+		"counts": {"unread": 2},
+		"user_is_target": true,
+		`+devices+`
+	}}`)
+
+	if len(recorded["vendor"]) != 1 || len(recorded["forwarder"]) != 1 {
+		t.Fatalf("pushed %d and %d messages, want 1 each", len(recorded["vendor"]), len(recorded["forwarder"]))
+	}
+
+	notification := make(map[string]interface{})
+	if err := json.Unmarshal(recorded["forwarder"][0].Payload.Notification, &notification); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := notification["devices"]; ok {
+		t.Error("devices forwarded")
+	}
+	// the fields unknown to the gateway are kept as received
+	if notification["user_is_target"] != true {
+		t.Errorf("user_is_target = %v, want true", notification["user_is_target"])
+	}
+	content, _ := notification["content"].(map[string]interface{})
+	if content["format"] != "org.matrix.custom.html" {
+		t.Errorf("content = %v, want the format kept", content)
+	}
+	if _, ok := content["m.new_content"]; ok {
+		t.Error("empty fields added to the content")
+	}
+}
@@ -59,6 +59,9 @@ func parseMessage(ctx context.Context, notification Notification, message *push.
 		message.Payload.Title = cfg.DefaultTitle
 	}
 
+	message.Payload.CollapseID = notification.RoomID
+	message.Payload.Priority = notification.Prio
+
 	pmr(ctx, notification, message, cfg)
 }
 
@@ -0,0 +1,123 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Config is the config of the worker pool.
+type Config struct {
+	// Workers is the max number of tasks running at the same time.
+	// Default: 64
+	Workers int `yaml:"workers"`
+
+	// VendorWorkers is the max number of tasks of a vendor running at the
+	// same time, keyed by the provider type, e.g. huawei. The instances of
+	// the same type share the workers of the vendor.
+	// Default: no limit other than Workers
+	VendorWorkers map[string]int `yaml:"vendor_workers"`
+}
+
+func (c *Config) Validate() error {
+	if c.Workers == 0 {
+		c.Workers = 64
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("workers must be positive")
+	}
+	for vendor, workers := range c.VendorWorkers {
+		if workers <= 0 {
+			return fmt.Errorf("workers of vendor %s must be positive", vendor)
+		}
+	}
+	return nil
+}
+
+// Pool bounds the number of tasks running at the same time,
+// both globally and for every vendor.
+type Pool struct {
+	global  chan struct{}
+	vendors map[string]chan struct{}
+}
+
+func New(cfg *Config) *Pool {
+	vendors := make(map[string]chan struct{}, len(cfg.VendorWorkers))
+	for vendor, workers := range cfg.VendorWorkers {
+		vendors[vendor] = make(chan struct{}, workers)
+	}
+
+	return &Pool{
+		global:  make(chan struct{}, cfg.Workers),
+		vendors: vendors,
+	}
+}
+
+// acquire blocks until a worker of the vendor is available.
+func (p *Pool) acquire(ctx context.Context, vendor string) error {
+	if sem, ok := p.vendors[vendor]; ok {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case p.global <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if sem, ok := p.vendors[vendor]; ok {
+			<-sem
+		}
+		return ctx.Err()
+	}
+}
+
+// release releases the worker of the vendor.
+func (p *Pool) release(vendor string) {
+	<-p.global
+	if sem, ok := p.vendors[vendor]; ok {
+		<-sem
+	}
+}
+
+// Group returns a new group of tasks running in the pool.
+func (p *Pool) Group() *Group {
+	return &Group{pool: p}
+}
+
+// Group is a collection of tasks running in the pool.
+type Group struct {
+	pool *Pool
+	wg   sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+// Go runs fn in the pool once a worker of the vendor is available.
+// fn is not called if ctx is done before that.
+func (g *Group) Go(ctx context.Context, vendor string, fn func(ctx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		if err := g.pool.acquire(ctx, vendor); err != nil {
+			g.once.Do(func() {
+				g.err = fmt.Errorf("failed acquire worker of %s: %v", vendor, err)
+			})
+			return
+		}
+		defer g.pool.release(vendor)
+
+		fn(ctx)
+	}()
+}
+
+// Wait blocks until all the tasks are finished, it returns the first error
+// of the tasks that failed to acquire a worker.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
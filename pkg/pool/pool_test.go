@@ -0,0 +1,121 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counter records the max number of tasks running at the same time
+type counter struct {
+	locker          sync.Mutex
+	running, maxRun int
+}
+
+func (c *counter) run(ctx context.Context) {
+	c.locker.Lock()
+	c.running++
+	if c.running > c.maxRun {
+		c.maxRun = c.running
+	}
+	c.locker.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.locker.Lock()
+	c.running--
+	c.locker.Unlock()
+}
+
+func newPool(t *testing.T, cfg *Config) *Pool {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg)
+}
+
+func TestGlobalWorkers(t *testing.T) {
+	p := newPool(t, &Config{Workers: 3})
+
+	c := new(counter)
+	group := p.Group()
+	for i := 0; i < 10; i++ {
+		group.Go(context.Background(), "huawei", c.run)
+	}
+	if err := group.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if c.maxRun != 3 {
+		t.Errorf("max running = %d, want 3", c.maxRun)
+	}
+}
+
+func TestVendorWorkers(t *testing.T) {
+	p := newPool(t, &Config{Workers: 10, VendorWorkers: map[string]int{"huawei": 2}})
+
+	huawei, xiaomi := new(counter), new(counter)
+	group := p.Group()
+	for i := 0; i < 6; i++ {
+		group.Go(context.Background(), "huawei", huawei.run)
+		group.Go(context.Background(), "xiaomi", xiaomi.run)
+	}
+	if err := group.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if huawei.maxRun != 2 {
+		t.Errorf("max running of huawei = %d, want 2", huawei.maxRun)
+	}
+	// the vendors without a limit are bounded by the global workers only
+	if xiaomi.maxRun <= 2 {
+		t.Errorf("max running of xiaomi = %d, want more than 2", xiaomi.maxRun)
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	p := newPool(t, &Config{Workers: 1})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	busy := p.Group()
+	busy.Go(context.Background(), "huawei", func(ctx context.Context) {
+		close(started)
+		<-release
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	called := false
+	group := p.Group()
+	group.Go(ctx, "huawei", func(ctx context.Context) {
+		called = true
+	})
+	cancel()
+
+	if err := group.Wait(); err == nil {
+		t.Error("Wait() = nil, want the failure to acquire a worker")
+	}
+	if called {
+		t.Error("task called after the context is canceled")
+	}
+
+	close(release)
+	if err := busy.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the worker of the canceled task is not leaked
+	group = p.Group()
+	group.Go(context.Background(), "huawei", func(ctx context.Context) {
+		called = true
+	})
+	if err := group.Wait(); err != nil || !called {
+		t.Errorf("Wait() = %v, called %v, want the task run", err, called)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := &Config{VendorWorkers: map[string]int{"huawei": 0}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() = nil, want the error of the vendor workers")
+	}
+}
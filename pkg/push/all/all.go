@@ -0,0 +1,20 @@
+package all
+
+import (
+	_ "github.com/eachchat/yiqia-push/pkg/push/apns"
+	_ "github.com/eachchat/yiqia-push/pkg/push/dingtalk"
+	_ "github.com/eachchat/yiqia-push/pkg/push/email"
+	_ "github.com/eachchat/yiqia-push/pkg/push/fcm"
+	_ "github.com/eachchat/yiqia-push/pkg/push/feishu"
+	_ "github.com/eachchat/yiqia-push/pkg/push/getui"
+	_ "github.com/eachchat/yiqia-push/pkg/push/honor"
+	_ "github.com/eachchat/yiqia-push/pkg/push/huawei"
+	_ "github.com/eachchat/yiqia-push/pkg/push/meizu"
+	_ "github.com/eachchat/yiqia-push/pkg/push/oppo"
+	_ "github.com/eachchat/yiqia-push/pkg/push/unifiedpush"
+	_ "github.com/eachchat/yiqia-push/pkg/push/vivo"
+	_ "github.com/eachchat/yiqia-push/pkg/push/webhook"
+	_ "github.com/eachchat/yiqia-push/pkg/push/webpush"
+	_ "github.com/eachchat/yiqia-push/pkg/push/wecom"
+	_ "github.com/eachchat/yiqia-push/pkg/push/xiaomi"
+)
@@ -0,0 +1,317 @@
+package apns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// newKeyFile writes a .p8 signing key to a temporary file.
+func newKeyFile(t *testing.T) (string, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.p8")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+// newServer starts an HTTP/2 stand-in server of APNs and returns the config
+// pushing to it with the token-based auth.
+func newServer(t *testing.T, handler http.HandlerFunc) (*Config, *ecdsa.PrivateKey) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, key := newKeyFile(t)
+	cfg := &Config{
+		Topic:   "com.example.app",
+		Host:    srv.URL,
+		CAFile:  caFile,
+		KeyFile: keyFile,
+		KeyID:   "KEYID",
+		TeamID:  "TEAMID",
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, key
+}
+
+func newAPNS(t *testing.T, cfg *Config) push.Push {
+	t.Helper()
+	p, err := New(cfg, &provider.Options{Name: "apns", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// verifyToken verifies the ES256 provider token and returns its claims.
+func verifyToken(t *testing.T, value string, key *ecdsa.PublicKey) (map[string]string, map[string]interface{}) {
+	t.Helper()
+	parts := strings.Split(strings.TrimPrefix(value, "bearer "), ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q is not a JWT", value)
+	}
+
+	encoding := base64.RawURLEncoding
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		t.Fatalf("invalid signature %q: %v", parts[2], err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		t.Fatal("signature not verified")
+	}
+
+	header := make(map[string]string)
+	claims := make(map[string]interface{})
+	for i, v := range []interface{}{&header, &claims} {
+		data, err := encoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return header, claims
+}
+
+func TestSignToken(t *testing.T) {
+	keyFile, key := newKeyFile(t)
+	signingKey, err := loadSigningKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints := &Endpoints{key: signingKey}
+	token, err := endpoints.signToken("KEYID", "TEAMID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token.Value, "bearer ") {
+		t.Errorf("token %q, want the bearer scheme", token.Value)
+	}
+	if lifetime := token.ExpiresAt.Sub(token.FetchedAt); lifetime >= time.Hour {
+		t.Errorf("lifetime = %v, want less than an hour", lifetime)
+	}
+
+	header, claims := verifyToken(t, token.Value, &key.PublicKey)
+	if header["alg"] != "ES256" || header["kid"] != "KEYID" {
+		t.Errorf("header = %v, want ES256 with the key id", header)
+	}
+	if claims["iss"] != "TEAMID" {
+		t.Errorf("iss = %v, want TEAMID", claims["iss"])
+	}
+	if iat, _ := claims["iat"].(float64); time.Since(time.Unix(int64(iat), 0)) > time.Minute {
+		t.Errorf("iat = %v, want now", claims["iat"])
+	}
+}
+
+func TestPushNoticeRequest(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	cfg, key := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+		w.Header().Set("apns-id", "apns-id")
+	})
+	cfg.MutableContent = true
+	p := newAPNS(t, cfg)
+
+	result, err := p.PushNotice(context.Background(), &push.Message{
+		DeviceTokens: []string{"device"},
+		Payload: &push.Payload{
+			Title:        "title",
+			Content:      "content",
+			CollapseID:   "!room:example.org",
+			Priority:     "low",
+			Notification: json.RawMessage(`{"room_id":"!room:example.org","event_id":"$event","counts":{"unread":3}}`),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Tokens[0].Status != push.StatusDelivered {
+		t.Errorf("status = %v, want delivered", result.Tokens[0].Status)
+	}
+
+	if req.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2", req.Proto)
+	}
+	if req.URL.Path != "/3/device/device" {
+		t.Errorf("path = %s, want /3/device/device", req.URL.Path)
+	}
+	headers := map[string]string{
+		"apns-topic":       "com.example.app",
+		"apns-push-type":   "alert",
+		"apns-priority":    "5",
+		"apns-collapse-id": "!room:example.org",
+	}
+	for name, want := range headers {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	verifyToken(t, req.Header.Get("Authorization"), &key.PublicKey)
+
+	payload := new(struct {
+		Aps struct {
+			Alert struct {
+				Title string `json:"title"`
+				Body  string `json:"body"`
+			} `json:"alert"`
+			Badge          *int `json:"badge"`
+			MutableContent int  `json:"mutable-content"`
+		} `json:"aps"`
+		RoomID  string `json:"room_id"`
+		EventID string `json:"event_id"`
+	})
+	if err := json.Unmarshal(body, payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Aps.Alert.Title != "title" || payload.Aps.Alert.Body != "content" {
+		t.Errorf("alert = %+v", payload.Aps.Alert)
+	}
+	if payload.Aps.Badge == nil || *payload.Aps.Badge != 3 {
+		t.Errorf("badge = %v, want 3", payload.Aps.Badge)
+	}
+	if payload.Aps.MutableContent != 1 {
+		t.Errorf("mutable-content = %d, want 1", payload.Aps.MutableContent)
+	}
+	if payload.RoomID != "!room:example.org" || payload.EventID != "$event" {
+		t.Errorf("room_id = %q, event_id = %q", payload.RoomID, payload.EventID)
+	}
+}
+
+func TestPushNoticeWithoutCounts(t *testing.T) {
+	var body []byte
+	cfg, _ := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	})
+	p := newAPNS(t, cfg)
+
+	_, err := p.PushNotice(context.Background(), &push.Message{
+		DeviceTokens: []string{"device"},
+		Payload:      &push.Payload{Notification: json.RawMessage(`{"event_id":"$event"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the badge is kept on the device
+	if strings.Contains(string(body), "badge") {
+		t.Errorf("body %s, want no badge", body)
+	}
+}
+
+func TestPushNoticeStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   int
+		reason string
+		want   push.Status
+	}{
+		{"bad device token", http.StatusBadRequest, reasonBadDeviceToken, push.StatusRejected},
+		{"unregistered", http.StatusGone, reasonUnregistered, push.StatusRejected},
+		{"device token not for topic", http.StatusBadRequest, reasonDeviceTokenNotForTopic, push.StatusRejected},
+		{"too many requests", http.StatusTooManyRequests, "TooManyRequests", push.StatusRetryable},
+		{"internal server error", http.StatusInternalServerError, "InternalServerError", push.StatusRetryable},
+		{"service unavailable", http.StatusServiceUnavailable, "ServiceUnavailable", push.StatusRetryable},
+		{"bad topic", http.StatusBadRequest, "BadTopic", push.StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+				_ = json.NewEncoder(w).Encode(map[string]string{"reason": tt.reason})
+			})
+			p := newAPNS(t, cfg)
+
+			tokens := []string{"device"}
+			result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: tokens, Payload: &push.Payload{}})
+			if err != nil {
+				result = push.FailedResult(tokens, err)
+			}
+			if got := result.Tokens[0].Status; got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushNoticeConcurrent(t *testing.T) {
+	var locker sync.Mutex
+	var running, maxRunning int
+	cfg, _ := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		locker.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		locker.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		locker.Lock()
+		running--
+		locker.Unlock()
+	})
+	cfg.Concurrency = 2
+	p := newAPNS(t, cfg)
+
+	tokens := []string{"a", "b", "c", "d", "e"}
+	result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: tokens, Payload: &push.Payload{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != len(tokens) {
+		t.Errorf("result = %+v, want delivered", result.Tokens)
+	}
+
+	locker.Lock()
+	defer locker.Unlock()
+	if maxRunning != 2 {
+		t.Errorf("max concurrent requests = %d, want 2", maxRunning)
+	}
+}
@@ -0,0 +1,315 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	productionHost = "https://api.push.apple.com"
+	sandboxHost    = "https://api.sandbox.push.apple.com"
+)
+
+// tokenLifetime is the lifetime of the provider token. APNs rejects the
+// tokens older than one hour, and the tokens refreshed more than once
+// every 20 minutes.
+const tokenLifetime = 50 * time.Minute
+
+// maxCollapseIDSize is the max size of the apns-collapse-id header.
+const maxCollapseIDSize = 64
+
+type Endpoints struct {
+	// tokens is nil with the certificate-based auth
+	tokens *token.Manager
+	key    *ecdsa.PrivateKey
+
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, cfg *Config, opts *provider.Options, client *http.Client) (*Endpoints, error) {
+	logger := opts.Logger
+	tgt, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	tgt.Path = ""
+
+	endpoints := &Endpoints{}
+	if cfg.KeyFile != "" {
+		endpoints.key, err = loadSigningKey(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	options := []httptransport.ClientOption{
+		httptransport.SetClient(client),
+		httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
+			if value, ok := token.FromContext(ctx); ok {
+				r.Header.Set("Authorization", value)
+			}
+			return ctx
+		}),
+	}
+
+	endpoints.PushNoticeEndpoint = httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+		req := request.(*push.Message)
+		r.URL.Path = "/3/device/" + req.DeviceTokens[0]
+
+		// more info: https://developer.apple.com/documentation/usernotifications/generating-a-remote-notification
+		body := &struct {
+			Aps struct {
+				Alert struct {
+					Title string `json:"title,omitempty"`
+					Body  string `json:"body,omitempty"`
+				} `json:"alert"`
+				Badge          *int   `json:"badge,omitempty"`
+				Sound          string `json:"sound,omitempty"`
+				MutableContent int    `json:"mutable-content,omitempty"`
+			} `json:"aps"`
+			// the app fetches the event of the notification with them
+			RoomID  string `json:"room_id,omitempty"`
+			EventID string `json:"event_id,omitempty"`
+		}{}
+		body.Aps.Alert.Title = req.Payload.Title
+		body.Aps.Alert.Body = req.Payload.Content
+		body.Aps.Sound = "default"
+		if cfg.MutableContent {
+			body.Aps.MutableContent = 1
+		}
+
+		if len(req.Payload.Notification) > 0 {
+			notification := new(matrixNotification)
+			err := json.Unmarshal(req.Payload.Notification, notification)
+			if err != nil {
+				return push.Permanent("", fmt.Errorf("failed decode notification: %w", err))
+			}
+			body.RoomID = notification.RoomID
+			body.EventID = notification.EventID
+			body.Aps.Badge = notification.Counts.Unread
+		}
+
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			return err
+		}
+
+		priority := cfg.Priority
+		if req.Payload.Priority == "low" {
+			priority = PriorityPowerSaving
+		}
+
+		r.Body = io.NopCloser(&buf)
+		r.ContentLength = int64(buf.Len())
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("apns-topic", cfg.Topic)
+		r.Header.Set("apns-push-type", "alert")
+		r.Header.Set("apns-priority", strconv.Itoa(priority))
+		if collapseID := collapseID(req.Payload.CollapseID); collapseID != "" {
+			r.Header.Set("apns-collapse-id", collapseID)
+		}
+		return nil
+	}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+		defer resp.Body.Close()
+
+		body := &pushNoticeResponse{
+			ID: resp.Header.Get("apns-id"),
+		}
+		if resp.StatusCode == http.StatusOK {
+			return body, nil
+		}
+
+		// the failure reason is in the body of the failed response
+		if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+			return nil, push.HTTPError(resp)
+		}
+		if _, ok := rejectedReasons[body.Reason]; ok {
+			return body, nil
+		}
+
+		err = fmt.Errorf("failed push notice: %s, status: %s, apnsID: %s", body.Reason, resp.Status, body.ID)
+		switch {
+		case resp.StatusCode == http.StatusForbidden && authFailureReasons[body.Reason]:
+			return body, push.Transient(body.Reason, token.Unauthorized(err))
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return body, push.RateLimited(body.Reason, err)
+		case resp.StatusCode >= http.StatusInternalServerError:
+			return body, push.Transient(body.Reason, err)
+		}
+		return body, push.Permanent(body.Reason, err)
+	}, options...).Endpoint()
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("apns", "push")(endpoints.PushNoticeEndpoint)
+
+	if endpoints.key != nil {
+		endpoints.tokens = token.New("apns:"+cfg.TeamID+":"+cfg.KeyID, func(ctx context.Context) (*token.Token, error) {
+			return endpoints.signToken(cfg.KeyID, cfg.TeamID)
+		}, opts.TokenStore, logger)
+		endpoints.tokens.Start(ctx)
+		endpoints.PushNoticeEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeEndpoint)
+	}
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// collapseID returns the apns-collapse-id of the notification, the id longer
+// than the header allows is replaced by its hash.
+func collapseID(id string) string {
+	if len(id) <= maxCollapseIDSize {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// failure reasons of the push notice api.
+// more info: https://developer.apple.com/documentation/usernotifications/handling-notification-responses-from-apns
+const (
+	// the device token is invalid
+	reasonBadDeviceToken = "BadDeviceToken"
+	// the device token is no longer active for the topic
+	reasonUnregistered = "Unregistered"
+	// the device token is of another topic, e.g. another app
+	reasonDeviceTokenNotForTopic = "DeviceTokenNotForTopic"
+	// the provider token is stale
+	reasonExpiredProviderToken = "ExpiredProviderToken"
+	// the provider token is not valid, or its signature can't be verified
+	reasonInvalidProviderToken = "InvalidProviderToken"
+)
+
+// rejectedReasons are the failure reasons of the invalid device tokens.
+var rejectedReasons = map[string]struct{}{
+	reasonBadDeviceToken:         {},
+	reasonUnregistered:           {},
+	reasonDeviceTokenNotForTopic: {},
+}
+
+// authFailureReasons are the failure reasons refreshing the provider token.
+var authFailureReasons = map[string]bool{
+	reasonExpiredProviderToken: true,
+	reasonInvalidProviderToken: true,
+}
+
+// matrixNotification is the part of the Matrix notification sent to the app.
+// more info: https://spec.matrix.org/latest/push-gateway-api/#post_matrixpushv1notify
+type matrixNotification struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+	Counts  struct {
+		// Unread is the badge of the app, the badge is kept if the
+		// homeserver omits the counts.
+		Unread *int `json:"unread"`
+	} `json:"counts"`
+}
+
+type pushNoticeResponse struct {
+	ID     string `json:"-"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// result returns the push result of the tokens.
+func (r *pushNoticeResponse) result(tokens []string) *push.Result {
+	result := push.NewResult(tokens, push.StatusDelivered, r.ID, r.Reason, r.Reason)
+	if _, ok := rejectedReasons[r.Reason]; ok {
+		result.SetStatus(tokens, push.StatusRejected)
+	}
+	return result
+}
+
+// loadSigningKey loads the .p8 signing key of the token-based auth.
+func loadSigningKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed read APNs key file: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block in APNs key file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse APNs key: %v", err)
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// signToken signs the provider token, a JWT signed with ES256.
+// more info: https://developer.apple.com/documentation/usernotifications/establishing-a-token-based-connection-to-apns
+func (endpoints *Endpoints) signToken(keyID string, teamID string) (*token.Token, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "ES256",
+		"kid": keyID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": teamID,
+		"iat": now.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, endpoints.key, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed sign provider token: %v", err)
+	}
+
+	// the signature is the big-endian r and s padded to the key size
+	size := (endpoints.key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+
+	return &token.Token{
+		Value:     "bearer " + unsigned + "." + encoding.EncodeToString(signature),
+		ExpiresAt: now.Add(tokenLifetime),
+		FetchedAt: now,
+	}, nil
+}
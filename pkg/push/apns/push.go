@@ -0,0 +1,206 @@
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type APNS struct {
+	cfg       *Config
+	endpoints *Endpoints
+	// cert is the client certificate of the certificate-based auth
+	cert *x509.Certificate
+}
+
+func init() {
+	provider.Register("apns", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	p := &APNS{cfg: cfg}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.KeyFile == "" {
+		keyFile := cfg.CertKeyFile
+		if keyFile == "" {
+			keyFile = cfg.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed load APNs certificate: %v", err)
+		}
+		p.cert, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed parse APNs certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client, err := newHTTPClient(cfg, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	p.endpoints, err = newEndpoints(context.Background(), cfg, opts, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed create APNs endpoints: %v", err)
+	}
+	return p, nil
+}
+
+// newHTTPClient returns the HTTP/2 client of APNs.
+func newHTTPClient(cfg *Config, tlsConfig *tls.Config) (*http.Client, error) {
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed read APNs ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in APNs ca file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// Check signs the provider token with the token-based auth, or checks the
+// expiry of the client certificate with the certificate-based auth.
+func (p *APNS) Check(ctx context.Context) error {
+	if p.endpoints.tokens != nil {
+		_, err := p.endpoints.tokens.Get(ctx)
+		return err
+	}
+
+	if time.Now().After(p.cert.NotAfter) {
+		return fmt.Errorf("APNs certificate expired at %s", p.cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// APNs accepts one device token per request, the requests of the tokens are
+// sent concurrently and multiplexed on the HTTP/2 connection.
+const maxBatchSize = 1
+
+func (p *APNS) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.BatchConcurrent(ctx, message, maxBatchSize, p.cfg.Concurrency, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+}
+
+// APNs priorities
+const (
+	// PriorityImmediate sends the notification immediately
+	PriorityImmediate = 10
+	// PriorityPowerSaving sends the notification considering the power of the device
+	PriorityPowerSaving = 5
+)
+
+type Config struct {
+	// Topic is the bundle id of the app.
+	Topic string `yaml:"topic"`
+
+	// Sandbox pushes to the development environment of APNs.
+	Sandbox bool `yaml:"sandbox"`
+
+	// Host overrides the APNs host, e.g. a local stand-in server.
+	// Default: the production or sandbox host
+	Host string `yaml:"host"`
+
+	// CAFile is the CA certificates verifying the host, the system
+	// certificates are used if it is empty.
+	CAFile string `yaml:"ca_file"`
+
+	// KeyFile is the .p8 signing key of the token-based auth, the key id
+	// and the team id are required with it.
+	KeyFile string `yaml:"key_file"`
+	KeyID   string `yaml:"key_id"`
+	TeamID  string `yaml:"team_id"`
+
+	// CertFile is the PEM client certificate of the certificate-based auth,
+	// it is used if the key file is empty. CertKeyFile is the PEM private key
+	// of the certificate, which is read from the cert file if it is empty.
+	CertFile    string `yaml:"cert_file"`
+	CertKeyFile string `yaml:"cert_key_file"`
+
+	// Priority is the priority of the notifications: 10 or 5, the low
+	// priority notifications are always sent with 5.
+	// Default: 10
+	Priority int `yaml:"priority"`
+
+	// MutableContent lets the notification service extension of the app
+	// modify the notifications.
+	MutableContent bool `yaml:"mutable_content"`
+
+	// Concurrency is the max number of requests of a message sent at the
+	// same time.
+	// Default: 16
+	Concurrency int `yaml:"concurrency"`
+}
+
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		c.Host = productionHost
+		if c.Sandbox {
+			c.Host = sandboxHost
+		}
+	}
+	if c.Priority == 0 {
+		c.Priority = PriorityImmediate
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 16
+	}
+
+	if c.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	if c.Priority != PriorityImmediate && c.Priority != PriorityPowerSaving {
+		return fmt.Errorf("invalid priority: %d", c.Priority)
+	}
+	if c.Concurrency < 0 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+
+	switch {
+	case c.KeyFile != "":
+		if c.KeyID == "" {
+			return fmt.Errorf("key id is required")
+		}
+		if c.TeamID == "" {
+			return fmt.Errorf("team id is required")
+		}
+	case c.CertFile == "":
+		return fmt.Errorf("key file or cert file is required")
+	}
+	return nil
+}
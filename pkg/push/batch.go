@@ -0,0 +1,91 @@
+package push
+
+import (
+	"context"
+	"sync"
+)
+
+// Chunk splits the tokens into chunks of at most size tokens.
+func Chunk(tokens []string, size int) [][]string {
+	if size <= 0 {
+		return [][]string{tokens}
+	}
+
+	chunks := make([][]string, 0, (len(tokens)+size-1)/size)
+	for size < len(tokens) {
+		chunks = append(chunks, tokens[:size:size])
+		tokens = tokens[size:]
+	}
+	return append(chunks, tokens)
+}
+
+// Batch splits the device tokens of the message into chunks of at most size
+// tokens, pushes every chunk with fn and merges the results.
+// The tokens of a failed chunk are reported by FailedResult, the error is
+// returned only when every chunk failed.
+func Batch(ctx context.Context, message *Message, size int, fn func(ctx context.Context, message *Message) (*Result, error)) (*Result, error) {
+	chunks := Chunk(message.DeviceTokens, size)
+
+	results := make([]*Result, len(chunks))
+	errs := make([]error, len(chunks))
+	for i, tokens := range chunks {
+		chunk := *message
+		chunk.DeviceTokens = tokens
+
+		results[i], errs[i] = fn(ctx, &chunk)
+	}
+	return merge(chunks, results, errs)
+}
+
+// BatchConcurrent is Batch pushing at most concurrency chunks at the same
+// time, e.g. the chunks of a single token of the vendors without batching.
+// The results are merged in the order of the chunks.
+func BatchConcurrent(ctx context.Context, message *Message, size int, concurrency int, fn func(ctx context.Context, message *Message) (*Result, error)) (*Result, error) {
+	chunks := Chunk(message.DeviceTokens, size)
+	if concurrency <= 1 || len(chunks) == 1 {
+		return Batch(ctx, message, size, fn)
+	}
+
+	results := make([]*Result, len(chunks))
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, tokens := range chunks {
+		chunk := *message
+		chunk.DeviceTokens = tokens
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i], errs[i] = fn(ctx, &chunk)
+		}()
+	}
+	wg.Wait()
+	return merge(chunks, results, errs)
+}
+
+// merge merges the results of the chunks, the tokens of a failed chunk are
+// reported by FailedResult. The error is returned only when every chunk
+// failed.
+func merge(chunks [][]string, results []*Result, errs []error) (*Result, error) {
+	var failed int
+	var lastErr error
+	result := &Result{}
+	for i, tokens := range chunks {
+		if errs[i] != nil {
+			failed++
+			lastErr = errs[i]
+			result.Merge(FailedResult(tokens, errs[i]))
+			continue
+		}
+		result.Merge(results[i])
+	}
+
+	if failed == len(chunks) {
+		return nil, lastErr
+	}
+	return result, nil
+}
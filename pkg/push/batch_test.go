@@ -0,0 +1,61 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchConcurrent(t *testing.T) {
+	message := &Message{DeviceTokens: []string{"a", "b", "c", "d", "e", "f", "g", "h"}}
+
+	var locker sync.Mutex
+	var running, maxRunning int
+	result, err := BatchConcurrent(context.Background(), message, 1, 3, func(ctx context.Context, message *Message) (*Result, error) {
+		locker.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		locker.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		locker.Lock()
+		running--
+		locker.Unlock()
+		if message.DeviceTokens[0] == "c" {
+			return nil, Permanent("400", errors.New("bad request"))
+		}
+		return NewResult(message.DeviceTokens, StatusDelivered, "", "", ""), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxRunning != 3 {
+		t.Errorf("max running chunks = %d, want 3", maxRunning)
+	}
+	for i, token := range result.Tokens {
+		want := StatusDelivered
+		if token.Token == "c" {
+			want = StatusFailed
+		}
+		if token.Token != message.DeviceTokens[i] || token.Status != want {
+			t.Errorf("result %d = %+v, want %s %v in the order of the chunks", i, token, message.DeviceTokens[i], want)
+		}
+	}
+}
+
+func TestBatchConcurrentAllFailed(t *testing.T) {
+	message := &Message{DeviceTokens: []string{"a", "b", "c"}}
+
+	_, err := BatchConcurrent(context.Background(), message, 1, 2, func(ctx context.Context, message *Message) (*Result, error) {
+		return nil, Transient("503", errors.New("unavailable"))
+	})
+	if KindOf(err) != KindTransient {
+		t.Errorf("err = %v, want the transient failure of the chunks", err)
+	}
+}
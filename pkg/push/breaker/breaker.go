@@ -0,0 +1,143 @@
+package breaker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/log"
+	"github.com/sony/gobreaker"
+)
+
+// codeOpen is the code of the push failure when the breaker fails fast.
+const codeOpen = "circuit_open"
+
+type Config struct {
+	// ConsecutiveFailures is the number of the consecutive transient
+	// failures to open the breaker.
+	// Default: 5
+	ConsecutiveFailures uint32 `yaml:"consecutive_failures"`
+
+	// Timeout is the duration of the open state, after which the breaker
+	// becomes half-open.
+	// Default: 30s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxRequests is the max number of the requests allowed to pass
+	// through the half-open breaker.
+	// Default: 1
+	MaxRequests uint32 `yaml:"max_requests"`
+
+	// Interval is the cyclic period of the closed state to clear the
+	// failure counts, the counts are never cleared if it is 0.
+	// Default: 60s
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c *Config) Validate() error {
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+	if c.MaxRequests == 0 {
+		c.MaxRequests = 1
+	}
+	if c.Interval == 0 {
+		c.Interval = 60 * time.Second
+	}
+	if c.Timeout < 0 || c.Interval < 0 {
+		return fmt.Errorf("durations must be positive")
+	}
+	return nil
+}
+
+var (
+	locker   sync.Mutex
+	breakers = make(map[string]*gobreaker.CircuitBreaker)
+)
+
+// Middleware returns an endpoint middleware with the circuit breaker of the
+// name. Only the transient and rate limited failures count against the
+// breaker, the requests failing fast are reported as transient failures so
+// that they can be retried later.
+func Middleware(name string, cfg *Config, logger log.Logger) endpoint.Middleware {
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        name,
+		MaxRequests: cfg.MaxRequests,
+		Interval:    cfg.Interval,
+		Timeout:     cfg.Timeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= cfg.ConsecutiveFailures
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			level.Warn(logger).Log("msg", "circuit breaker state changed", "breaker", name, "from", from, "to", to)
+		},
+		IsSuccessful: func(err error) bool {
+			return err == nil || push.KindOf(err) == push.KindPermanent
+		},
+	})
+
+	locker.Lock()
+	breakers[name] = cb
+	locker.Unlock()
+
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		next = circuitbreaker.Gobreaker(cb)(next)
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+				return nil, push.Transient(codeOpen, fmt.Errorf("circuit breaker %s: %v", name, err))
+			}
+			return response, err
+		}
+	}
+}
+
+// State is the state of a circuit breaker
+type State struct {
+	Name                string `json:"name"`
+	State               string `json:"state"`
+	Requests            uint32 `json:"requests"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+}
+
+// States returns the states of all the circuit breakers, sorted by name.
+func States() []State {
+	locker.Lock()
+	defer locker.Unlock()
+
+	states := make([]State, 0, len(breakers))
+	for name, cb := range breakers {
+		counts := cb.Counts()
+		states = append(states, State{
+			Name:                name,
+			State:               cb.State().String(),
+			Requests:            counts.Requests,
+			ConsecutiveFailures: counts.ConsecutiveFailures,
+		})
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// Handler returns the http handler reporting the states of the circuit breakers.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(States())
+	})
+}
@@ -0,0 +1,138 @@
+package dingtalk
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// bot is a stand-in of the DingTalk bot api
+type bot struct {
+	errCode int
+
+	query url.Values
+	body  map[string]interface{}
+}
+
+func (b *bot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != sendPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b.query = r.URL.Query()
+	_ = json.NewDecoder(r.Body).Decode(&b.body)
+	fmt.Fprintf(w, `{"errcode":%d,"errmsg":"message"}`, b.errCode)
+}
+
+func newDingTalk(t *testing.T, b *bot, cfg *Config) push.Push {
+	t.Helper()
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+
+	cfg.Host = srv.URL
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPushClient(cfg, &provider.Options{Name: "dingtalk", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newMessage() *push.Message {
+	return &push.Message{
+		DeviceTokens: []string{"a", "b"},
+		Payload:      &push.Payload{Title: "Alice", Content: "**hi**"},
+	}
+}
+
+func TestSign(t *testing.T) {
+	b := new(bot)
+	p := newDingTalk(t, b, &Config{AccessToken: "token", Secret: "SEC"})
+
+	result, err := p.PushNotice(context.Background(), newMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != 2 {
+		t.Errorf("result = %+v, want the pushkeys delivered", result.Tokens)
+	}
+
+	if got := b.query.Get("access_token"); got != "token" {
+		t.Errorf("access_token = %q, want the token of the instance", got)
+	}
+	timestamp := b.query.Get("timestamp")
+	mac := hmac.New(sha256.New, []byte("SEC"))
+	mac.Write([]byte(timestamp + "\nSEC"))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); b.query.Get("sign") != want {
+		t.Errorf("sign = %q, want %q", b.query.Get("sign"), want)
+	}
+}
+
+func TestNotSignedWithoutSecret(t *testing.T) {
+	b := new(bot)
+	p := newDingTalk(t, b, &Config{AccessToken: "token"})
+
+	if _, err := p.PushNotice(context.Background(), newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if b.query.Has("timestamp") || b.query.Has("sign") {
+		t.Errorf("query = %v, want no sign", b.query)
+	}
+}
+
+func TestMarkdownEscaped(t *testing.T) {
+	b := new(bot)
+	p := newDingTalk(t, b, &Config{AccessToken: "token", MessageType: MessageMarkdown})
+
+	if _, err := p.PushNotice(context.Background(), newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	markdown := b.body["markdown"].(map[string]interface{})
+	if text := markdown["text"].(string); !strings.HasSuffix(text, `\*\*hi\*\*`) {
+		t.Errorf("text = %q, want the content escaped", text)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		errCode int
+		want    push.Kind
+	}{
+		{"system busy", -1, push.KindTransient},
+		{"send too fast", 130101, push.KindRateLimited},
+		{"invalid access token", 300001, push.KindPermanent},
+		{"unknown", 400000, push.KindPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newDingTalk(t, &bot{errCode: tt.errCode}, &Config{AccessToken: "token"})
+
+			_, err := p.PushNotice(context.Background(), newMessage())
+			if err == nil {
+				t.Fatal("err = nil, want the failure of the code")
+			}
+			if got := push.KindOf(err); got != tt.want {
+				t.Errorf("KindOf() = %v, want %v", got, tt.want)
+			}
+			// the pushers are not rejected for a failure of the bot
+			if got := push.FailedResult([]string{"a"}, err).Filter(push.StatusRejected); len(got) != 0 {
+				t.Errorf("rejected = %v, want none", got)
+			}
+		})
+	}
+}
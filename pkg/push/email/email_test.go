@@ -0,0 +1,345 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// parts returns the headers and the decoded parts of the email by their
+// content types.
+func parts(t *testing.T, data []byte) (mail.Header, map[string]string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := make(map[string]string)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		decoded[mediaType] = string(content)
+	}
+	return msg.Header, decoded
+}
+
+func newRenderConfig(t *testing.T, subject string) *Config {
+	t.Helper()
+	cfg := &Config{Host: "smtp.example.com", From: "Yiqia <noreply@example.com>", Subject: subject}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRenderSubject(t *testing.T) {
+	from := &mail.Address{Name: "Yiqia", Address: "noreply@example.com"}
+	to := &mail.Address{Address: "alice@example.com"}
+
+	tests := []struct {
+		name    string
+		subject string
+		title   string
+		want    string
+	}{
+		{"title", "", "Room", "Room"},
+		{"configured", "New messages", "Room", "New messages"},
+		{"crlf folded", "", "Room\r\nBcc: eve@example.com", "Room Bcc: eve@example.com"},
+		{"lf folded", "", "Room\n\nX-Injected: 1", "Room X-Injected: 1"},
+		{"encoded", "", "房间 Room", "房间 Room"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, messageID, err := render(newRenderConfig(t, tt.subject), from, to, &push.Payload{Title: tt.title}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, _ := parts(t, data)
+
+			subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != tt.want {
+				t.Errorf("Subject = %q, want %q", subject, tt.want)
+			}
+			for _, injected := range []string{"Bcc", "X-Injected"} {
+				if header.Get(injected) != "" {
+					t.Errorf("header %s injected", injected)
+				}
+			}
+			if header.Get("Message-ID") != messageID || !strings.HasSuffix(messageID, "@example.com>") {
+				t.Errorf("Message-ID = %q, want %q of the sender domain", header.Get("Message-ID"), messageID)
+			}
+		})
+	}
+}
+
+func TestRenderBody(t *testing.T) {
+	from := &mail.Address{Address: "noreply@example.com"}
+	to := &mail.Address{Address: "alice@example.com"}
+	payload := &push.Payload{Title: "Tom & Jerry", Content: `<script>alert("hi")</script>`}
+
+	data, _, err := render(newRenderConfig(t, ""), from, to, payload, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, decoded := parts(t, data)
+
+	text, html := decoded["text/plain"], decoded["text/html"]
+	if !strings.Contains(text, payload.Content) || !strings.Contains(text, payload.Title) {
+		t.Errorf("text part %q, want the raw title and content", text)
+	}
+	if strings.Contains(html, "<script>") || !strings.Contains(html, "&lt;script&gt;") || !strings.Contains(html, "Tom &amp; Jerry") {
+		t.Errorf("html part %q, want the title and content escaped", html)
+	}
+	for _, part := range []string{text, html} {
+		if !strings.Contains(part, "3 more notifications since the last email.") {
+			t.Errorf("part %q, want the suppressed line", part)
+		}
+	}
+
+	// no suppressed line without the suppressed notifications
+	data, _, err = render(newRenderConfig(t, ""), from, to, payload, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, decoded = parts(t, data)
+	for _, part := range decoded {
+		if strings.Contains(part, "more notifications") {
+			t.Errorf("part %q, want no suppressed line", part)
+		}
+	}
+}
+
+// fakeSMTP is a scripted SMTP server
+type fakeSMTP struct {
+	listener net.Listener
+	// startTLS advertises the STARTTLS extension
+	startTLS bool
+	locker   sync.Mutex
+	// rcpt is the reply of RCPT TO
+	rcpt string
+	data []string
+}
+
+func newFakeSMTP(t *testing.T, startTLS bool, rcpt string) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	f := &fakeSMTP{listener: listener, startTLS: startTLS, rcpt: rcpt}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		_, _ = io.WriteString(conn, line+"\r\n")
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch command {
+		case "EHLO", "HELO":
+			if f.startTLS {
+				reply("250-fake")
+				reply("250 STARTTLS")
+			} else {
+				reply("250 fake")
+			}
+		case "MAIL":
+			reply("250 OK")
+		case "RCPT":
+			f.locker.Lock()
+			rcpt := f.rcpt
+			f.locker.Unlock()
+			reply(rcpt)
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			f.locker.Lock()
+			f.data = append(f.data, data.String())
+			f.locker.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (f *fakeSMTP) newEmail(t *testing.T, security string) push.Push {
+	t.Helper()
+	addr := f.listener.Addr().(*net.TCPAddr)
+	cfg := &Config{
+		Host:     "127.0.0.1",
+		Port:     addr.Port,
+		Security: security,
+		From:     "Yiqia <noreply@example.com>",
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, &provider.Options{Name: "email", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newMessage(addresses ...string) *push.Message {
+	message := &push.Message{
+		DeviceData: make(map[string]map[string]interface{}),
+		Payload:    &push.Payload{Title: "title", Content: "content"},
+	}
+	for i, address := range addresses {
+		token := "pushkey" + strconv.Itoa(i)
+		message.DeviceTokens = append(message.DeviceTokens, token)
+		message.DeviceData[token] = map[string]interface{}{dataAddress: address}
+	}
+	return message
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name     string
+		security string
+		startTLS bool
+		rcpt     string
+		want     push.Status
+	}{
+		{"sent", SecurityNone, false, "250 OK", push.StatusDelivered},
+		{"mailbox unavailable", SecurityNone, false, "550 5.1.1 no such user", push.StatusRejected},
+		{"null mx", SecurityNone, false, "556 5.1.10 null MX", push.StatusRejected},
+		{"mailbox name not allowed", SecurityNone, false, "553 5.1.3 bad address", push.StatusFailed},
+		{"mailbox full", SecurityNone, false, "552 5.2.2 mailbox full", push.StatusFailed},
+		{"without enhanced status", SecurityNone, false, "550 no such user", push.StatusFailed},
+		{"spam", SecurityNone, false, "550 5.7.1 message refused", push.StatusFailed},
+		{"greylisted", SecurityNone, false, "451 4.7.1 try again later", push.StatusRetryable},
+		{"policy", SecurityNone, false, "554 5.7.1 relay denied", push.StatusFailed},
+		{"missing starttls", SecurityStartTLS, false, "250 OK", push.StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSMTP(t, tt.startTLS, tt.rcpt)
+			message := newMessage("alice@example.com")
+
+			result, err := f.newEmail(t, tt.security).PushNotice(context.Background(), message)
+			if err != nil {
+				result = push.FailedResult(message.DeviceTokens, err)
+			}
+			if got := result.Tokens[0].Status; got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+
+			f.locker.Lock()
+			defer f.locker.Unlock()
+			if sent := len(f.data) == 1; sent != (tt.want == push.StatusDelivered) {
+				t.Errorf("emails sent = %d", len(f.data))
+			}
+		})
+	}
+}
+
+func TestSendThrottled(t *testing.T) {
+	f := newFakeSMTP(t, false, "250 OK")
+	p := f.newEmail(t, SecurityNone)
+
+	result, err := p.PushNotice(context.Background(), newMessage("alice@example.com", "Alice@Example.com", "not an address"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []push.Status{push.StatusDelivered, push.StatusSuppressed, push.StatusRejected}
+	for i, token := range result.Tokens {
+		if token.Status != want[i] {
+			t.Errorf("status of %s = %v, want %v", token.Token, token.Status, want[i])
+		}
+	}
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	if len(f.data) != 1 {
+		t.Errorf("emails sent = %d, want 1", len(f.data))
+	}
+}
+
+func TestSendRetriedAfterTransientFailure(t *testing.T) {
+	f := newFakeSMTP(t, false, "451 4.7.1 try again later")
+	p := f.newEmail(t, SecurityNone)
+
+	if _, err := p.PushNotice(context.Background(), newMessage("alice@example.com")); push.KindOf(err) != push.KindTransient {
+		t.Fatalf("err = %v, want transient", err)
+	}
+
+	// the failed email does not throttle the recipient
+	f.locker.Lock()
+	f.rcpt = "250 OK"
+	f.locker.Unlock()
+	result, err := p.PushNotice(context.Background(), newMessage("alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Tokens[0].Status; got != push.StatusDelivered {
+		t.Errorf("status = %v, want delivered", got)
+	}
+}
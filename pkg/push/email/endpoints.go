@@ -0,0 +1,181 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/kit/endpoint"
+)
+
+type Endpoints struct {
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+// envelope is an email to a recipient
+type envelope struct {
+	to   string
+	data []byte
+}
+
+func newEndpoints(ctx context.Context, cfg *Config, from string, tlsConfig *tls.Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+
+	endpoints := &Endpoints{
+		PushNoticeEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(*envelope)
+			return send(ctx, cfg, tlsConfig, from, req)
+		},
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("email", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// send sends the email over a new SMTP connection.
+func send(ctx context.Context, cfg *Config, tlsConfig *tls.Config, from string, req *envelope) (*pushNoticeResponse, error) {
+	deadline := time.Now().Add(cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	var conn net.Conn
+	var err error
+	if cfg.Security == SecurityTLS {
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed connect SMTP server: %w", err)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, smtpError(fmt.Errorf("failed greet SMTP server: %w", err))
+	}
+	defer c.Close()
+
+	if cfg.Security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return nil, push.Permanent("", errors.New("STARTTLS is not supported by SMTP server"))
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return nil, smtpError(fmt.Errorf("failed start TLS: %w", err))
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return nil, smtpError(fmt.Errorf("failed auth: %w", err))
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return nil, smtpError(fmt.Errorf("failed MAIL FROM: %w", err))
+	}
+	if err := c.Rcpt(req.to); err != nil {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			if _, ok := rejectedStatuses[enhancedStatus(protoErr.Msg)]; ok {
+				return &pushNoticeResponse{Code: protoErr.Code, Message: protoErr.Msg}, nil
+			}
+		}
+		return nil, smtpError(fmt.Errorf("failed RCPT TO: %w", err))
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return nil, smtpError(fmt.Errorf("failed DATA: %w", err))
+	}
+	if _, err := w.Write(req.data); err != nil {
+		return nil, smtpError(fmt.Errorf("failed write email: %w", err))
+	}
+	if err := w.Close(); err != nil {
+		return nil, smtpError(fmt.Errorf("failed send email: %w", err))
+	}
+	_ = c.Quit()
+	return &pushNoticeResponse{Code: codeSuccess, Message: "OK"}, nil
+}
+
+// smtpError classifies the SMTP failures by the reply codes, the 4xx
+// replies are transient and the 5xx replies are permanent.
+func smtpError(err error) error {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		// the network failures are classified by push.KindOf
+		return err
+	}
+
+	code := strconv.Itoa(protoErr.Code)
+	if protoErr.Code >= 400 && protoErr.Code < 500 {
+		return push.Transient(code, err)
+	}
+	return push.Permanent(code, err)
+}
+
+const codeSuccess = 250
+
+// rejectedStatuses are the enhanced status codes of RCPT TO of the
+// recipients which do not exist, the other refusals, e.g. 550 5.7.1 of a
+// policy, are not a fault of the address.
+// more info: https://www.rfc-editor.org/rfc/rfc3463
+var rejectedStatuses = map[string]struct{}{
+	// bad destination mailbox address
+	"5.1.1": {},
+	// recipient address has null MX
+	"5.1.10": {},
+}
+
+// enhancedStatus returns the enhanced status code leading the text of the
+// reply, e.g. 5.1.1 of "5.1.1 no such user", or empty if there is none.
+func enhancedStatus(msg string) string {
+	status, _, _ := strings.Cut(msg, " ")
+	if strings.Count(status, ".") != 2 {
+		return ""
+	}
+	return status
+}
+
+type pushNoticeResponse struct {
+	Code    int
+	Message string
+}
+
+// result returns the push result of the tokens, the tokens of the
+// recipients which do not exist are rejected.
+func (r *pushNoticeResponse) result(tokens []string, messageID string) *push.Result {
+	result := push.NewResult(tokens, push.StatusDelivered, messageID, strconv.Itoa(r.Code), r.Message)
+	if _, ok := rejectedStatuses[enhancedStatus(r.Message)]; ok {
+		result.SetStatus(tokens, push.StatusRejected)
+	}
+	return result
+}
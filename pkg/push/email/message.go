@@ -0,0 +1,109 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/google/uuid"
+)
+
+var htmlTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<h3>{{.Title}}</h3>
+<p>{{.Content}}</p>
+{{- if .Suppressed}}
+<p><small>{{.Suppressed}} more notifications since the last email.</small></p>
+{{- end}}
+</body>
+</html>
+`))
+
+// render returns the multipart/alternative email of the payload in plain
+// text and HTML, and its Message-ID.
+func render(cfg *Config, from *mail.Address, to *mail.Address, payload *push.Payload, suppressed int) ([]byte, string, error) {
+	fields := struct {
+		Title      string
+		Content    string
+		Suppressed int
+	}{
+		Title:      payload.Title,
+		Content:    payload.Content,
+		Suppressed: suppressed,
+	}
+
+	subject := cfg.Subject
+	if subject == "" {
+		subject = payload.Title
+	}
+
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	messageID := fmt.Sprintf("<%s@%s>", uuid.New().String(), domain)
+
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	// the line breaks of the subject would start new headers
+	subject = strings.Join(strings.Fields(subject), " ")
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + body.Boundary()},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+
+	text := fields.Title + "\r\n\r\n" + fields.Content + "\r\n"
+	if suppressed > 0 {
+		text += fmt.Sprintf("\r\n%d more notifications since the last email.\r\n", suppressed)
+	}
+	if err := writePart(body, "text/plain; charset=utf-8", strings.NewReader(text)); err != nil {
+		return nil, "", err
+	}
+
+	var html bytes.Buffer
+	if err := htmlTemplate.Execute(&html, fields); err != nil {
+		return nil, "", err
+	}
+	if err := writePart(body, "text/html; charset=utf-8", &html); err != nil {
+		return nil, "", err
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), messageID, nil
+}
+
+// writePart writes a quoted-printable part of the content type.
+func writePart(body *multipart.Writer, contentType string, content io.Reader) error {
+	part, err := body.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	w := quotedprintable.NewWriter(part)
+	if _, err := io.Copy(w, content); err != nil {
+		return err
+	}
+	return w.Close()
+}
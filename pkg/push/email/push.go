@@ -0,0 +1,217 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type Email struct {
+	cfg       *Config
+	from      *mail.Address
+	throttle  *throttle
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("email", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: cfg.Host,
+	}
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed read SMTP ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in SMTP ca file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	endpoints, err := newEndpoints(context.Background(), cfg, from.Address, tlsConfig, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create email endpoints: %v", err)
+	}
+	return &Email{
+		cfg:       cfg,
+		from:      from,
+		throttle:  newThrottle(cfg.Throttle),
+		endpoints: endpoints,
+	}, nil
+}
+
+// an email is sent to a recipient.
+const maxBatchSize = 1
+
+// dataAddress is the field of the recipient address in the pusher data.
+const dataAddress = "address"
+
+// codes of the tokens not sent
+const (
+	// codeInvalidAddress is the code of the pushers without a valid address
+	codeInvalidAddress = "invalid_address"
+	// codeThrottled is the code of the notifications folded into the next
+	// email of the recipient
+	codeThrottled = "throttled"
+)
+
+// PushNotice sends an email to the address of every pusher. The
+// notifications of a recipient within the throttle interval are not sent,
+// they are counted in the next email instead.
+func (p *Email) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		token := message.DeviceTokens[0]
+		to, err := addressOf(message, token)
+		if err != nil {
+			return push.NewResult(message.DeviceTokens, push.StatusRejected, "", codeInvalidAddress, err.Error()), nil
+		}
+
+		recipient := strings.ToLower(to.Address)
+		suppressed, ok := p.throttle.take(recipient, time.Now())
+		if !ok {
+			return push.NewResult(message.DeviceTokens, push.StatusSuppressed, "", codeThrottled, "throttled"), nil
+		}
+
+		data, messageID, err := render(p.cfg, p.from, to, message.Payload, suppressed)
+		if err != nil {
+			p.throttle.undo(recipient, suppressed)
+			return nil, push.Permanent("", fmt.Errorf("failed render email: %v", err))
+		}
+
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, &envelope{
+			to:   to.Address,
+			data: data,
+		})
+		if err != nil {
+			// the recipient may be retried
+			p.throttle.undo(recipient, suppressed)
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens, messageID), nil
+	})
+}
+
+// addressOf returns the recipient address in the pusher data of the token.
+func addressOf(message *push.Message, token string) (*mail.Address, error) {
+	address, _ := message.DeviceData[token][dataAddress].(string)
+	if address == "" {
+		return nil, fmt.Errorf("address is missing in pusher data")
+	}
+	to, err := mail.ParseAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %v", err)
+	}
+	return to, nil
+}
+
+// security modes of the SMTP connections
+const (
+	// SecurityStartTLS upgrades the plain connection with STARTTLS
+	SecurityStartTLS = "starttls"
+	// SecurityTLS connects with the implicit TLS
+	SecurityTLS = "tls"
+	// SecurityNone sends in plain text, e.g. to a local SMTP server in testing
+	SecurityNone = "none"
+)
+
+type Config struct {
+	// Host is the host of the SMTP server.
+	Host string `yaml:"host"`
+
+	// Port is the port of the SMTP server.
+	// Default: 465 with the implicit TLS, 587 otherwise
+	Port int `yaml:"port"`
+
+	// Security is the security of the connections: starttls, tls or none.
+	// Default: starttls
+	Security string `yaml:"security"`
+
+	// CAFile is the CA certificates verifying the host, the system
+	// certificates are used if it is empty.
+	CAFile string `yaml:"ca_file"`
+
+	// Username and Password authenticate with PLAIN auth, no auth if the
+	// username is empty.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// From is the sender address, e.g. "Yiqia <noreply@example.com>".
+	From string `yaml:"from"`
+
+	// Subject is the subject of the emails, the title of the notification
+	// if it is empty.
+	Subject string `yaml:"subject"`
+
+	// Throttle is the min interval between the emails to a recipient, the
+	// notifications within the interval are suppressed and counted in the
+	// next email. The times and the counts are kept in memory only, they are
+	// lost on restart and not shared by the replicas, so a recipient may get
+	// an email early once after a restart.
+	// Default: 10m
+	Throttle time.Duration `yaml:"throttle"`
+
+	// Timeout is the timeout of sending an email.
+	// Default: 30s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *Config) Validate() error {
+	if c.Security == "" {
+		c.Security = SecurityStartTLS
+	}
+	if c.Port == 0 {
+		c.Port = 587
+		if c.Security == SecurityTLS {
+			c.Port = 465
+		}
+	}
+	if c.Throttle == 0 {
+		c.Throttle = 10 * time.Minute
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+
+	if c.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if c.Security != SecurityStartTLS && c.Security != SecurityTLS && c.Security != SecurityNone {
+		return fmt.Errorf("unknown security: %s", c.Security)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", c.Port)
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("invalid from address: %v", err)
+	}
+	if c.Throttle < 0 {
+		return fmt.Errorf("throttle must be positive")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
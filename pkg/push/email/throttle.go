@@ -0,0 +1,83 @@
+package email
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle limits the emails to a recipient to one per interval.
+type throttle struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	recipients map[string]*recipient
+	pruned     time.Time
+}
+
+type recipient struct {
+	// sent is when the last email is sent
+	sent time.Time
+	// last is the sent time before the last email, restored by undo
+	last time.Time
+	// suppressed is the number of the notifications not sent since then
+	suppressed int
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{
+		interval:   interval,
+		recipients: make(map[string]*recipient),
+	}
+}
+
+// take reports whether an email may be sent to the recipient now, and
+// returns the number of the notifications suppressed since the last email.
+// The notification is counted as suppressed if it may not be sent.
+func (t *throttle) take(address string, now time.Time) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	r, ok := t.recipients[address]
+	if !ok {
+		r = &recipient{}
+		t.recipients[address] = r
+	}
+	if !r.sent.IsZero() && now.Sub(r.sent) < t.interval {
+		r.suppressed++
+		return 0, false
+	}
+
+	suppressed := r.suppressed
+	r.last = r.sent
+	r.sent = now
+	r.suppressed = 0
+	return suppressed, true
+}
+
+// undo restores the recipient after the email taken is not sent.
+func (t *throttle) undo(address string, suppressed int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r, ok := t.recipients[address]; ok {
+		r.sent = r.last
+		r.suppressed += suppressed
+	}
+}
+
+// prune removes the recipients idle for an interval without a suppressed
+// notification, at most once per interval.
+func (t *throttle) prune(now time.Time) {
+	if now.Sub(t.pruned) < t.interval {
+		return
+	}
+	t.pruned = now
+
+	for address, r := range t.recipients {
+		if r.suppressed == 0 && now.Sub(r.sent) >= t.interval {
+			delete(t.recipients, address)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package email
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleTake(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name       string
+		after      time.Duration
+		suppressed int
+		ok         bool
+	}{
+		{"first email", 0, 0, true},
+		{"within interval", time.Minute, 0, false},
+		{"still within interval", 9 * time.Minute, 0, false},
+		{"after interval", 10 * time.Minute, 2, true},
+		{"within next interval", 11 * time.Minute, 0, false},
+		{"after next interval", 30 * time.Minute, 1, true},
+	}
+
+	th := newThrottle(10 * time.Minute)
+	for _, tt := range tests {
+		suppressed, ok := th.take("alice@example.com", start.Add(tt.after))
+		if suppressed != tt.suppressed || ok != tt.ok {
+			t.Errorf("%s: take() = %d, %v, want %d, %v", tt.name, suppressed, ok, tt.suppressed, tt.ok)
+		}
+	}
+
+	// the recipients are throttled separately
+	if _, ok := th.take("bob@example.com", start.Add(31*time.Minute)); !ok {
+		t.Error("take() of another recipient throttled")
+	}
+}
+
+func TestThrottleUndo(t *testing.T) {
+	start := time.Now()
+	th := newThrottle(10 * time.Minute)
+
+	th.take("alice@example.com", start)
+	th.take("alice@example.com", start.Add(time.Minute))
+	suppressed, ok := th.take("alice@example.com", start.Add(10*time.Minute))
+	if !ok || suppressed != 1 {
+		t.Fatalf("take() = %d, %v, want 1, true", suppressed, ok)
+	}
+
+	// the email is not sent, the recipient is not throttled by it and the
+	// suppressed notification is counted again
+	th.undo("alice@example.com", suppressed)
+	suppressed, ok = th.take("alice@example.com", start.Add(10*time.Minute+time.Second))
+	if !ok || suppressed != 1 {
+		t.Errorf("take() after undo = %d, %v, want 1, true", suppressed, ok)
+	}
+
+	// undo of an unknown recipient is ignored
+	th.undo("bob@example.com", 1)
+}
+
+func TestThrottlePrune(t *testing.T) {
+	start := time.Now()
+	th := newThrottle(10 * time.Minute)
+
+	th.take("idle@example.com", start)
+	th.take("suppressed@example.com", start)
+	th.take("suppressed@example.com", start.Add(time.Minute))
+
+	// the prune runs once per interval
+	th.take("other@example.com", start.Add(5*time.Minute))
+	if len(th.recipients) != 3 {
+		t.Fatalf("recipients = %d, want 3 before the prune", len(th.recipients))
+	}
+
+	th.take("other@example.com", start.Add(20*time.Minute))
+	if _, ok := th.recipients["idle@example.com"]; ok {
+		t.Error("idle recipient not pruned")
+	}
+	// the suppressed notifications are kept for the next email
+	if r, ok := th.recipients["suppressed@example.com"]; !ok || r.suppressed != 1 {
+		t.Errorf("recipient with a suppressed notification pruned: %+v", r)
+	}
+}
@@ -0,0 +1,35 @@
+package push
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// AllowEndpoint returns the error if the endpoint URL of a pusher is not
+// allowed to be requested: the scheme is https, or http if allowHTTP, there
+// is no userinfo and the host is one of the allowed hosts, *.example.com
+// allows the subdomains of example.com. The allowed hosts are lower case.
+func AllowEndpoint(endpoint string, allowedHosts []string, allowHTTP bool) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if u.Scheme != "https" && !(allowHTTP && u.Scheme == "http") {
+		return fmt.Errorf("scheme %s not allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("userinfo not allowed")
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range allowedHosts {
+		if host == allowed {
+			return nil
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %s not allowed", host)
+}
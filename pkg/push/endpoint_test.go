@@ -0,0 +1,32 @@
+package push
+
+import "testing"
+
+func TestAllowEndpoint(t *testing.T) {
+	allowedHosts := []string{"push.example.com", "*.notify.example.org"}
+
+	tests := []struct {
+		endpoint string
+		allowed  bool
+	}{
+		{"https://push.example.com/sub", true},
+		{"https://PUSH.example.com:8443/sub", true},
+		{"https://wns2.notify.example.org/sub", true},
+		{"https://notify.example.org/sub", false},
+		{"https://evil-notify.example.org/sub", false},
+		{"http://push.example.com/sub", false},
+		{"https://user@push.example.com/sub", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://push.example.com.evil.com/sub", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := AllowEndpoint(tt.endpoint, allowedHosts, false); (err == nil) != tt.allowed {
+			t.Errorf("AllowEndpoint(%q) = %v, want allowed %v", tt.endpoint, err, tt.allowed)
+		}
+	}
+
+	if err := AllowEndpoint("http://push.example.com/sub", allowedHosts, true); err != nil {
+		t.Errorf("AllowEndpoint() of http with allowHTTP = %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Kind is the kind of a push failure
+type Kind int
+
+const (
+	// KindPermanent means the push fails again if it is retried
+	KindPermanent Kind = iota
+	// KindTransient means the push may succeed if it is retried
+	KindTransient
+	// KindRateLimited means the push is throttled by the vendor,
+	// it should be retried later
+	KindRateLimited
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindPermanent:
+		return "permanent"
+	case KindTransient:
+		return "transient"
+	case KindRateLimited:
+		return "rate_limited"
+	}
+	return "unknown"
+}
+
+// Error is a push failure classified by the vendor response
+type Error struct {
+	Kind Kind
+	// Code is the raw code returned by the vendor
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Permanent returns a permanent push failure.
+func Permanent(code string, err error) error {
+	return &Error{Kind: KindPermanent, Code: code, Err: err}
+}
+
+// Transient returns a transient push failure.
+func Transient(code string, err error) error {
+	return &Error{Kind: KindTransient, Code: code, Err: err}
+}
+
+// RateLimited returns a rate limited push failure.
+func RateLimited(code string, err error) error {
+	return &Error{Kind: KindRateLimited, Code: code, Err: err}
+}
+
+// HTTPError returns the push failure of an unexpected http response status.
+func HTTPError(resp *http.Response) error {
+	err := fmt.Errorf("unexpected http status: %s", resp.Status)
+	code := strconv.Itoa(resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return RateLimited(code, err)
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		return Transient(code, err)
+	}
+	return Permanent(code, err)
+}
+
+// KindOf returns the kind of the push failure. The network failures are
+// transient, the other failures not classified are permanent.
+func KindOf(err error) Kind {
+	var pushErr *Error
+	if errors.As(err, &pushErr) {
+		return pushErr.Kind
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return KindPermanent
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return KindTransient
+	}
+	return KindPermanent
+}
+
+// CodeOf returns the vendor code of the push failure.
+func CodeOf(err error) string {
+	var pushErr *Error
+	if errors.As(err, &pushErr) {
+		return pushErr.Code
+	}
+	return ""
+}
+
+// FailedResult returns the result of the tokens whose push failed with err.
+// The tokens are retryable if the failure is not permanent.
+func FailedResult(tokens []string, err error) *Result {
+	status := StatusFailed
+	if KindOf(err) != KindPermanent {
+		status = StatusRetryable
+	}
+	return NewResult(tokens, status, "", CodeOf(err), err.Error())
+}
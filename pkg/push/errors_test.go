@@ -0,0 +1,89 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Kind
+	}{
+		{"permanent", Permanent("400", errors.New("bad request")), KindPermanent},
+		{"transient", Transient("500", errors.New("server error")), KindTransient},
+		{"rate limited", RateLimited("429", errors.New("too many requests")), KindRateLimited},
+		{"wrapped transient", fmt.Errorf("failed get token: %w", Transient("500", errors.New("server error"))), KindTransient},
+		{"deadline exceeded", context.DeadlineExceeded, KindTransient},
+		{"wrapped deadline exceeded", fmt.Errorf("failed push: %w", context.DeadlineExceeded), KindTransient},
+		{"canceled", context.Canceled, KindPermanent},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, KindTransient},
+		{"wrapped network", fmt.Errorf("failed push: %w", &net.DNSError{Err: "timeout", IsTimeout: true}), KindTransient},
+		{"unclassified", errors.New("unknown"), KindPermanent},
+		{"flattened", fmt.Errorf("failed push: %v", Transient("500", errors.New("server error"))), KindPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KindOf(tt.err); got != tt.want {
+				t.Errorf("KindOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	tests := []struct {
+		status int
+		want   Kind
+	}{
+		{http.StatusBadRequest, KindPermanent},
+		{http.StatusUnauthorized, KindPermanent},
+		{http.StatusNotFound, KindPermanent},
+		{http.StatusRequestTimeout, KindTransient},
+		{http.StatusTooManyRequests, KindRateLimited},
+		{http.StatusInternalServerError, KindTransient},
+		{http.StatusBadGateway, KindTransient},
+		{http.StatusServiceUnavailable, KindTransient},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			err := HTTPError(&http.Response{StatusCode: tt.status, Status: http.StatusText(tt.status)})
+			if got := KindOf(err); got != tt.want {
+				t.Errorf("KindOf() = %v, want %v", got, tt.want)
+			}
+			if code := CodeOf(err); code != fmt.Sprint(tt.status) {
+				t.Errorf("CodeOf() = %q, want %d", code, tt.status)
+			}
+		})
+	}
+}
+
+func TestFailedResult(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Status
+	}{
+		{"permanent", Permanent("400", errors.New("bad request")), StatusFailed},
+		{"transient", Transient("500", errors.New("server error")), StatusRetryable},
+		{"rate limited", RateLimited("429", errors.New("too many requests")), StatusRetryable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := FailedResult([]string{"a", "b"}, tt.err)
+			if len(result.Tokens) != 2 {
+				t.Fatalf("tokens = %d, want 2", len(result.Tokens))
+			}
+			for _, token := range result.Tokens {
+				if token.Status != tt.want {
+					t.Errorf("status of %s = %v, want %v", token.Token, token.Status, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	host     = "https://fcm.googleapis.com"
+	tokenURI = "https://oauth2.googleapis.com/token"
+	// scope is the OAuth2 scope of sending messages
+	scope = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+// assertionLifetime is the lifetime of the JWT assertion exchanged for
+// the access token, which is at most one hour.
+const assertionLifetime = time.Hour
+
+type Endpoints struct {
+	tokens *token.Manager
+
+	GetTokenEndpoint   endpoint.Endpoint
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, cfg *Config, credentials *Credentials, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+	tgt, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	tgt.Path = ""
+
+	tokenTgt, err := url.Parse(credentials.TokenURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse token uri: %v", err)
+	}
+
+	key, err := parsePrivateKey(credentials.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints *Endpoints
+
+	options := []httptransport.ClientOption{
+		httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
+			if value, ok := token.FromContext(ctx); ok {
+				r.Header.Set("Authorization", value)
+			}
+			return ctx
+		}),
+	}
+
+	endpoints = &Endpoints{
+		// more info: https://developers.google.com/identity/protocols/oauth2/service-account#httprest
+		GetTokenEndpoint: httptransport.NewClient("POST", tokenTgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			assertion, err := signAssertion(key, credentials)
+			if err != nil {
+				return err
+			}
+
+			values := url.Values{}
+			values.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+			values.Set("assertion", assertion)
+
+			body := strings.NewReader(values.Encode())
+			r.Body = io.NopCloser(body)
+			r.ContentLength = int64(len(values.Encode()))
+
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			if resp.StatusCode != http.StatusOK {
+				return nil, push.HTTPError(resp)
+			}
+			defer resp.Body.Close()
+
+			body := new(Token)
+			err = json.NewDecoder(resp.Body).Decode(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed decode token: %v", err)
+			}
+			return body, nil
+		}).Endpoint(),
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			r.URL.Path = fmt.Sprintf("/v1/projects/%s/messages:send", cfg.ProjectID)
+			req := request.(*push.Message)
+
+			// more info: https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+			body := &struct {
+				Message struct {
+					Token        string `json:"token"`
+					Notification struct {
+						Title string `json:"title,omitempty"`
+						Body  string `json:"body,omitempty"`
+					} `json:"notification"`
+					Android struct {
+						Priority    string `json:"priority,omitempty"`
+						TTL         string `json:"ttl,omitempty"`
+						CollapseKey string `json:"collapse_key,omitempty"`
+					} `json:"android"`
+				} `json:"message"`
+			}{}
+
+			body.Message.Token = req.DeviceTokens[0]
+			body.Message.Notification.Title = req.Payload.Title
+			body.Message.Notification.Body = req.Payload.Content
+
+			body.Message.Android.Priority = cfg.Priority
+			if req.Payload.Priority == "low" {
+				body.Message.Android.Priority = PriorityNormal
+			}
+			if cfg.TTL > 0 {
+				body.Message.Android.TTL = strconv.FormatInt(int64(cfg.TTL/time.Second), 10) + "s"
+			}
+			switch cfg.CollapseKey {
+			case "":
+			case CollapseKeyRoom:
+				body.Message.Android.CollapseKey = req.Payload.CollapseID
+			default:
+				body.Message.Android.CollapseKey = cfg.CollapseKey
+			}
+
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(body)
+			if err != nil {
+				return err
+			}
+
+			r.Body = io.NopCloser(&buf)
+			r.Header.Set("Content-Type", "application/json")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			defer resp.Body.Close()
+
+			body := new(pushNoticeResponse)
+			if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+				if resp.StatusCode != http.StatusOK {
+					return nil, push.HTTPError(resp)
+				}
+				return nil, fmt.Errorf("failed decode push notice result: %v", err)
+			}
+			if resp.StatusCode == http.StatusOK {
+				return body, nil
+			}
+
+			if body.Error == nil {
+				return nil, push.HTTPError(resp)
+			}
+
+			code := body.Error.code()
+			if body.Error.rejected() {
+				return body, nil
+			}
+
+			err = fmt.Errorf("failed push notice: %s, code: %s", body.Error.Message, code)
+			switch {
+			case resp.StatusCode == http.StatusUnauthorized:
+				return body, push.Transient(code, token.Unauthorized(err))
+			case resp.StatusCode == http.StatusTooManyRequests:
+				return body, push.RateLimited(code, err)
+			case resp.StatusCode >= http.StatusInternalServerError:
+				return body, push.Transient(code, err)
+			}
+			return body, push.Permanent(code, err)
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("fcm", "push")(endpoints.PushNoticeEndpoint)
+	endpoints.GetTokenEndpoint = metrics.TokenMiddleware("fcm")(endpoints.GetTokenEndpoint)
+
+	endpoints.tokens = token.New("fcm:"+credentials.ClientEmail, endpoints.fetchToken, opts.TokenStore, logger)
+	endpoints.tokens.Start(ctx)
+	endpoints.PushNoticeEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+		endpoints.GetTokenEndpoint = breaker.Middleware(opts.Name+".token", opts.Breaker, logger)(endpoints.GetTokenEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// error codes of the push notice api.
+// more info: https://firebase.google.com/docs/reference/fcm/rest/v1/ErrorCode
+const (
+	// the device token is no longer valid
+	codeUnregistered = "UNREGISTERED"
+	// a field of the message is invalid, the device token is invalid only
+	// if the field violation is of the token
+	codeInvalidArgument = "INVALID_ARGUMENT"
+)
+
+// fieldToken is the field of the device token in the field violations
+const fieldToken = "message.token"
+
+type pushNoticeResponse struct {
+	// Name is the id of the message
+	Name  string         `json:"name,omitempty"`
+	Error *responseError `json:"error,omitempty"`
+}
+
+// responseError is the error of the failed response.
+// more info: https://cloud.google.com/apis/design/errors
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+	Details []struct {
+		Type      string `json:"@type"`
+		ErrorCode string `json:"errorCode"`
+		// FieldViolations are the invalid fields of a bad request
+		FieldViolations []struct {
+			Field       string `json:"field"`
+			Description string `json:"description"`
+		} `json:"fieldViolations"`
+	} `json:"details"`
+}
+
+// code returns the FCM error code in the details, or the status of the
+// error if there is none.
+func (e *responseError) code() string {
+	for _, detail := range e.Details {
+		if detail.ErrorCode != "" {
+			return detail.ErrorCode
+		}
+	}
+	return e.Status
+}
+
+// rejected reports whether the error is of an invalid device token: the
+// token is unregistered, or the invalid argument is the token.
+func (e *responseError) rejected() bool {
+	switch e.code() {
+	case codeUnregistered:
+		return true
+	case codeInvalidArgument:
+		for _, detail := range e.Details {
+			for _, violation := range detail.FieldViolations {
+				if violation.Field == fieldToken {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// result returns the push result of the tokens.
+func (r *pushNoticeResponse) result(tokens []string) *push.Result {
+	if r.Error == nil {
+		return push.NewResult(tokens, push.StatusDelivered, r.Name, "", "")
+	}
+
+	result := push.NewResult(tokens, push.StatusDelivered, r.Name, r.Error.code(), r.Error.Message)
+	if r.Error.rejected() {
+		result.SetStatus(tokens, push.StatusRejected)
+	}
+	return result
+}
+
+type Token struct {
+	AccessToken string `json:"access_token,omitempty"`
+	TokenType   string `json:"token_type,omitempty"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
+}
+
+// fetchToken exchanges the signed JWT assertion for the access token.
+func (endpoints *Endpoints) fetchToken(ctx context.Context) (*token.Token, error) {
+	resp, err := endpoints.GetTokenEndpoint(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed get token: %w", err)
+	}
+
+	body := resp.(*Token)
+	now := time.Now()
+	return &token.Token{
+		Value:     fmt.Sprintf("%s %s", body.TokenType, body.AccessToken),
+		ExpiresAt: now.Add(time.Duration(body.ExpiresIn) * time.Second),
+		FetchedAt: now,
+	}, nil
+}
+
+// parsePrivateKey parses the PEM RSA private key of the service account.
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block in FCM private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parse FCM private key: %v", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("FCM private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signAssertion signs the JWT assertion of the service account with RS256.
+func signAssertion(key *rsa.PrivateKey, credentials *Credentials) (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": credentials.PrivateKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   credentials.ClientEmail,
+		"scope": scope,
+		"aud":   credentials.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(assertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed sign assertion: %v", err)
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
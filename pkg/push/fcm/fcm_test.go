@@ -0,0 +1,213 @@
+package fcm
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// fakeGoogle serves the token exchange and the send api of FCM.
+type fakeGoogle struct {
+	key *rsa.PrivateKey
+
+	locker      sync.Mutex
+	assertions  []string
+	authorized  []string
+	pushed      []string
+	code        int
+	status      string
+	errorDetail string
+	// field is the field violation of the bad request, if any
+	field string
+}
+
+func (f *fakeGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.assertions = append(f.assertions, r.PostForm.Get("assertion"))
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&Token{AccessToken: "access", TokenType: "Bearer", ExpiresIn: 3600})
+	case "/v1/projects/project/messages:send":
+		f.authorized = append(f.authorized, r.Header.Get("Authorization"))
+		body := new(struct {
+			Message struct {
+				Token string `json:"token"`
+			} `json:"message"`
+		})
+		_ = json.NewDecoder(r.Body).Decode(body)
+		f.pushed = append(f.pushed, body.Message.Token)
+
+		if f.code != 0 {
+			badRequest := ""
+			if f.field != "" {
+				badRequest = `,{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":[{"field":"` + f.field + `","description":"invalid"}]}`
+			}
+			w.WriteHeader(f.code)
+			_, _ = w.Write([]byte(`{"error":{"code":` + strconv.Itoa(f.code) + `,"message":"failed","status":"` + f.status +
+				`","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"` + f.errorDetail + `"}` + badRequest + `]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"name":"projects/project/messages/1"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newFCM returns the FCM client of a service account pushing to the fake.
+func newFCM(t *testing.T, f *fakeGoogle) push.Push {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.key = key
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(&Credentials{
+		Type:         "service_account",
+		ProjectID:    "project",
+		PrivateKeyID: "key-id",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "pusher@project.iam.gserviceaccount.com",
+		TokenURI:     srv.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{CredentialsFile: path, Host: srv.URL}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, &provider.Options{Name: "fcm", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTokenExchange(t *testing.T) {
+	f := new(fakeGoogle)
+	p := newFCM(t, f)
+
+	result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != 2 {
+		t.Errorf("result = %+v, want delivered", result.Tokens)
+	}
+
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	if len(f.assertions) != 1 {
+		t.Fatalf("token exchanges = %d, want 1", len(f.assertions))
+	}
+	for _, value := range f.authorized {
+		if value != "Bearer access" {
+			t.Errorf("Authorization = %q, want the exchanged token", value)
+		}
+	}
+
+	// the assertion is signed by the service account with RS256
+	parts := strings.Split(f.assertions[0], ".")
+	if len(parts) != 3 {
+		t.Fatalf("assertion %q is not a JWT", f.assertions[0])
+	}
+	encoding := base64.RawURLEncoding
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("assertion signature: %v", err)
+	}
+
+	data, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["iss"] != "pusher@project.iam.gserviceaccount.com" || claims["scope"] != scope || !strings.HasSuffix(claims["aud"].(string), "/token") {
+		t.Errorf("claims = %v", claims)
+	}
+	if exp, iat := claims["exp"].(float64), claims["iat"].(float64); exp-iat > assertionLifetime.Seconds() {
+		t.Errorf("assertion lifetime = %vs, want at most an hour", exp-iat)
+	}
+}
+
+func TestPushNoticeStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   int
+		status string
+		detail string
+		field  string
+		want   push.Status
+	}{
+		{"unregistered", http.StatusNotFound, "NOT_FOUND", codeUnregistered, "", push.StatusRejected},
+		{"invalid token", http.StatusBadRequest, "INVALID_ARGUMENT", codeInvalidArgument, "message.token", push.StatusRejected},
+		{"invalid payload", http.StatusBadRequest, "INVALID_ARGUMENT", codeInvalidArgument, "message.android.ttl", push.StatusFailed},
+		{"invalid argument without field", http.StatusBadRequest, "INVALID_ARGUMENT", codeInvalidArgument, "", push.StatusFailed},
+		{"quota exceeded", http.StatusTooManyRequests, "RESOURCE_EXHAUSTED", "QUOTA_EXCEEDED", "", push.StatusRetryable},
+		{"unavailable", http.StatusServiceUnavailable, "UNAVAILABLE", "UNAVAILABLE", "", push.StatusRetryable},
+		{"sender id mismatch", http.StatusForbidden, "PERMISSION_DENIED", "SENDER_ID_MISMATCH", "", push.StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeGoogle{code: tt.code, status: tt.status, errorDetail: tt.detail, field: tt.field}
+			p := newFCM(t, f)
+
+			tokens := []string{"device"}
+			result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: tokens, Payload: &push.Payload{}})
+			if err != nil {
+				result = push.FailedResult(tokens, err)
+			}
+			if got := result.Tokens[0].Status; got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package fcm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type FCM struct {
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("fcm", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	credentials, err := loadCredentials(cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProjectID == "" {
+		cfg.ProjectID = credentials.ProjectID
+	}
+	if cfg.ProjectID == "" {
+		return nil, fmt.Errorf("project id is required")
+	}
+
+	endpoints, err := newEndpoints(context.Background(), cfg, credentials, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create FCM endpoints: %v", err)
+	}
+	return &FCM{
+		endpoints: endpoints,
+	}, nil
+}
+
+// Check fetches the access token of FCM.
+func (p *FCM) Check(ctx context.Context) error {
+	_, err := p.endpoints.tokens.Get(ctx)
+	return err
+}
+
+// the HTTP v1 api sends a message to one device token per request.
+const maxBatchSize = 1
+
+func (p *FCM) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+}
+
+// Android priorities
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+)
+
+// CollapseKeyRoom collapses the notifications of the same room.
+const CollapseKeyRoom = "room"
+
+type Config struct {
+	// CredentialsFile is the service account JSON key of the Firebase project.
+	CredentialsFile string `yaml:"credentials_file"`
+
+	// ProjectID is the id of the Firebase project.
+	// Default: the project id of the service account
+	ProjectID string `yaml:"project_id"`
+
+	// Host overrides the FCM host, e.g. a fake endpoint.
+	// Default: https://fcm.googleapis.com
+	Host string `yaml:"host"`
+
+	// Priority is the Android priority of the notifications: high or normal,
+	// the low priority notifications are always sent with normal.
+	// Default: high
+	Priority string `yaml:"priority"`
+
+	// TTL is how long the notifications are kept while the devices are
+	// offline, FCM keeps them for 4 weeks if it is 0.
+	TTL time.Duration `yaml:"ttl"`
+
+	// CollapseKey is the collapse_key of the notifications, the pending
+	// notifications with the same key are replaced by the latest one.
+	// The notifications are collapsed by their rooms if it is room,
+	// nothing is collapsed if it is empty.
+	CollapseKey string `yaml:"collapse_key"`
+}
+
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		c.Host = host
+	}
+	if c.Priority == "" {
+		c.Priority = PriorityHigh
+	}
+
+	if c.CredentialsFile == "" {
+		return fmt.Errorf("credentials file is required")
+	}
+	if c.Priority != PriorityHigh && c.Priority != PriorityNormal {
+		return fmt.Errorf("invalid priority: %s", c.Priority)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	return nil
+}
+
+// Credentials is the service account JSON key
+type Credentials struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// loadCredentials loads the service account JSON key.
+func loadCredentials(path string) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed read FCM credentials file: %v", err)
+	}
+
+	credentials := new(Credentials)
+	err = json.Unmarshal(data, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed decode FCM credentials: %v", err)
+	}
+	if credentials.Type != "service_account" {
+		return nil, fmt.Errorf("unsupported FCM credentials type: %s", credentials.Type)
+	}
+	if credentials.ClientEmail == "" || credentials.PrivateKey == "" {
+		return nil, fmt.Errorf("client email and private key are required in FCM credentials")
+	}
+	if credentials.TokenURI == "" {
+		credentials.TokenURI = tokenURI
+	}
+	return credentials, nil
+}
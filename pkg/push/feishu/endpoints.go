@@ -0,0 +1,160 @@
+package feishu
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	defaultHost = "https://open.feishu.cn"
+	hookPath    = "/open-apis/bot/v2/hook/"
+)
+
+type Endpoints struct {
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, conf *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+	tgt, err := url.Parse(conf.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints *Endpoints
+	options := []httptransport.ClientOption{}
+
+	endpoints = &Endpoints{
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*push.Message)
+
+			r.URL.Path = hookPath + conf.Token
+			r.URL.RawPath = hookPath + url.PathEscape(conf.Token)
+
+			msg := message(conf, req)
+			if conf.Secret != "" {
+				timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+				msg["timestamp"] = timestamp
+				msg["sign"] = sign(timestamp, conf.Secret)
+			}
+
+			body, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Type", "application/json")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			if resp.StatusCode != http.StatusOK {
+				return nil, push.HTTPError(resp)
+			}
+			defer resp.Body.Close()
+
+			body := new(pushNoticeResponse)
+			err = json.NewDecoder(resp.Body).Decode(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed decode body: %v", err)
+			}
+
+			if body.Code != codeSuccess {
+				return nil, &push.Error{
+					Kind: codeKinds[body.Code],
+					Code: strconv.Itoa(body.Code),
+					Err:  fmt.Errorf("failed push notice: %s", body.Msg),
+				}
+			}
+			return body, nil
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("feishu", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// sign returns the base64 HMAC-SHA256 of empty data keyed by the timestamp
+// in seconds and the secret joined by a newline.
+func sign(timestamp string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(timestamp+"\n"+secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// message returns the bot message of the message type.
+func message(conf *Config, req *push.Message) map[string]interface{} {
+	if conf.MessageType == MessageInteractive {
+		return map[string]interface{}{
+			"msg_type": MessageInteractive,
+			"card": map[string]interface{}{
+				"header": map[string]interface{}{
+					"title": map[string]string{
+						"tag":     "plain_text",
+						"content": req.Payload.Title,
+					},
+				},
+				"elements": []interface{}{
+					map[string]string{
+						"tag":     "markdown",
+						"content": push.EscapeMarkdown(req.Payload.Content),
+					},
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"msg_type": MessageText,
+		"content": map[string]string{
+			"text": req.Payload.Title + "\n" + req.Payload.Content,
+		},
+	}
+}
+
+const codeSuccess = 0
+
+// codeKinds classifies the failure codes of the bot api, the codes not
+// listed are permanent, e.g. 19001 of the invalid webhook token of the
+// instance, which is not a fault of the pushers.
+var codeKinds = map[int]push.Kind{
+	// frequency limited
+	11232: push.KindRateLimited,
+}
+
+type pushNoticeResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// result returns the push result of the pushkeys, the message sent to the
+// bot is delivered to all of them.
+func (r *pushNoticeResponse) result(pushKeys []string) *push.Result {
+	return push.NewResult(pushKeys, push.StatusDelivered, "", strconv.Itoa(r.Code), r.Msg)
+}
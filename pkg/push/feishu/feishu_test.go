@@ -0,0 +1,131 @@
+package feishu
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// bot is a stand-in of the Feishu bot api
+type bot struct {
+	code int
+
+	path string
+	body map[string]interface{}
+}
+
+func (b *bot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.path = r.URL.Path
+	_ = json.NewDecoder(r.Body).Decode(&b.body)
+	fmt.Fprintf(w, `{"code":%d,"msg":"message"}`, b.code)
+}
+
+func newFeishu(t *testing.T, b *bot, cfg *Config) push.Push {
+	t.Helper()
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+
+	cfg.Host = srv.URL
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPushClient(cfg, &provider.Options{Name: "feishu", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newMessage() *push.Message {
+	return &push.Message{
+		DeviceTokens: []string{"a", "b"},
+		Payload:      &push.Payload{Title: "Alice", Content: "**hi**"},
+	}
+}
+
+func TestSign(t *testing.T) {
+	b := new(bot)
+	p := newFeishu(t, b, &Config{Token: "token", Secret: "SEC"})
+
+	result, err := p.PushNotice(context.Background(), newMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != 2 {
+		t.Errorf("result = %+v, want the pushkeys delivered", result.Tokens)
+	}
+
+	if b.path != hookPath+"token" {
+		t.Errorf("path = %q, want the token of the instance", b.path)
+	}
+	timestamp, _ := b.body["timestamp"].(string)
+	mac := hmac.New(sha256.New, []byte(timestamp+"\nSEC"))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); b.body["sign"] != want {
+		t.Errorf("sign = %v, want %q", b.body["sign"], want)
+	}
+}
+
+func TestNotSignedWithoutSecret(t *testing.T) {
+	b := new(bot)
+	p := newFeishu(t, b, &Config{Token: "token"})
+
+	if _, err := p.PushNotice(context.Background(), newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.body["sign"]; ok {
+		t.Errorf("body = %v, want no sign", b.body)
+	}
+}
+
+func TestMarkdownEscaped(t *testing.T) {
+	b := new(bot)
+	p := newFeishu(t, b, &Config{Token: "token", MessageType: MessageInteractive})
+
+	if _, err := p.PushNotice(context.Background(), newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	card := b.body["card"].(map[string]interface{})
+	element := card["elements"].([]interface{})[0].(map[string]interface{})
+	if content := element["content"]; content != `\*\*hi\*\*` {
+		t.Errorf("content = %q, want the content escaped", content)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		want push.Kind
+	}{
+		{"frequency limited", 11232, push.KindRateLimited},
+		{"invalid webhook token", 19001, push.KindPermanent},
+		{"sign match fail", 19021, push.KindPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFeishu(t, &bot{code: tt.code}, &Config{Token: "token"})
+
+			_, err := p.PushNotice(context.Background(), newMessage())
+			if err == nil {
+				t.Fatal("err = nil, want the failure of the code")
+			}
+			if got := push.KindOf(err); got != tt.want {
+				t.Errorf("KindOf() = %v, want %v", got, tt.want)
+			}
+			// the pushers are not rejected for a failure of the bot
+			if got := push.FailedResult([]string{"a"}, err).Filter(push.StatusRejected); len(got) != 0 {
+				t.Errorf("rejected = %v, want none", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package feishu
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type Feishu struct {
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("feishu", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return NewPushClient(cfg.(*Config), opts)
+	})
+}
+
+func NewPushClient(cfg *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), cfg, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create Feishu endpoints: %v", err)
+	}
+	return &Feishu{
+		endpoints: endpoints,
+	}, nil
+}
+
+// PushNotice sends the message once to the bot of the instance, the
+// pushkeys of the message share it.
+func (p *Feishu) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+}
+
+// message types
+const (
+	// MessageText is the plain text of the title and the content
+	MessageText = "text"
+	// MessageInteractive is the card with the title as the header and
+	// the content as markdown
+	MessageInteractive = "interactive"
+)
+
+type Config struct {
+	// Host is the host of the Feishu api, e.g. https://open.larksuite.com for Lark.
+	// Default: https://open.feishu.cn
+	Host string `yaml:"host"`
+
+	// Token is the last path segment of the webhook URL of the group bot.
+	Token string `yaml:"token"`
+
+	// Secret is the signing secret of the bot, the requests are not
+	// signed if there is no secret.
+	Secret string `yaml:"secret"`
+
+	// MessageType is the type of the messages: text or interactive.
+	// Default: text
+	MessageType string `yaml:"message_type"`
+}
+
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		c.Host = defaultHost
+	}
+	if c.MessageType == "" {
+		c.MessageType = MessageText
+	}
+
+	if c.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if c.MessageType != MessageText && c.MessageType != MessageInteractive {
+		return fmt.Errorf("unknown message type: %s", c.MessageType)
+	}
+	return nil
+}
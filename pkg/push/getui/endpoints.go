@@ -11,26 +11,33 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
+	"github.com/eachchat/yiqia-push/pkg/metrics"
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/google/uuid"
 )
 
 // host is the default host of the GETUI push service.
 var host = "https://restapi.getui.com"
 
 type Endpoints struct {
-	sync.Mutex
-	token *Token
+	tokens *token.Manager
 
-	GetTokenEndpoint   endpoint.Endpoint
-	PushNoticeEndpoint endpoint.Endpoint
+	GetTokenEndpoint        endpoint.Endpoint
+	PushNoticeEndpoint      endpoint.Endpoint
+	PushNoticeBatchEndpoint endpoint.Endpoint
 }
 
-func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
+func newEndpoints(ctx context.Context, cfg *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
 	tgt, err := url.Parse(host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse host: %v", err)
@@ -41,12 +48,9 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 	options := []httptransport.ClientOption{
 		httptransport.ClientBefore(
 			func(ctx context.Context, r *http.Request) context.Context {
-				token, err := endpoints.getToken(ctx)
-				if err != nil {
-					r.Close = true
-					return ctx
+				if value, ok := token.FromContext(ctx); ok {
+					r.Header.Set("Token", value)
 				}
-				r.Header.Set("Token", token)
 				return ctx
 			}),
 	}
@@ -79,7 +83,7 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			return nil
 		}, func(ctx context.Context, r *http.Response) (interface{}, error) {
 			if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusBadRequest {
-				return nil, fmt.Errorf("failed to get token: %s", r.Status)
+				return nil, push.HTTPError(r)
 			}
 			defer r.Body.Close()
 
@@ -91,13 +95,13 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 				}
 			}{}
 
-			err = json.NewDecoder(r.Body).Decode(&resp)
+			err := json.NewDecoder(r.Body).Decode(&resp)
 			if err != nil {
 				return nil, fmt.Errorf("failed to decode response: %v", err)
 			}
 
 			if resp.Code != 0 {
-				return nil, fmt.Errorf("failed to get token: %s", resp.Message)
+				return nil, classify(resp.Code, fmt.Errorf("failed to get token: %s", resp.Message))
 			}
 
 			timeStamp, err := strconv.ParseInt(resp.Data.ExpireTime, 10, 64)
@@ -105,9 +109,10 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 				return nil, fmt.Errorf("failed to parse expire time: %v", err)
 			}
 
-			return &Token{
-				Token:      resp.Data.Token,
-				ExpireTime: timeStamp,
+			return &token.Token{
+				Value:     resp.Data.Token,
+				ExpiresAt: time.UnixMilli(timeStamp),
+				FetchedAt: time.Now(),
 			}, nil
 		}).Endpoint(),
 		// more info: https://docs.getui.com/getui/server/rest_v2/push/
@@ -115,33 +120,12 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			r.URL.Path = fmt.Sprintf("/v2/%s/push/single/cid", cfg.AppID)
 
 			req := i.(*push.Message)
-			body := map[string]interface{}{
-				"request_id": req.Payload.BusinessID,
-				"audience": map[string]interface{}{
-					"cid": req.DeviceTokens,
-				},
-				"push_message": map[string]interface{}{
-					"notification": map[string]interface{}{
-						"title":      req.Payload.Title,
-						"body":       req.Payload.Content,
-						"click_type": "startapp",
-					},
-				},
-				"push_channel": map[string]interface{}{
-					"android": map[string]interface{}{
-						"ups": map[string]interface{}{
-							"notification": map[string]interface{}{
-								"title":      req.Payload.Title,
-								"body":       req.Payload.Content,
-								"click_type": "startapp",
-							},
-						},
-					},
-				},
-			}
+			// request_id must be unique for every message, 10 to 32 characters
+			requestID := strings.ReplaceAll(uuid.New().String(), "-", "")
+			body := newNotice(requestID, req.DeviceTokens, req.Payload)
 
 			var buf bytes.Buffer
-			err = json.NewEncoder(&buf).Encode(body)
+			err := json.NewEncoder(&buf).Encode(body)
 			if err != nil {
 				return fmt.Errorf("failed to encode body: %v", err)
 			}
@@ -150,37 +134,177 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			r.Header.Set("Content-Type", "application/json;charset=utf-8")
 
 			return nil
-		}, func(ctx context.Context, r *http.Response) (interface{}, error) {
-			if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusBadRequest {
-				return nil, fmt.Errorf("failed to push notice: %s", r.Status)
+		}, decodePushNoticeResponse, options...).Endpoint(),
+		// more info: https://docs.getui.com/getui/server/rest_v2/push/#doc-title-3
+		PushNoticeBatchEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, i interface{}) error {
+			r.URL.Path = fmt.Sprintf("/v2/%s/push/single/batch/cid", cfg.AppID)
+
+			req := i.(*push.Message)
+			msgList := make([]map[string]interface{}, 0, len(req.DeviceTokens))
+			for _, cid := range req.DeviceTokens {
+				// request_id must be unique for every message, 10 to 32 characters
+				requestID := strings.ReplaceAll(uuid.New().String(), "-", "")
+				msgList = append(msgList, newNotice(requestID, []string{cid}, req.Payload))
+			}
+			body := map[string]interface{}{
+				"is_async": false,
+				"msg_list": msgList,
 			}
-			defer r.Body.Close()
 
-			var resp = struct {
-				baseResponse
-				Data map[string]interface{} `json:"data"`
-			}{}
-			err = json.NewDecoder(r.Body).Decode(&resp)
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(body)
 			if err != nil {
-				return nil, fmt.Errorf("failed to decode response: %v", err)
+				return fmt.Errorf("failed to encode body: %v", err)
 			}
 
-			if resp.Code != 0 {
-				return nil, fmt.Errorf("failed to push notice: %s", resp.Message)
-			}
+			r.Body = io.NopCloser(&buf)
+			r.Header.Set("Content-Type", "application/json;charset=utf-8")
 
-			return resp, nil
-		}, options...).Endpoint(),
+			return nil
+		}, decodePushNoticeResponse, options...).Endpoint(),
+	}
+
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("getui", "push")(endpoints.PushNoticeEndpoint)
+	endpoints.PushNoticeBatchEndpoint = metrics.EndpointMiddleware("getui", "push_batch")(endpoints.PushNoticeBatchEndpoint)
+	endpoints.GetTokenEndpoint = metrics.TokenMiddleware("getui")(endpoints.GetTokenEndpoint)
+
+	endpoints.tokens = token.New("getui:"+cfg.AppID, endpoints.fetchToken, opts.TokenStore, logger)
+	endpoints.tokens.Start(ctx)
+	endpoints.PushNoticeEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeEndpoint)
+	endpoints.PushNoticeBatchEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeBatchEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+		endpoints.PushNoticeBatchEndpoint = pushBreaker(endpoints.PushNoticeBatchEndpoint)
+		endpoints.GetTokenEndpoint = breaker.Middleware(opts.Name+".token", opts.Breaker, logger)(endpoints.GetTokenEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+		endpoints.PushNoticeBatchEndpoint = limiter(endpoints.PushNoticeBatchEndpoint)
 	}
 
 	return endpoints, nil
 }
 
+// newNotice returns the push body of the cids.
+func newNotice(requestID string, cids []string, payload *push.Payload) map[string]interface{} {
+	return map[string]interface{}{
+		"request_id": requestID,
+		"audience": map[string]interface{}{
+			"cid": cids,
+		},
+		"push_message": map[string]interface{}{
+			"notification": map[string]interface{}{
+				"title":      payload.Title,
+				"body":       payload.Content,
+				"click_type": "startapp",
+			},
+		},
+		"push_channel": map[string]interface{}{
+			"android": map[string]interface{}{
+				"ups": map[string]interface{}{
+					"notification": map[string]interface{}{
+						"title":      payload.Title,
+						"body":       payload.Content,
+						"click_type": "startapp",
+					},
+				},
+			},
+		},
+	}
+}
+
+func decodePushNoticeResponse(ctx context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusBadRequest {
+		return nil, push.HTTPError(r)
+	}
+	defer r.Body.Close()
+
+	resp := new(pushNoticeResponse)
+	err := json.NewDecoder(r.Body).Decode(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if resp.Code != codeSuccess && resp.Code != codeInvalidCID {
+		return nil, classify(resp.Code, fmt.Errorf("failed to push notice: %s", resp.Message))
+	}
+
+	return resp, nil
+}
+
+// response codes of the GETUI push service.
+// more info: https://docs.getui.com/getui/server/rest_v2/code/
+const (
+	codeSuccess = 0
+	// the token is invalid or expired
+	codeInvalidToken = 10001
+	// the calls per minute exceed the limit
+	codeFrequencyLimited = 10005
+	// the target cid is invalid or not registered
+	codeInvalidCID = 20001
+)
+
+// codeKinds classifies the failure codes of the GETUI push service,
+// the codes not listed are permanent.
+var codeKinds = map[int]push.Kind{
+	codeInvalidToken:     push.KindTransient,
+	codeFrequencyLimited: push.KindRateLimited,
+}
+
+// classify returns the push failure of the response code.
+func classify(code int, err error) error {
+	if code == codeInvalidToken {
+		err = token.Unauthorized(err)
+	}
+	return &push.Error{
+		Kind: codeKinds[code],
+		Code: strconv.Itoa(code),
+		Err:  err,
+	}
+}
+
 type baseResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"msg"`
 }
 
+type pushNoticeResponse struct {
+	baseResponse
+	// Data is the push status of the cids grouped by task id,
+	// e.g. {"taskid": {"cid": "successed_online"}}
+	Data map[string]map[string]string `json:"data"`
+}
+
+// result returns the push result of the cids.
+func (r *pushNoticeResponse) result(cids []string) *push.Result {
+	code := strconv.Itoa(r.Code)
+	if r.Code == codeInvalidCID {
+		return push.NewResult(cids, push.StatusRejected, "", code, r.Message)
+	}
+
+	result := &push.Result{}
+	for _, cid := range cids {
+		token := push.TokenResult{
+			Token:  cid,
+			Status: push.StatusDelivered,
+			Code:   code,
+			Reason: r.Message,
+		}
+		for taskID, status := range r.Data {
+			if s, ok := status[cid]; ok {
+				token.MessageID = taskID
+				token.Reason = s
+			}
+		}
+		result.Tokens = append(result.Tokens, token)
+	}
+	return result
+}
+
 // sign is the signature of the GETUI push service.
 // timestamp: current timestamp in milliseconds
 func (e *Endpoints) sign(ctx context.Context, appKey string, masterSecret string, timestamp int64) (string, error) {
@@ -194,24 +318,11 @@ func (e *Endpoints) sign(ctx context.Context, appKey string, masterSecret string
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-type Token struct {
-	ExpireTime int64  `json:"expire_time"`
-	Token      string `json:"token"`
-}
-
-func (e *Endpoints) getToken(ctx context.Context) (string, error) {
-	if e.token == nil || time.Now().Add(5*time.Minute).UnixMilli() > e.token.ExpireTime {
-		if !e.TryLock() {
-			<-time.After(time.Millisecond * 500)
-			return e.getToken(ctx)
-		}
-		token, err := e.GetTokenEndpoint(ctx, nil)
-		if err != nil {
-			e.Unlock()
-			return "", fmt.Errorf("failed to get token: %v", err)
-		}
-		e.token = token.(*Token)
-		e.Unlock()
+// fetchToken fetches the token from the GETUI push service.
+func (e *Endpoints) fetchToken(ctx context.Context) (*token.Token, error) {
+	resp, err := e.GetTokenEndpoint(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
-	return e.token.Token, nil
+	return resp.(*token.Token), nil
 }
@@ -0,0 +1,39 @@
+package getui
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+func TestResult(t *testing.T) {
+	resp := new(pushNoticeResponse)
+	data := `{"code":0,"msg":"success","data":{"task1":{"a":"successed_online"},"task2":{"b":"successed_offline"}}}`
+	if err := json.Unmarshal([]byte(data), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []push.TokenResult{
+		{Token: "a", Status: push.StatusDelivered, MessageID: "task1", Code: "0", Reason: "successed_online"},
+		{Token: "b", Status: push.StatusDelivered, MessageID: "task2", Code: "0", Reason: "successed_offline"},
+	}
+	result := resp.result([]string{"a", "b"})
+	for i, token := range result.Tokens {
+		if token != want[i] {
+			t.Errorf("result = %+v, want %+v", token, want[i])
+		}
+	}
+}
+
+func TestResultRejected(t *testing.T) {
+	resp := new(pushNoticeResponse)
+	if err := json.Unmarshal([]byte(`{"code":20001,"msg":"cid is invalid"}`), resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range resp.result([]string{"a", "b"}).Tokens {
+		if token.Status != push.StatusRejected || token.Code != "20001" {
+			t.Errorf("result = %+v, want rejected with the code", token)
+		}
+	}
+}
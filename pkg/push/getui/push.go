@@ -5,14 +5,24 @@ import (
 	"fmt"
 
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
 )
 
 type GETUI struct {
 	endpoints *Endpoints
 }
 
-func New(conf *Config) (push.Push, error) {
-	endpoints, err := newEndpoints(context.Background(), conf)
+func init() {
+	provider.Register("getui", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(conf *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), conf, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed create GETUI endpoints: %v", err)
 	}
@@ -21,11 +31,34 @@ func New(conf *Config) (push.Push, error) {
 	}, nil
 }
 
-func (p *GETUI) PushNotice(ctx context.Context, message *push.Message) error {
-	_, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+// Check fetches the access token of GETUI.
+func (p *GETUI) Check(ctx context.Context) error {
+	_, err := p.endpoints.tokens.Get(ctx)
 	return err
 }
 
+// maxBatchSize is the max number of messages in a batch push request.
+const maxBatchSize = 200
+
+func (p *GETUI) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, p.pushNotice)
+}
+
+// pushNotice pushes the message with the single cid api if there is only
+// one cid, otherwise with the batch cid api.
+func (p *GETUI) pushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	e := p.endpoints.PushNoticeEndpoint
+	if len(message.DeviceTokens) > 1 {
+		e = p.endpoints.PushNoticeBatchEndpoint
+	}
+
+	resp, err := e(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+}
+
 type Config struct {
 	AppID        string `yaml:"app_id"`
 	AppKey       string `yaml:"app_key"`
@@ -0,0 +1,291 @@
+package honor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	defaultHost      = "https://push-api.cloud.honor.com"
+	defaultTokenHost = "https://iam.developer.honor.com"
+)
+
+type Endpoints struct {
+	tokens *token.Manager
+
+	GetTokenEndpoint   endpoint.Endpoint
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, cfg *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+	tgt, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	tgt.Path = ""
+
+	tokenTgt, err := url.Parse(cfg.TokenHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse auth host: %v", err)
+	}
+
+	var endpoints *Endpoints
+
+	options := []httptransport.ClientOption{
+		httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
+			if value, ok := token.FromContext(ctx); ok {
+				r.Header.Set("Authorization", value)
+			}
+			return ctx
+		}),
+	}
+
+	endpoints = &Endpoints{
+		GetTokenEndpoint: httptransport.NewClient("POST", tokenTgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			r.URL.Path = "/auth/token"
+
+			values := url.Values{}
+			values.Set("grant_type", "client_credentials")
+			values.Set("client_id", cfg.ClientID)
+			values.Set("client_secret", cfg.ClientSecret)
+
+			body := strings.NewReader(values.Encode())
+			r.Body = io.NopCloser(body)
+			r.ContentLength = int64(len(values.Encode()))
+
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			if resp.StatusCode != http.StatusOK {
+				return nil, push.HTTPError(resp)
+			}
+			defer resp.Body.Close()
+
+			body := new(Token)
+			err = json.NewDecoder(resp.Body).Decode(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed decode token: %v", err)
+			}
+			return body, nil
+		}, options...).Endpoint(),
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			r.URL.Path = fmt.Sprintf("/api/v1/%s/sendMessage", cfg.AppID)
+			req := request.(*push.Message)
+
+			type notification struct {
+				Title       string `json:"title,omitempty"`
+				Body        string `json:"body,omitempty"`
+				Importance  string `json:"importance,omitempty"`
+				ClickAction struct {
+					Type int `json:"type"`
+				} `json:"clickAction"`
+			}
+			body := &struct {
+				Android struct {
+					TTL            string        `json:"ttl,omitempty"`
+					Category       string        `json:"category,omitempty"`
+					TargetUserType int           `json:"targetUserType,omitempty"`
+					Data           string        `json:"data,omitempty"`
+					Notification   *notification `json:"notification,omitempty"`
+				} `json:"android"`
+
+				Token []string `json:"token"`
+			}{}
+
+			body.Android.Category = cfg.Category
+			body.Android.TargetUserType = cfg.TargetUserType
+			if cfg.TTL > 0 {
+				body.Android.TTL = strconv.FormatInt(int64(cfg.TTL/time.Second), 10) + "s"
+			}
+
+			switch cfg.MessageType {
+			case MessageData:
+				data, err := json.Marshal(map[string]string{
+					"title":   req.Payload.Title,
+					"content": req.Payload.Content,
+				})
+				if err != nil {
+					return err
+				}
+				body.Android.Data = string(data)
+			default:
+				body.Android.Notification = &notification{
+					Title:      req.Payload.Title,
+					Body:       req.Payload.Content,
+					Importance: cfg.Importance,
+				}
+				if req.Payload.Priority == "low" {
+					body.Android.Notification.Importance = ImportanceLow
+				}
+				// open the app
+				body.Android.Notification.ClickAction.Type = 3
+			}
+			body.Token = req.DeviceTokens
+
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(body)
+			if err != nil {
+				return err
+			}
+
+			r.Body = io.NopCloser(&buf)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("timestamp", strconv.FormatInt(time.Now().UnixMilli(), 10))
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			if resp.StatusCode == http.StatusUnauthorized {
+				return nil, push.Transient(strconv.Itoa(resp.StatusCode), token.Unauthorized(errors.New(resp.Status)))
+			}
+			if resp.StatusCode != http.StatusOK {
+				return nil, push.HTTPError(resp)
+			}
+			defer resp.Body.Close()
+
+			body := new(pushNoticeResponse)
+			if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+				return body, fmt.Errorf("failed decode push notice result: %v", err)
+			}
+
+			code := strconv.Itoa(body.Code)
+			switch code {
+			case codeSuccess, codePartialSuccess, codeInvalidToken:
+				return body, nil
+			}
+
+			err = fmt.Errorf("failed push notice: %s, requestID: %s", body.Message, body.Data.RequestID)
+			if _, ok := authFailureCodes[code]; ok {
+				err = token.Unauthorized(err)
+			}
+			return body, &push.Error{
+				Kind: codeKinds[code],
+				Code: code,
+				Err:  err,
+			}
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("honor", "push")(endpoints.PushNoticeEndpoint)
+	endpoints.GetTokenEndpoint = metrics.TokenMiddleware("honor")(endpoints.GetTokenEndpoint)
+
+	endpoints.tokens = token.New("honor:"+cfg.ClientID, endpoints.fetchToken, opts.TokenStore, logger)
+	endpoints.tokens.Start(ctx)
+	endpoints.PushNoticeEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+		endpoints.GetTokenEndpoint = breaker.Middleware(opts.Name+".token", opts.Breaker, logger)(endpoints.GetTokenEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// result codes of the push notice api in the error codes of the HONOR
+// push server api.
+const (
+	codeSuccess = "200"
+	// some tokens are sent, the others are in the fail and expire tokens
+	codePartialSuccess = "80100000"
+	// all tokens are invalid
+	codeInvalidToken = "80300007"
+)
+
+// codeKinds classifies the failure codes of the push notice api, the codes
+// not listed are permanent, e.g. 80100001 of the invalid parameters,
+// 80100003 of the invalid message, 80300002 of the app not allowed to push,
+// 80300008 of the message too large and 80300010 of too many tokens.
+var codeKinds = map[string]push.Kind{
+	codeAuthFailed:   push.KindTransient,
+	codeTokenExpired: push.KindTransient,
+	// system internal error
+	"81000001": push.KindTransient,
+}
+
+// failure codes of the access token.
+const (
+	// OAuth authentication error
+	codeAuthFailed = "80200001"
+	// OAuth token expired
+	codeTokenExpired = "80200003"
+)
+
+// authFailureCodes are the failure codes refreshing the access token.
+var authFailureCodes = map[string]struct{}{
+	codeAuthFailed:   {},
+	codeTokenExpired: {},
+}
+
+type pushNoticeResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Data    struct {
+		SendResult bool   `json:"sendResult"`
+		RequestID  string `json:"requestId,omitempty"`
+		// FailTokens are the tokens failed to send
+		FailTokens []string `json:"failTokens,omitempty"`
+		// ExpireTokens are the tokens no longer valid
+		ExpireTokens []string `json:"expireTokens,omitempty"`
+	} `json:"data"`
+}
+
+// result returns the push result of the tokens.
+func (r *pushNoticeResponse) result(tokens []string) *push.Result {
+	code := strconv.Itoa(r.Code)
+	result := push.NewResult(tokens, push.StatusDelivered, r.Data.RequestID, code, r.Message)
+	if code == codeInvalidToken {
+		result.SetStatus(tokens, push.StatusRejected)
+		return result
+	}
+	result.SetStatus(r.Data.FailTokens, push.StatusFailed)
+	result.SetStatus(r.Data.ExpireTokens, push.StatusRejected)
+	return result
+}
+
+type Token struct {
+	AccessToken string `json:"access_token,omitempty"`
+	TokenType   string `json:"token_type,omitempty"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
+}
+
+// fetchToken fetches the access token from the HONOR auth server.
+func (endpoints *Endpoints) fetchToken(ctx context.Context) (*token.Token, error) {
+	resp, err := endpoints.GetTokenEndpoint(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed get token: %w", err)
+	}
+
+	body := resp.(*Token)
+	tokenType := body.TokenType
+	if tokenType == "" {
+		tokenType = "Bearer"
+	}
+	now := time.Now()
+	return &token.Token{
+		Value:     fmt.Sprintf("%s %s", tokenType, body.AccessToken),
+		ExpiresAt: now.Add(time.Duration(body.ExpiresIn) * time.Second),
+		FetchedAt: now,
+	}, nil
+}
@@ -0,0 +1,156 @@
+package honor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// fakeHONOR is a stand-in of the HONOR auth and push servers
+type fakeHONOR struct {
+	// response is the body of the push notice responses
+	response string
+
+	locker     sync.Mutex
+	forms      []map[string]string
+	authorized []string
+	tokens     [][]string
+}
+
+func (f *fakeHONOR) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	switch r.URL.Path {
+	case "/auth/token":
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.forms = append(f.forms, map[string]string{
+			"grant_type":    r.PostForm.Get("grant_type"),
+			"client_id":     r.PostForm.Get("client_id"),
+			"client_secret": r.PostForm.Get("client_secret"),
+		})
+		_, _ = w.Write([]byte(`{"access_token":"access","token_type":"Bearer","expires_in":3600}`))
+	case "/api/v1/app/sendMessage":
+		body := new(struct {
+			Token []string `json:"token"`
+		})
+		_ = json.NewDecoder(r.Body).Decode(body)
+		f.authorized = append(f.authorized, r.Header.Get("Authorization"))
+		f.tokens = append(f.tokens, body.Token)
+		_, _ = w.Write([]byte(f.response))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newHONOR(t *testing.T, f *fakeHONOR) push.Push {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{AppID: "app", ClientID: "client", ClientSecret: "secret", Host: srv.URL, TokenHost: srv.URL}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, &provider.Options{Name: "honor", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTokenExchange(t *testing.T) {
+	f := &fakeHONOR{response: `{"code":200,"message":"success","data":{"sendResult":true,"requestId":"1"}}`}
+	p := newHONOR(t, f)
+
+	for i := 0; i < 2; i++ {
+		result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Filter(push.StatusDelivered)) != 2 {
+			t.Errorf("result = %+v, want delivered", result.Tokens)
+		}
+	}
+
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	// the access token is fetched once and reused
+	if len(f.forms) != 1 {
+		t.Fatalf("token exchanges = %d, want 1", len(f.forms))
+	}
+	want := map[string]string{"grant_type": "client_credentials", "client_id": "client", "client_secret": "secret"}
+	for key, value := range want {
+		if f.forms[0][key] != value {
+			t.Errorf("%s = %q, want %q", key, f.forms[0][key], value)
+		}
+	}
+	for i, value := range f.authorized {
+		if value != "Bearer access" {
+			t.Errorf("Authorization = %q, want the exchanged token", value)
+		}
+		if len(f.tokens[i]) != 2 {
+			t.Errorf("tokens = %v, want the tokens of the message", f.tokens[i])
+		}
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     []push.Status
+	}{
+		{
+			"sent",
+			`{"code":200,"message":"success","data":{"sendResult":true,"requestId":"1"}}`,
+			[]push.Status{push.StatusDelivered, push.StatusDelivered, push.StatusDelivered},
+		},
+		{
+			"partial success",
+			`{"code":80100000,"message":"partial success","data":{"requestId":"1","failTokens":["b"],"expireTokens":["c"]}}`,
+			[]push.Status{push.StatusDelivered, push.StatusFailed, push.StatusRejected},
+		},
+		{
+			"all tokens invalid",
+			`{"code":80300007,"message":"all the tokens are invalid","data":{"requestId":"1"}}`,
+			[]push.Status{push.StatusRejected, push.StatusRejected, push.StatusRejected},
+		},
+		{
+			"invalid parameters",
+			`{"code":80100001,"message":"invalid parameters","data":{"requestId":"1"}}`,
+			[]push.Status{push.StatusFailed, push.StatusFailed, push.StatusFailed},
+		},
+		{
+			"internal error",
+			`{"code":81000001,"message":"internal error","data":{"requestId":"1"}}`,
+			[]push.Status{push.StatusRetryable, push.StatusRetryable, push.StatusRetryable},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newHONOR(t, &fakeHONOR{response: tt.response})
+
+			tokens := []string{"a", "b", "c"}
+			result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: tokens, Payload: &push.Payload{}})
+			if err != nil {
+				result = push.FailedResult(tokens, err)
+			}
+			for i, token := range result.Tokens {
+				if token.Status != tt.want[i] {
+					t.Errorf("status of %s = %v, want %v", token.Token, token.Status, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package honor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type HONOR struct {
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("honor", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), cfg, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create HONOR endpoints: %v", err)
+	}
+	return &HONOR{
+		endpoints: endpoints,
+	}, nil
+}
+
+// Check fetches the access token of HONOR.
+func (p *HONOR) Check(ctx context.Context) error {
+	_, err := p.endpoints.tokens.Get(ctx)
+	return err
+}
+
+// maxBatchSize is the max number of tokens in a push request.
+const maxBatchSize = 1000
+
+func (p *HONOR) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+}
+
+// message types
+const (
+	// MessageNotification is displayed by the system
+	MessageNotification = "notification"
+	// MessageData is passed to the app, which displays it itself
+	MessageData = "data"
+)
+
+// notification importances
+const (
+	ImportanceNormal = "NORMAL"
+	ImportanceLow    = "LOW"
+)
+
+type Config struct {
+	AppID        string `yaml:"app_id"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	// Host overrides the HONOR push host, e.g. a local stand-in server.
+	// Default: https://push-api.cloud.honor.com
+	Host string `yaml:"host"`
+
+	// TokenHost overrides the HONOR auth host of the access tokens.
+	// Default: https://iam.developer.honor.com
+	TokenHost string `yaml:"token_host"`
+
+	// MessageType is the type of the messages: notification or data.
+	// Default: notification
+	MessageType string `yaml:"message_type"`
+
+	// Importance is the importance of the notifications: NORMAL or LOW,
+	// the low priority notifications are always sent with LOW.
+	// Default: NORMAL
+	Importance string `yaml:"importance"`
+
+	// Category is the category of the notifications, e.g. IM, which is
+	// approved by HONOR for the app.
+	Category string `yaml:"category"`
+
+	// TTL is how long the messages are kept while the devices are offline,
+	// HONOR keeps them for 1 day if it is 0.
+	TTL time.Duration `yaml:"ttl"`
+
+	// TargetUserType sends the messages as test messages if it is 1.
+	TargetUserType int `yaml:"target_user_type"`
+}
+
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		c.Host = defaultHost
+	}
+	if c.TokenHost == "" {
+		c.TokenHost = defaultTokenHost
+	}
+	if c.MessageType == "" {
+		c.MessageType = MessageNotification
+	}
+	if c.Importance == "" {
+		c.Importance = ImportanceNormal
+	}
+
+	if c.AppID == "" {
+		return fmt.Errorf("app id is required")
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("client id is required")
+	}
+	if c.ClientSecret == "" {
+		return fmt.Errorf("client secret is required")
+	}
+	if c.MessageType != MessageNotification && c.MessageType != MessageData {
+		return fmt.Errorf("unknown message type: %s", c.MessageType)
+	}
+	if c.Importance != ImportanceNormal && c.Importance != ImportanceLow {
+		return fmt.Errorf("unknown importance: %s", c.Importance)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	return nil
+}
@@ -9,33 +9,34 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/eachchat/yiqia-push/pkg/metrics"
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
 )
 
-const (
-	skipAuthKey = "X-Skip-Auth"
-)
-
 const (
 	host      = "https://push-api.cloud.huawei.com"
 	tokenHost = "https://oauth-login.cloud.huawei.com"
 )
 
 type Endpoints struct {
-	locker sync.Mutex
-	token  *Token
+	tokens *token.Manager
 
 	GetTokenEndpoint   endpoint.Endpoint
 	PushNoticeEndpoint endpoint.Endpoint
 }
 
-func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
+func newEndpoints(ctx context.Context, cfg *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
 	tgt, err := url.Parse(host)
 	if err != nil {
 		return nil, err
@@ -46,18 +47,9 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 
 	options := []httptransport.ClientOption{
 		httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
-			if r.Header.Get(skipAuthKey) != "" {
-				r.Header.Del(skipAuthKey)
-				return ctx
-			}
-
-			token, err := endpoints.getToken(ctx)
-			if err != nil {
-				// FIXME:
-				fmt.Println(err)
+			if value, ok := token.FromContext(ctx); ok {
+				r.Header.Set("Authorization", value)
 			}
-
-			r.Header.Set("Authorization", token)
 			return ctx
 		}),
 	}
@@ -70,7 +62,6 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 				return fmt.Errorf("failed parse auth host: %v", err)
 			}
 			r.URL.Path = "/oauth2/v3/token"
-			r.Header.Add(skipAuthKey, "True")
 
 			values := url.Values{}
 			values.Set("grant_type", "client_credentials")
@@ -85,16 +76,16 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			return nil
 		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
 			if resp.StatusCode != http.StatusOK {
-				return nil, errors.New(resp.Status)
+				return nil, push.HTTPError(resp)
 			}
 			defer resp.Body.Close()
 
-			token := new(Token)
-			err = json.NewDecoder(resp.Body).Decode(token)
+			body := new(Token)
+			err = json.NewDecoder(resp.Body).Decode(body)
 			if err != nil {
 				return nil, fmt.Errorf("failed decode token: %v", err)
 			}
-			return token, nil
+			return body, nil
 		}, options...).Endpoint(),
 		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
 			r.URL.Path = fmt.Sprintf("/v1/%s/messages:send", cfg.ClientId)
@@ -130,7 +121,7 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			body.Message.Token = req.DeviceTokens
 
 			var buf bytes.Buffer
-			err = json.NewEncoder(&buf).Encode(body)
+			err := json.NewEncoder(&buf).Encode(body)
 			if err != nil {
 				return err
 			}
@@ -139,54 +130,137 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			r.Header.Set("Content-Type", "application/json")
 			return nil
 		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
-			if resp.StatusCode != http.StatusOK {
-				return nil, errors.New(resp.Status)
+			// invalid tokens are reported with http status 400
+			if resp.StatusCode == http.StatusUnauthorized {
+				return nil, push.Transient(strconv.Itoa(resp.StatusCode), token.Unauthorized(errors.New(resp.Status)))
+			}
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				// HUAWEI responds 503 when the flow control is triggered
+				return nil, push.RateLimited(strconv.Itoa(resp.StatusCode), errors.New(resp.Status))
+			}
+			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+				return nil, push.HTTPError(resp)
 			}
 			defer resp.Body.Close()
 
-			body := &struct {
-				Code      string `json:"code,omitempty"`
-				Msg       string `json:"msg,omitempty"`
-				RequestID string `json:"requestId,omitempty"`
-			}{}
-
+			body := new(pushNoticeResponse)
 			if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
 				return body, fmt.Errorf("failed decode push notice result: %v", err)
 			}
 
-			if body.Code != "80000000" {
-				return body, fmt.Errorf("failed push notice: %s, requestID: %s", body.Msg, body.RequestID)
+			switch body.Code {
+			case codeSuccess, codePartialSuccess, codeInvalidToken:
+				return body, nil
 			}
 
-			return body, nil
+			err = fmt.Errorf("failed push notice: %s, requestID: %s", body.Msg, body.RequestID)
+			if _, ok := authFailureCodes[body.Code]; ok {
+				err = token.Unauthorized(err)
+			}
+			return body, &push.Error{
+				Kind: codeKinds[body.Code],
+				Code: body.Code,
+				Err:  err,
+			}
 		}, options...).Endpoint(),
 	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("huawei", "push")(endpoints.PushNoticeEndpoint)
+	endpoints.GetTokenEndpoint = metrics.TokenMiddleware("huawei")(endpoints.GetTokenEndpoint)
+
+	endpoints.tokens = token.New("huawei:"+cfg.ClientId, endpoints.fetchToken, opts.TokenStore, logger)
+	endpoints.tokens.Start(ctx)
+	endpoints.PushNoticeEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+		endpoints.GetTokenEndpoint = breaker.Middleware(opts.Name+".token", opts.Breaker, logger)(endpoints.GetTokenEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
 	return endpoints, nil
 }
 
+// result codes of the push notice api.
+// more info: https://developer.huawei.com/consumer/cn/doc/development/HMSCore-References/https-send-api-0000001050986197#section199311513445
+const (
+	codeSuccess = "80000000"
+	// some tokens are sent successfully, the illegal tokens are listed in msg
+	codePartialSuccess = "80100000"
+	// all tokens are invalid
+	codeInvalidToken = "80300007"
+)
+
+// codeKinds classifies the failure codes of the push notice api,
+// the codes not listed are permanent.
+var codeKinds = map[string]push.Kind{
+	codeAuthFailed:   push.KindTransient,
+	codeTokenExpired: push.KindTransient,
+	// system internal error
+	"81000001": push.KindTransient,
+}
+
+// failure codes of the access token.
+const (
+	// OAuth authentication error
+	codeAuthFailed = "80200001"
+	// OAuth token expired
+	codeTokenExpired = "80200003"
+)
+
+// authFailureCodes are the failure codes refreshing the access token.
+var authFailureCodes = map[string]struct{}{
+	codeAuthFailed:   {},
+	codeTokenExpired: {},
+}
+
+type pushNoticeResponse struct {
+	Code      string `json:"code,omitempty"`
+	Msg       string `json:"msg,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// result returns the push result of the tokens.
+func (r *pushNoticeResponse) result(tokens []string) *push.Result {
+	result := push.NewResult(tokens, push.StatusDelivered, r.RequestID, r.Code, r.Msg)
+	switch r.Code {
+	case codeInvalidToken:
+		result.SetStatus(tokens, push.StatusRejected)
+	case codePartialSuccess:
+		msg := &struct {
+			Success       int      `json:"success"`
+			Failure       int      `json:"failure"`
+			IllegalTokens []string `json:"illegal_tokens"`
+		}{}
+		if err := json.Unmarshal([]byte(r.Msg), msg); err == nil {
+			result.SetStatus(msg.IllegalTokens, push.StatusRejected)
+		}
+	}
+	return result
+}
+
 type Token struct {
 	AccessToken string `json:"access_token,omitempty"`
 	TokenType   string `json:"token_type,omitempty"`
 	ExpiresIn   int64  `json:"expires_in,omitempty"`
 }
 
-func (endpoints *Endpoints) getToken(ctx context.Context) (string, error) {
-	if endpoints.token == nil || time.Now().Add(time.Minute*5).Unix() > endpoints.token.ExpiresIn {
-		if !endpoints.locker.TryLock() {
-			<-time.After(time.Millisecond * 500)
-			return endpoints.getToken(ctx)
-		}
-
-		tokenInterface, err := endpoints.GetTokenEndpoint(ctx, nil)
-		if err != nil {
-			endpoints.locker.Unlock()
-			return "", fmt.Errorf("failed get token: %v", err)
-		}
-		token := tokenInterface.(*Token)
-		token.ExpiresIn += time.Now().Unix()
-		endpoints.token = token
-		endpoints.locker.Unlock()
+// fetchToken fetches the access token from the HUAWEI OAuth server.
+func (endpoints *Endpoints) fetchToken(ctx context.Context) (*token.Token, error) {
+	resp, err := endpoints.GetTokenEndpoint(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed get token: %w", err)
 	}
 
-	return fmt.Sprintf("%s %s", endpoints.token.TokenType, endpoints.token.AccessToken), nil
+	body := resp.(*Token)
+	now := time.Now()
+	return &token.Token{
+		Value:     fmt.Sprintf("%s %s", body.TokenType, body.AccessToken),
+		ExpiresAt: now.Add(time.Duration(body.ExpiresIn) * time.Second),
+		FetchedAt: now,
+	}, nil
 }
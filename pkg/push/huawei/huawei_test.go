@@ -0,0 +1,46 @@
+package huawei
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+func TestResult(t *testing.T) {
+	resp := new(pushNoticeResponse)
+	if err := json.Unmarshal([]byte(`{"code":"80000000","msg":"Success","requestId":"request"}`), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	result := resp.result([]string{"a", "b"})
+	for _, token := range result.Tokens {
+		if token.Status != push.StatusDelivered || token.MessageID != "request" || token.Code != "80000000" || token.Reason != "Success" {
+			t.Errorf("result = %+v, want delivered with the request id and the code", token)
+		}
+	}
+}
+
+func TestResultRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []push.Status
+	}{
+		{"invalid tokens", `{"code":"80300007","msg":"All the tokens are invalid","requestId":"request"}`, []push.Status{push.StatusRejected, push.StatusRejected}},
+		{"partial success", `{"code":"80100000","msg":"{\"success\":1,\"failure\":1,\"illegal_tokens\":[\"b\"]}","requestId":"request"}`, []push.Status{push.StatusDelivered, push.StatusRejected}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(pushNoticeResponse)
+			if err := json.Unmarshal([]byte(tt.data), resp); err != nil {
+				t.Fatal(err)
+			}
+			for i, token := range resp.result([]string{"a", "b"}).Tokens {
+				if token.Status != tt.want[i] {
+					t.Errorf("result = %+v, want %v", token, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -5,14 +5,24 @@ import (
 	"fmt"
 
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
 )
 
 type HUAWEI struct {
 	endpoints *Endpoints
 }
 
-func New(cfg *Config) (push.Push, error) {
-	endpoints, err := newEndpoints(context.Background(), cfg)
+func init() {
+	provider.Register("huawei", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), cfg, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed create HUAWEI endpoints: %v", err)
 	}
@@ -21,11 +31,25 @@ func New(cfg *Config) (push.Push, error) {
 	}, nil
 }
 
-func (p *HUAWEI) PushNotice(ctx context.Context, message *push.Message) error {
-	_, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+// Check fetches the access token of HUAWEI.
+func (p *HUAWEI) Check(ctx context.Context) error {
+	_, err := p.endpoints.tokens.Get(ctx)
 	return err
 }
 
+// maxBatchSize is the max number of tokens in a push request.
+const maxBatchSize = 1000
+
+func (p *HUAWEI) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+}
+
 type Config struct {
 	ClientId       string `yaml:"client_id"`
 	ClientSecret   string `yaml:"client_secret"`
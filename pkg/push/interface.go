@@ -1,11 +1,22 @@
 package push
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+)
 
 // Message is the message to be pushed
 type Message struct {
+	// ID identifies the message across the retries of its delivery,
+	// it is generated once when the notification is received
+	ID string
+	// AppID is the app id of the pusher the devices registered with
+	AppID        string
 	DeviceTokens []string
 	Payload      *Payload
+	// DeviceData is the pusher data of the device tokens keyed by the token,
+	// e.g. the Web Push subscription of the pushkey
+	DeviceData map[string]map[string]interface{}
 }
 
 // Payload is the payload of the message
@@ -15,10 +26,39 @@ type Payload struct {
 	Content       string
 	CallBack      string
 	CallbackParam string
+	// CollapseID identifies the notifications replacing each other on the
+	// device, e.g. the notifications of the same room
+	CollapseID string
+	// Priority is the priority of the notification, high or low
+	Priority string
+	// Notification is the Matrix notification without the devices,
+	// forwarded as is by the providers of the Matrix clients
+	Notification json.RawMessage
 }
 
 // Push is the interface for push
 type Push interface {
-	// PushNotice pushes the message to the devices
-	PushNotice(ctx context.Context, message *Message) error
+	// PushNotice pushes the message to the devices.
+	// The error is returned when the push fails as a whole, otherwise the
+	// result contains the status of every device token of the message.
+	PushNotice(ctx context.Context, message *Message) (*Result, error)
+}
+
+// Middleware decorates a Push with additional behavior
+type Middleware func(Push) Push
+
+// Forwarder is implemented by the push clients forwarding the Matrix
+// notification to the devices. The notifications without a sender, e.g. the
+// updates of the unread counts, have nothing to display and are pushed by the
+// forwarders only.
+type Forwarder interface {
+	// Forwards reports whether the notification is forwarded to the devices.
+	Forwards() bool
+}
+
+// Checker is implemented by the push clients authenticating with an access token
+type Checker interface {
+	// Check fetches the access token of the vendor, the error is returned
+	// when the credentials are not usable.
+	Check(ctx context.Context) error
 }
@@ -0,0 +1,172 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	// the vendor timezones are available without the system tzdata
+	_ "time/tzdata"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/ratelimit"
+	"golang.org/x/time/rate"
+)
+
+// codeQuotaExceeded is the code of the tokens failing fast
+// because of the exhausted daily quota.
+const codeQuotaExceeded = "quota_exceeded"
+
+type Config struct {
+	// QPS is the max number of the vendor requests per second,
+	// the requests exceeding it are delayed. No limit if it is 0.
+	QPS float64 `yaml:"qps"`
+
+	// Burst is the max number of the vendor requests sent at once.
+	// Default: QPS, at least 1
+	Burst int `yaml:"burst"`
+
+	// DailyQuota is the max number of the device tokens pushed per day,
+	// the tokens exceeding it fail fast. No limit if it is 0, but the
+	// tokens still fail fast once the vendor reports the quota exceeded.
+	DailyQuota int `yaml:"daily_quota"`
+
+	// Timezone is the timezone of the vendor, the daily quota resets at
+	// its midnight.
+	// Default: Asia/Shanghai
+	Timezone string `yaml:"timezone"`
+
+	location *time.Location
+}
+
+func (c *Config) Validate() error {
+	if c.QPS < 0 || c.Burst < 0 || c.DailyQuota < 0 {
+		return fmt.Errorf("limits must be positive")
+	}
+	if c.Burst == 0 {
+		c.Burst = int(c.QPS)
+		if c.Burst < 1 {
+			c.Burst = 1
+		}
+	}
+	if c.Timezone == "" {
+		c.Timezone = "Asia/Shanghai"
+	}
+
+	location, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
+	}
+	c.location = location
+	return nil
+}
+
+// EndpointMiddleware returns an endpoint middleware which delays the vendor
+// requests to respect the QPS. The requests which can not be sent before
+// the context deadline fail as rate limited.
+func EndpointMiddleware(cfg *Config) endpoint.Middleware {
+	if cfg.QPS <= 0 {
+		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			return next
+		}
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(cfg.QPS), cfg.Burst)
+	return ratelimit.NewDelayingLimiter(ratelimit.WaiterFunc(func(ctx context.Context) error {
+		err := limiter.Wait(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return push.RateLimited("", fmt.Errorf("failed wait rate limiter: %v", err))
+		}
+		return err
+	}))
+}
+
+// Middleware returns a push middleware which counts the device tokens
+// against the daily quota. The tokens exceeding the quota fail fast as
+// quota exceeded, without calling the vendor. The quota is also used up
+// once the vendor reports it is exceeded, until the next day.
+func Middleware(cfg *Config) push.Middleware {
+	return func(next push.Push) push.Push {
+		return &quota{
+			cfg:  cfg,
+			next: next,
+		}
+	}
+}
+
+type quota struct {
+	cfg  *Config
+	next push.Push
+
+	locker    sync.Mutex
+	day       string
+	used      int
+	exhausted bool
+}
+
+// take takes at most n tokens from the quota of today,
+// it returns the number of the tokens taken.
+func (q *quota) take(n int) int {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	q.reset()
+	if q.exhausted {
+		return 0
+	}
+	if q.cfg.DailyQuota <= 0 {
+		return n
+	}
+
+	if remaining := q.cfg.DailyQuota - q.used; n > remaining {
+		n = remaining
+	}
+	q.used += n
+	return n
+}
+
+// exhaust uses up the quota of today, as the vendor reports so.
+func (q *quota) exhaust() {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	q.reset()
+	q.exhausted = true
+}
+
+// reset clears the used quota at the midnight of the vendor timezone.
+func (q *quota) reset() {
+	day := time.Now().In(q.cfg.location).Format(time.DateOnly)
+	if day != q.day {
+		q.day = day
+		q.used = 0
+		q.exhausted = false
+	}
+}
+
+func (q *quota) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	n := q.take(len(message.DeviceTokens))
+	exceeded := push.NewResult(message.DeviceTokens[n:], push.StatusQuotaExceeded, "", codeQuotaExceeded, "daily quota exhausted")
+	if n == 0 {
+		return exceeded, nil
+	}
+
+	allowed := *message
+	allowed.DeviceTokens = message.DeviceTokens[:n]
+	result, err := q.next.PushNotice(ctx, &allowed)
+	if err != nil {
+		if len(exceeded.Tokens) == 0 {
+			return nil, err
+		}
+		result = push.FailedResult(allowed.DeviceTokens, err)
+	}
+
+	if len(result.Filter(push.StatusQuotaExceeded)) > 0 {
+		q.exhaust()
+	}
+
+	result.Merge(exceeded)
+	return result, nil
+}
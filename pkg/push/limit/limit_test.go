@@ -0,0 +1,125 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+// pushFunc adapts a function to push.Push
+type pushFunc func(ctx context.Context, message *push.Message) (*push.Result, error)
+
+func (f pushFunc) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return f(ctx, message)
+}
+
+func newQuota(t *testing.T, dailyQuota int, next push.Push) *quota {
+	t.Helper()
+	cfg := &Config{DailyQuota: dailyQuota}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return Middleware(cfg)(next).(*quota)
+}
+
+func delivered(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.NewResult(message.DeviceTokens, push.StatusDelivered, "", "", ""), nil
+}
+
+func count(result *push.Result, status push.Status) int {
+	return len(result.Filter(status))
+}
+
+func TestQuotaTake(t *testing.T) {
+	tests := []struct {
+		name       string
+		dailyQuota int
+		takes      []int
+		want       []int
+	}{
+		{"unlimited", 0, []int{5, 100}, []int{5, 100}},
+		{"within quota", 10, []int{3, 4}, []int{3, 4}},
+		{"partially exceeded", 10, []int{6, 6, 1}, []int{6, 4, 0}},
+		{"exactly used up", 4, []int{4, 1}, []int{4, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuota(t, tt.dailyQuota, pushFunc(delivered))
+			for i, n := range tt.takes {
+				if got := q.take(n); got != tt.want[i] {
+					t.Errorf("take #%d(%d) = %d, want %d", i, n, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	q := newQuota(t, 2, pushFunc(delivered))
+	if got := q.take(3); got != 2 {
+		t.Fatalf("take(3) = %d, want 2", got)
+	}
+	q.exhaust()
+	if got := q.take(1); got != 0 {
+		t.Fatalf("take(1) after exhausted = %d, want 0", got)
+	}
+
+	// the quota of yesterday is reset at the midnight of the timezone
+	yesterday := time.Now().In(q.cfg.location).AddDate(0, 0, -1).Format(time.DateOnly)
+	q.locker.Lock()
+	q.day = yesterday
+	q.locker.Unlock()
+
+	if got := q.take(1); got != 1 {
+		t.Errorf("take(1) on the next day = %d, want 1", got)
+	}
+	if q.exhausted {
+		t.Error("quota still exhausted on the next day")
+	}
+}
+
+func TestQuotaMiddleware(t *testing.T) {
+	q := newQuota(t, 3, pushFunc(delivered))
+	message := &push.Message{DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{}}
+
+	result, err := q.PushNotice(context.Background(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count(result, push.StatusDelivered) != 2 {
+		t.Errorf("first push: %+v, want 2 delivered", result.Tokens)
+	}
+
+	result, err = q.PushNotice(context.Background(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count(result, push.StatusDelivered) != 1 || count(result, push.StatusQuotaExceeded) != 1 {
+		t.Errorf("second push: %+v, want 1 delivered and 1 quota exceeded", result.Tokens)
+	}
+}
+
+func TestQuotaExhaustedByVendor(t *testing.T) {
+	calls := 0
+	q := newQuota(t, 0, pushFunc(func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		calls++
+		return push.NewResult(message.DeviceTokens, push.StatusQuotaExceeded, "", "", ""), nil
+	}))
+	message := &push.Message{DeviceTokens: []string{"a"}, Payload: &push.Payload{}}
+
+	for i := 0; i < 2; i++ {
+		result, err := q.PushNotice(context.Background(), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count(result, push.StatusQuotaExceeded) != 1 {
+			t.Errorf("push #%d: %+v, want quota exceeded", i, result.Tokens)
+		}
+	}
+	// the tokens fail fast once the vendor reports the quota exceeded
+	if calls != 1 {
+		t.Errorf("vendor calls = %d, want 1", calls)
+	}
+}
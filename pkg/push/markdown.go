@@ -0,0 +1,31 @@
+package push
+
+import "strings"
+
+// markdownEscaper escapes the markdown syntax with backslashes and the HTML
+// syntax, e.g. the font tags of the bots, with character references.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"`", "\\`",
+	`*`, `\*`,
+	`_`, `\_`,
+	`~`, `\~`,
+	`#`, `\#`,
+	`+`, `\+`,
+	`-`, `\-`,
+	`!`, `\!`,
+	`|`, `\|`,
+	`[`, `\[`,
+	`]`, `\]`,
+	`(`, `\(`,
+	`)`, `\)`,
+	`&`, `&amp;`,
+	`<`, `&lt;`,
+	`>`, `&gt;`,
+)
+
+// EscapeMarkdown escapes the text of the notification to be shown as is in
+// a markdown message, e.g. the message body of a user.
+func EscapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
@@ -0,0 +1,22 @@
+package push
+
+import "testing"
+
+func TestEscapeMarkdown(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hello", "hello"},
+		{"**bold** _it_", `\*\*bold\*\* \_it\_`},
+		{"[link](http://a)", `\[link\]\(http://a\)`},
+		{"# title", `\# title`},
+		{`<font color="red">x</font>`, `&lt;font color="red"&gt;x&lt;/font&gt;`},
+		{`a\*b`, `a\\\*b`},
+	}
+	for _, tt := range tests {
+		if got := EscapeMarkdown(tt.text); got != tt.want {
+			t.Errorf("EscapeMarkdown(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package meizu
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	defaultHost = "https://server-api-push.meizu.com"
+)
+
+// paths of the push apis of the message types
+var paths = map[string]string{
+	MessageNotification: "/garcia/api/server/push/varnished/pushByPushId",
+	MessageUnvarnished:  "/garcia/api/server/push/unvarnished/pushByPushId",
+}
+
+type Endpoints struct {
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, conf *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+	tgt, err := url.Parse(conf.Host)
+	if err != nil {
+		return nil, err
+	}
+	tgt.Path = ""
+
+	var endpoints *Endpoints
+	options := []httptransport.ClientOption{}
+
+	endpoints = &Endpoints{
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*push.Message)
+
+			message, err := json.Marshal(endpoints.message(conf, req))
+			if err != nil {
+				return err
+			}
+
+			values := url.Values{}
+			values.Set("appId", conf.AppID)
+			values.Set("pushIds", strings.Join(req.DeviceTokens, ","))
+			values.Set("messageJson", string(message))
+			values.Set("sign", endpoints.sign(values, conf.AppSecret))
+
+			body := strings.NewReader(values.Encode())
+			r.Body = io.NopCloser(body)
+			r.ContentLength = int64(len(values.Encode()))
+
+			r.URL.Path = paths[conf.MessageType]
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			if resp.StatusCode != http.StatusOK {
+				return nil, push.HTTPError(resp)
+			}
+			defer resp.Body.Close()
+
+			body := new(pushNoticeResponse)
+			err = json.NewDecoder(resp.Body).Decode(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed decode body: %v", err)
+			}
+
+			if body.Code != codeSuccess {
+				return nil, &push.Error{
+					Kind: codeKinds[body.Code],
+					Code: body.Code,
+					Err:  fmt.Errorf("failed push notice: %s, msgId: %s", body.Message, body.MsgID),
+				}
+			}
+			return body, nil
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("meizu", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// message returns the messageJson of the message type.
+func (endpoints *Endpoints) message(conf *Config, req *push.Message) interface{} {
+	pushTimeInfo := map[string]interface{}{
+		// keep the message while the device is offline
+		"offLine":   1,
+		"validTime": int(conf.TTL / time.Hour),
+	}
+
+	if conf.MessageType == MessageUnvarnished {
+		return map[string]interface{}{
+			"title":        req.Payload.Title,
+			"content":      req.Payload.Content,
+			"pushTimeInfo": pushTimeInfo,
+		}
+	}
+
+	return map[string]interface{}{
+		"noticeBarInfo": map[string]interface{}{
+			"noticeBarType": 0,
+			"title":         req.Payload.Title,
+			"content":       req.Payload.Content,
+		},
+		// open the app
+		"clickTypeInfo": map[string]interface{}{
+			"clickType": 0,
+		},
+		"pushTimeInfo": pushTimeInfo,
+	}
+}
+
+// sign returns the MD5 of the parameters sorted by the keys, each in the
+// form of key=value, followed by the app secret.
+func (endpoints *Endpoints) sign(values url.Values, appSecret string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var signStr strings.Builder
+	for _, key := range keys {
+		signStr.WriteString(key)
+		signStr.WriteString("=")
+		signStr.WriteString(values.Get(key))
+	}
+	signStr.WriteString(appSecret)
+
+	hash := md5.New()
+	_, _ = hash.Write([]byte(signStr.String()))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+const codeSuccess = "200"
+
+// codeKinds classifies the failure codes of the push api,
+// the codes not listed are permanent.
+var codeKinds = map[string]push.Kind{
+	// system error
+	"1001": push.KindTransient,
+	// server busy
+	"1003": push.KindTransient,
+}
+
+// codes of the pushIds failed in the push result.
+const (
+	// the pushId is no longer valid
+	codeInvalidPushID = "110002"
+	// the pushId is illegal
+	codeIllegalPushID = "110003"
+)
+
+// rejectedCodes are the codes of the invalid pushIds.
+var rejectedCodes = map[string]struct{}{
+	codeInvalidPushID: {},
+	codeIllegalPushID: {},
+}
+
+type pushNoticeResponse struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Value maps the failure codes to the failed pushIds
+	Value map[string][]string `json:"value,omitempty"`
+	MsgID string              `json:"msgId,omitempty"`
+}
+
+// result returns the push result of the pushIds, the invalid pushIds are
+// rejected and the pushIds failed otherwise are not retried.
+func (r *pushNoticeResponse) result(pushIDs []string) *push.Result {
+	result := push.NewResult(pushIDs, push.StatusDelivered, r.MsgID, r.Code, r.Message)
+	for code, failed := range r.Value {
+		status := push.StatusFailed
+		if _, ok := rejectedCodes[code]; ok {
+			status = push.StatusRejected
+		}
+		result.SetStatus(failed, status)
+	}
+	return result
+}
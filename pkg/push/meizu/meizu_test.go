@@ -0,0 +1,131 @@
+package meizu
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// fakeMeizu is a stand-in of the Meizu push server
+type fakeMeizu struct {
+	// response is the body of the push notice responses
+	response string
+
+	locker sync.Mutex
+	forms  []map[string]string
+}
+
+func (f *fakeMeizu) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if r.URL.Path != paths[MessageNotification] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	form := make(map[string]string)
+	for key := range r.PostForm {
+		form[key] = r.PostForm.Get(key)
+	}
+	f.forms = append(f.forms, form)
+	_, _ = w.Write([]byte(f.response))
+}
+
+func newMeizu(t *testing.T, f *fakeMeizu) push.Push {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{AppID: "100", AppSecret: "secret", Host: srv.URL}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPushClient(cfg, &provider.Options{Name: "meizu", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSign(t *testing.T) {
+	f := &fakeMeizu{response: `{"code":"200","message":"","value":{},"msgId":"1"}`}
+	p := newMeizu(t, f)
+
+	result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{Title: "title", Content: "content"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != 2 {
+		t.Errorf("result = %+v, want delivered", result.Tokens)
+	}
+
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	form := f.forms[0]
+	if form["appId"] != "100" || form["pushIds"] != "a,b" {
+		t.Errorf("form = %v", form)
+	}
+	// the sorted key=value of the parameters followed by the app secret
+	signStr := "appId=" + form["appId"] + "messageJson=" + form["messageJson"] + "pushIds=" + form["pushIds"] + "secret"
+	sum := md5.Sum([]byte(signStr))
+	if want := hex.EncodeToString(sum[:]); form["sign"] != want {
+		t.Errorf("sign = %q, want %q", form["sign"], want)
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     []push.Status
+	}{
+		{
+			"sent",
+			`{"code":"200","message":"","value":{},"msgId":"1"}`,
+			[]push.Status{push.StatusDelivered, push.StatusDelivered, push.StatusDelivered, push.StatusDelivered},
+		},
+		{
+			"invalid pushIds",
+			`{"code":"200","message":"","value":{"110002":["b"],"110003":["c"],"110010":["d"]},"msgId":"1"}`,
+			[]push.Status{push.StatusDelivered, push.StatusRejected, push.StatusRejected, push.StatusFailed},
+		},
+		{
+			"system error",
+			`{"code":"1001","message":"system error"}`,
+			[]push.Status{push.StatusRetryable, push.StatusRetryable, push.StatusRetryable, push.StatusRetryable},
+		},
+		{
+			"invalid sign",
+			`{"code":"1006","message":"invalid sign"}`,
+			[]push.Status{push.StatusFailed, push.StatusFailed, push.StatusFailed, push.StatusFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newMeizu(t, &fakeMeizu{response: tt.response})
+
+			tokens := []string{"a", "b", "c", "d"}
+			result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: tokens, Payload: &push.Payload{}})
+			if err != nil {
+				result = push.FailedResult(tokens, err)
+			}
+			for i, token := range result.Tokens {
+				if token.Status != tt.want[i] {
+					t.Errorf("status of %s = %v, want %v", token.Token, token.Status, tt.want[i])
+				}
+			}
+		})
+	}
+}
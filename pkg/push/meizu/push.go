@@ -0,0 +1,98 @@
+package meizu
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type MEIZU struct {
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("meizu", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return NewPushClient(cfg.(*Config), opts)
+	})
+}
+
+func NewPushClient(cfg *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), cfg, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create MEIZU endpoints: %v", err)
+	}
+	return &MEIZU{
+		endpoints: endpoints,
+	}, nil
+}
+
+// maxBatchSize is the max number of pushIds in a push request.
+const maxBatchSize = 1000
+
+func (p *MEIZU) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+}
+
+// message types
+const (
+	// MessageNotification is displayed in the notification bar by the system
+	MessageNotification = "notification"
+	// MessageUnvarnished is passed to the app, which displays it itself
+	MessageUnvarnished = "unvarnished"
+)
+
+type Config struct {
+	AppID     string `yaml:"app_id"`
+	AppSecret string `yaml:"app_secret"`
+
+	// Host overrides the Meizu push host, e.g. a local stand-in server.
+	// Default: https://server-api-push.meizu.com
+	Host string `yaml:"host"`
+
+	// MessageType is the type of the messages: notification or unvarnished.
+	// Default: notification
+	MessageType string `yaml:"message_type"`
+
+	// TTL is how long the messages are kept while the devices are offline,
+	// in hours from 1h to 72h.
+	// Default: 24h
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		c.Host = defaultHost
+	}
+	if c.MessageType == "" {
+		c.MessageType = MessageNotification
+	}
+	if c.TTL == 0 {
+		c.TTL = 24 * time.Hour
+	}
+
+	if c.AppID == "" {
+		return fmt.Errorf("app id is required")
+	}
+	if c.AppSecret == "" {
+		return fmt.Errorf("app secret is required")
+	}
+	if c.MessageType != MessageNotification && c.MessageType != MessageUnvarnished {
+		return fmt.Errorf("unknown message type: %s", c.MessageType)
+	}
+	if c.TTL < time.Hour || c.TTL > 72*time.Hour {
+		return fmt.Errorf("ttl must be between 1h and 72h")
+	}
+	return nil
+}
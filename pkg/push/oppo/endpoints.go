@@ -11,10 +11,14 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/eachchat/yiqia-push/pkg/metrics"
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
 )
@@ -24,14 +28,15 @@ const (
 )
 
 type Endpoints struct {
-	locker sync.Mutex
-	token  *Token
+	tokens *token.Manager
 
-	GetTokenEndpoint   endpoint.Endpoint
-	PushNoticeEndpoint endpoint.Endpoint
+	GetTokenEndpoint        endpoint.Endpoint
+	PushNoticeEndpoint      endpoint.Endpoint
+	PushNoticeBatchEndpoint endpoint.Endpoint
 }
 
-func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
+func newEndpoints(ctx context.Context, cfg *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
 	tgt, err := url.Parse(host)
 	if err != nil {
 		return nil, err
@@ -60,7 +65,7 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			return nil
 		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
 			if resp.StatusCode != http.StatusOK {
-				return nil, fmt.Errorf("get token failed, status code: %d", resp.StatusCode)
+				return nil, push.HTTPError(resp)
 			}
 			defer resp.Body.Close()
 
@@ -68,9 +73,9 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 				Code    int    `json:"code"`
 				Message string `json:"message"`
 				Data    struct {
-					// default 24 hours
-					AuthToken  string `json:"auth_token"`
-					CreateTime int    `json:"create_time"`
+					AuthToken string `json:"auth_token"`
+					// the create time in milliseconds
+					CreateTime int64 `json:"create_time"`
 				} `json:"data"`
 			}{}
 
@@ -79,61 +84,74 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 				return nil, fmt.Errorf("failed decode token: %v", err)
 			}
 
-			return body.Data.AuthToken, nil
+			if body.Code != codeSuccess {
+				return nil, classify(body.Code, fmt.Errorf("failed get token: %s", body.Message))
+			}
+
+			createdAt := time.Now()
+			if body.Data.CreateTime > 0 {
+				createdAt = time.UnixMilli(body.Data.CreateTime)
+			}
+			return &token.Token{
+				Value:     body.Data.AuthToken,
+				ExpiresAt: createdAt.Add(tokenLifetime),
+				FetchedAt: time.Now(),
+			}, nil
 		}, options...).Endpoint(),
 		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
 			r.URL.Path = "/server/v1/message/notification/unicast"
 
-			authToken, err := endpoints.getToken(ctx)
+			authToken, _ := token.FromContext(ctx)
+			values := url.Values{}
+			values.Add("auth_token", authToken)
+
+			req := request.(*push.Message)
+			message := newNotice(cfg, req.Payload, strings.Join(req.DeviceTokens, ","))
+
+			messageByte, _ := json.Marshal(message)
+			values.Add("message", string(messageByte))
+
+			body := strings.NewReader(values.Encode())
+			r.Body = io.NopCloser(body)
+			r.ContentLength = int64(len(values.Encode()))
+
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			if resp.StatusCode != http.StatusOK {
+				return nil, push.HTTPError(resp)
+			}
+			defer resp.Body.Close()
+
+			body := new(pushNoticeResponse)
+			err = json.NewDecoder(resp.Body).Decode(body)
 			if err != nil {
-				return fmt.Errorf("failed get token: %v", err)
+				return nil, fmt.Errorf("failed decode push result: %v", err)
 			}
 
+			if _, ok := codeStatus[body.Code]; !ok {
+				return nil, classify(body.Code, fmt.Errorf("failed push message: %s, messageID: %s, registrationID: %s",
+					body.Message, body.Data.MessageID, body.Data.RegistrationID))
+			}
+
+			return body, nil
+		}, options...).Endpoint(),
+		// more info: https://open.oppomobile.com/new/developmentDoc/info?id=11238
+		PushNoticeBatchEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			r.URL.Path = "/server/v1/message/notification/unicast_batch"
+
+			authToken, _ := token.FromContext(ctx)
 			values := url.Values{}
 			values.Add("auth_token", authToken)
 
 			req := request.(*push.Message)
-			// more info: https://open.oppomobile.com/new/developmentDoc/info?id=11238
-			message := struct {
-				// 推送的目标类型 2: registration_id 5: 别名
-				TargetType int `json:"target_type"`
-				// 推送目标，按taget_type对应填入，仅接受一个值。
-				TargetValue string `json:"target_value"`
-				// 消息到达客户端后是否校验registration_id。 true表示推送目标与客户端registration_id进行比较，如果一致则继续展示，不一致则就丢弃；false表示不校验
-				VerifyRegistrationID bool `json:"verify_registration_id"`
-
-				Notification struct {
-					// 通知栏样式 default 1
-					Style int `json:"style"`
-					// 设置在通知栏展示的通知栏标题, 【字数串长度限制在50个字符内，中英文字符及特殊符号（如emoji）均视为一个字符】
-					Title   string `json:"title"`
-					Content string `json:"content"`
-					// 点击通知栏后触发的动作类型。 0.启动应用；1.跳转指定应用内页（action标签名）；2.跳转网页；4.跳转指定应用内页（全路径类名）；【非必填，默认值为0】; 5.跳转Intent scheme URL
-					ClickActionType     int    `json:"click_action_type"`
-					ClickActionActivity string `json:"click_action_activity"`
-					// 是否是离线消息。如果是离线消息，OPPO PUSH在设备离线期间缓存消息一段时间，等待设备上线接收。 default true
-					OffLine bool `json:"off_line"`
-					// 离线消息的存活时间，单位是秒。存活时间最大允许设置为10天，参数超过10天以10天传入。 default 3600
-					OffLineTTL int `json:"off_line_ttl"`
-					// 通知栏通道（NotificationChannel），从Android9开始，Android设备发送通知栏消息必须要指定通道ID，（如果是快应用，必须带置顶的通道Id:OPPO PUSH推送）
-					ChannelID string `json:"channel_id"`
-				} `json:"notification"`
-			}{
-				TargetType:           2,
-				TargetValue:          strings.Join(req.DeviceTokens, ","),
-				VerifyRegistrationID: false,
+			messages := make([]*notice, 0, len(req.DeviceTokens))
+			for _, token := range req.DeviceTokens {
+				messages = append(messages, newNotice(cfg, req.Payload, token))
 			}
 
-			message.Notification.Title = req.Payload.Title
-			message.Notification.Content = req.Payload.Content
-			message.Notification.Style = 1
-			message.Notification.ClickActionType = 0
-			message.Notification.OffLine = true
-			message.Notification.OffLineTTL = 60 * 60 * 24 * 10
-			message.Notification.ChannelID = cfg.ChannelID
-
-			messageByte, _ := json.Marshal(message)
-			values.Add("message", string(messageByte))
+			messagesByte, _ := json.Marshal(messages)
+			values.Add("messages", string(messagesByte))
 
 			body := strings.NewReader(values.Encode())
 			r.Body = io.NopCloser(body)
@@ -143,61 +161,197 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			return nil
 		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
 			if resp.StatusCode != http.StatusOK {
-				return nil, fmt.Errorf("failed push message, code: %d", resp.StatusCode)
+				return nil, push.HTTPError(resp)
 			}
 			defer resp.Body.Close()
 
-			body := &struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-				Data    struct {
-					MessageID      string `json:"messageId"`
-					RegistrationID string `json:"registrationId"`
-				}
-			}{}
-
+			body := new(pushNoticeBatchResponse)
 			err = json.NewDecoder(resp.Body).Decode(body)
 			if err != nil {
 				return nil, fmt.Errorf("failed decode push result: %v", err)
 			}
 
-			if body.Code != 0 {
-				return nil, fmt.Errorf("failed push message: %s, messageID: %s, registrationID: %s",
-					body.Message, body.Data.MessageID, body.Data.RegistrationID)
+			if _, ok := codeStatus[body.Code]; !ok {
+				return nil, classify(body.Code, fmt.Errorf("failed push message: %s", body.Message))
 			}
 
 			return body, nil
 		}, options...).Endpoint(),
 	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("oppo", "push")(endpoints.PushNoticeEndpoint)
+	endpoints.PushNoticeBatchEndpoint = metrics.EndpointMiddleware("oppo", "push_batch")(endpoints.PushNoticeBatchEndpoint)
+	endpoints.GetTokenEndpoint = metrics.TokenMiddleware("oppo")(endpoints.GetTokenEndpoint)
+
+	endpoints.tokens = token.New("oppo:"+cfg.AppKey, endpoints.fetchToken, opts.TokenStore, logger)
+	endpoints.tokens.Start(ctx)
+	endpoints.PushNoticeEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeEndpoint)
+	endpoints.PushNoticeBatchEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeBatchEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+		endpoints.PushNoticeBatchEndpoint = pushBreaker(endpoints.PushNoticeBatchEndpoint)
+		endpoints.GetTokenEndpoint = breaker.Middleware(opts.Name+".token", opts.Breaker, logger)(endpoints.GetTokenEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+		endpoints.PushNoticeBatchEndpoint = limiter(endpoints.PushNoticeBatchEndpoint)
+	}
+
 	return endpoints, nil
 }
 
-type Token struct {
-	AccessToken string
-	ExpiresIn   int64
+// notice is the unicast message of the push api.
+// more info: https://open.oppomobile.com/new/developmentDoc/info?id=11238
+type notice struct {
+	// 推送的目标类型 2: registration_id 5: 别名
+	TargetType int `json:"target_type"`
+	// 推送目标，按taget_type对应填入，仅接受一个值。
+	TargetValue string `json:"target_value"`
+	// 消息到达客户端后是否校验registration_id。 true表示推送目标与客户端registration_id进行比较，如果一致则继续展示，不一致则就丢弃；false表示不校验
+	VerifyRegistrationID bool `json:"verify_registration_id"`
+
+	Notification struct {
+		// 通知栏样式 default 1
+		Style int `json:"style"`
+		// 设置在通知栏展示的通知栏标题, 【字数串长度限制在50个字符内，中英文字符及特殊符号（如emoji）均视为一个字符】
+		Title   string `json:"title"`
+		Content string `json:"content"`
+		// 点击通知栏后触发的动作类型。 0.启动应用；1.跳转指定应用内页（action标签名）；2.跳转网页；4.跳转指定应用内页（全路径类名）；【非必填，默认值为0】; 5.跳转Intent scheme URL
+		ClickActionType     int    `json:"click_action_type"`
+		ClickActionActivity string `json:"click_action_activity"`
+		// 是否是离线消息。如果是离线消息，OPPO PUSH在设备离线期间缓存消息一段时间，等待设备上线接收。 default true
+		OffLine bool `json:"off_line"`
+		// 离线消息的存活时间，单位是秒。存活时间最大允许设置为10天，参数超过10天以10天传入。 default 3600
+		OffLineTTL int `json:"off_line_ttl"`
+		// 通知栏通道（NotificationChannel），从Android9开始，Android设备发送通知栏消息必须要指定通道ID，（如果是快应用，必须带置顶的通道Id:OPPO PUSH推送）
+		ChannelID string `json:"channel_id"`
+	} `json:"notification"`
 }
 
-// getToken get token from OPPO server
-func (endpoints *Endpoints) getToken(ctx context.Context) (string, error) {
-	if endpoints.token == nil || time.Now().Add(time.Minute*5).Unix() > endpoints.token.ExpiresIn {
-		if !endpoints.locker.TryLock() {
-			<-time.After(time.Millisecond * 500)
-			return endpoints.getToken(ctx)
-		}
+func newNotice(cfg *Config, payload *push.Payload, registrationID string) *notice {
+	message := &notice{
+		TargetType:           2,
+		TargetValue:          registrationID,
+		VerifyRegistrationID: false,
+	}
 
-		token, err := endpoints.GetTokenEndpoint(ctx, nil)
-		if err != nil {
-			endpoints.locker.Unlock()
-			return "", fmt.Errorf("failed get token: %v", err)
-		}
-		endpoints.token = &Token{
-			AccessToken: token.(string),
-			// default token expires in 24 hours
-			ExpiresIn: time.Now().Unix() + 60*60*24,
+	message.Notification.Title = payload.Title
+	message.Notification.Content = payload.Content
+	message.Notification.Style = 1
+	message.Notification.ClickActionType = 0
+	message.Notification.OffLine = true
+	message.Notification.OffLineTTL = 60 * 60 * 24 * 10
+	message.Notification.ChannelID = cfg.ChannelID
+	return message
+}
+
+// result codes of the push api.
+// more info: https://open.oppomobile.com/new/developmentDoc/info?id=11241
+const (
+	codeSuccess               = 0
+	codeServiceUnavailable    = -1
+	codeFlowControl           = -2
+	codeInvalidAuthToken      = 11
+	codeAppCallLimited        = 13
+	codeIPCallLimited         = 26
+	codeDailyLimitExceeded    = 33
+	codeInvalidRegistrationID = 10000
+)
+
+// codeStatus maps the result codes to the push status of the tokens.
+var codeStatus = map[int]push.Status{
+	codeSuccess:               push.StatusDelivered,
+	codeServiceUnavailable:    push.StatusRetryable,
+	codeFlowControl:           push.StatusRetryable,
+	codeDailyLimitExceeded:    push.StatusQuotaExceeded,
+	codeInvalidRegistrationID: push.StatusRejected,
+}
+
+// codeKinds classifies the failure codes of the api,
+// the codes not listed are permanent.
+var codeKinds = map[int]push.Kind{
+	codeInvalidAuthToken: push.KindTransient,
+	codeAppCallLimited:   push.KindRateLimited,
+	codeIPCallLimited:    push.KindRateLimited,
+}
+
+// classify returns the push failure of the result code.
+func classify(code int, err error) error {
+	if code == codeInvalidAuthToken {
+		err = token.Unauthorized(err)
+	}
+	return &push.Error{
+		Kind: codeKinds[code],
+		Code: strconv.Itoa(code),
+		Err:  err,
+	}
+}
+
+type pushNoticeResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		MessageID      string `json:"messageId"`
+		RegistrationID string `json:"registrationId"`
+	}
+}
+
+// result returns the push result of the registration ids.
+func (r *pushNoticeResponse) result(registrationIDs []string) *push.Result {
+	return push.NewResult(registrationIDs, codeStatus[r.Code], r.Data.MessageID, strconv.Itoa(r.Code), r.Message)
+}
+
+type pushNoticeBatchResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    []struct {
+		MessageID      string `json:"messageId"`
+		RegistrationID string `json:"registrationId"`
+		ErrorCode      int    `json:"errorCode"`
+		ErrorMessage   string `json:"errorMessage"`
+	} `json:"data"`
+}
+
+// result returns the push result of the registration ids.
+func (r *pushNoticeBatchResponse) result(registrationIDs []string) *push.Result {
+	if r.Code != codeSuccess {
+		return push.NewResult(registrationIDs, codeStatus[r.Code], "", strconv.Itoa(r.Code), r.Message)
+	}
+
+	result := push.NewResult(registrationIDs, push.StatusDelivered, "", strconv.Itoa(r.Code), r.Message)
+	for i := range result.Tokens {
+		token := &result.Tokens[i]
+		for _, data := range r.Data {
+			if data.RegistrationID != token.Token {
+				continue
+			}
+
+			status, ok := codeStatus[data.ErrorCode]
+			if !ok {
+				status = push.StatusFailed
+			}
+			token.Status = status
+			token.MessageID = data.MessageID
+			token.Code = strconv.Itoa(data.ErrorCode)
+			token.Reason = data.ErrorMessage
 		}
-		endpoints.locker.Unlock()
 	}
-	return endpoints.token.AccessToken, nil
+	return result
+}
+
+// tokenLifetime is the lifetime of the auth token since it is created.
+const tokenLifetime = 24 * time.Hour
+
+// fetchToken fetches the auth token from the OPPO server.
+func (endpoints *Endpoints) fetchToken(ctx context.Context) (*token.Token, error) {
+	resp, err := endpoints.GetTokenEndpoint(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed get token: %w", err)
+	}
+	return resp.(*token.Token), nil
 }
 
 func (endpoints *Endpoints) sign(ctx context.Context, cfg *Config, timestamp int64) string {
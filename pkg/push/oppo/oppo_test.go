@@ -0,0 +1,101 @@
+package oppo
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want push.Status
+		code string
+	}{
+		{"success", `{"code":0,"message":"Success","data":{"messageId":"message","registrationId":"a"}}`, push.StatusDelivered, "0"},
+		{"service unavailable", `{"code":-1,"message":"Service Currently Unavailable"}`, push.StatusRetryable, "-1"},
+		{"daily limit exceeded", `{"code":33,"message":"The number of messages exceeds the daily limit"}`, push.StatusQuotaExceeded, "33"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(pushNoticeResponse)
+			if err := json.Unmarshal([]byte(tt.data), resp); err != nil {
+				t.Fatal(err)
+			}
+			token := resp.result([]string{"a"}).Tokens[0]
+			if token.Status != tt.want || token.Code != tt.code {
+				t.Errorf("result = %+v, want %v with code %s", token, tt.want, tt.code)
+			}
+			if tt.want == push.StatusDelivered && token.MessageID != "message" {
+				t.Errorf("message id = %q, want message", token.MessageID)
+			}
+		})
+	}
+}
+
+func TestBatchResult(t *testing.T) {
+	resp := new(pushNoticeBatchResponse)
+	data := `{"code":0,"message":"Success","data":[
+		{"messageId":"m1","registrationId":"a","errorCode":0},
+		{"messageId":"m2","registrationId":"b","errorCode":-1,"errorMessage":"Service Currently Unavailable"},
+		{"messageId":"m3","registrationId":"c","errorCode":11,"errorMessage":"Invalid Signature"}
+	]}`
+	if err := json.Unmarshal([]byte(data), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		status    push.Status
+		messageID string
+		code      string
+	}{
+		{push.StatusDelivered, "m1", "0"},
+		{push.StatusRetryable, "m2", "-1"},
+		// the codes not mapped fail the registration id
+		{push.StatusFailed, "m3", "11"},
+	}
+	result := resp.result([]string{"a", "b", "c"})
+	for i, token := range result.Tokens {
+		if token.Status != want[i].status || token.MessageID != want[i].messageID || token.Code != want[i].code {
+			t.Errorf("result = %+v, want %+v", token, want[i])
+		}
+	}
+
+	// the failed batch fails all the registration ids
+	resp = new(pushNoticeBatchResponse)
+	if err := json.Unmarshal([]byte(`{"code":33,"message":"The number of messages exceeds the daily limit"}`), resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range resp.result([]string{"a", "b"}).Tokens {
+		if token.Status != push.StatusQuotaExceeded {
+			t.Errorf("result = %+v, want quota exceeded", token)
+		}
+	}
+}
+
+func TestResultRejected(t *testing.T) {
+	resp := new(pushNoticeResponse)
+	if err := json.Unmarshal([]byte(`{"code":10000,"message":"Invalid RegistrationId"}`), resp); err != nil {
+		t.Fatal(err)
+	}
+	if token := resp.result([]string{"a"}).Tokens[0]; token.Status != push.StatusRejected {
+		t.Errorf("result = %+v, want rejected", token)
+	}
+
+	batch := new(pushNoticeBatchResponse)
+	data := `{"code":0,"message":"Success","data":[
+		{"messageId":"m1","registrationId":"a","errorCode":0},
+		{"registrationId":"b","errorCode":10000,"errorMessage":"Invalid RegistrationId"}
+	]}`
+	if err := json.Unmarshal([]byte(data), batch); err != nil {
+		t.Fatal(err)
+	}
+	want := []push.Status{push.StatusDelivered, push.StatusRejected}
+	for i, token := range batch.result([]string{"a", "b"}).Tokens {
+		if token.Status != want[i] {
+			t.Errorf("result = %+v, want %v", token, want[i])
+		}
+	}
+}
@@ -5,14 +5,24 @@ import (
 	"fmt"
 
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
 )
 
 type OPPO struct {
 	endpoints *Endpoints
 }
 
-func New(conf *Config) (push.Push, error) {
-	endpoints, err := newEndpoints(context.Background(), conf)
+func init() {
+	provider.Register("oppo", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(conf *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), conf, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed create OPPO endpoints: %v", err)
 	}
@@ -21,11 +31,37 @@ func New(conf *Config) (push.Push, error) {
 	}, nil
 }
 
-func (p *OPPO) PushNotice(ctx context.Context, message *push.Message) error {
-	_, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+// Check fetches the access token of OPPO.
+func (p *OPPO) Check(ctx context.Context) error {
+	_, err := p.endpoints.tokens.Get(ctx)
 	return err
 }
 
+// maxBatchSize is the max number of messages in a unicast batch request.
+const maxBatchSize = 1000
+
+func (p *OPPO) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, p.pushNotice)
+}
+
+// pushNotice pushes the message with the unicast api if there is only
+// one registration id, otherwise with the unicast batch api.
+func (p *OPPO) pushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	if len(message.DeviceTokens) == 1 {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	}
+
+	resp, err := p.endpoints.PushNoticeBatchEndpoint(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pushNoticeBatchResponse).result(message.DeviceTokens), nil
+}
+
 type Config struct {
 	AppKey       string `yaml:"app_key"`
 	MasterSecret string `yaml:"master_secret"`
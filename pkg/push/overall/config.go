@@ -4,26 +4,151 @@ import (
 	"fmt"
 
 	"github.com/eachchat/yiqia-push/pkg/config"
-	"github.com/eachchat/yiqia-push/pkg/push/getui"
-	"github.com/eachchat/yiqia-push/pkg/push/huawei"
-	"github.com/eachchat/yiqia-push/pkg/push/oppo"
-	"github.com/eachchat/yiqia-push/pkg/push/vivo"
-	"github.com/eachchat/yiqia-push/pkg/push/xiaomi"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/retry"
+	"github.com/eachchat/yiqia-push/pkg/push/route"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	GETUI  *getui.Config  `json:"getui"`
-	HUAWEI *huawei.Config `json:"huawei"`
-	OPPO   *oppo.Config   `json:"oppo"`
-	XIAOMI *xiaomi.Config `json:"xiaomi"`
-	VIVO   *vivo.Config   `json:"vivo"`
+	// Providers are the named provider instances.
+	Providers []*Instance `yaml:"providers"`
+
+	// Retry retries the transient failures of the push clients,
+	// disabled if it is not configured.
+	Retry *retry.Config `yaml:"retry"`
+
+	// TokenStore shares the vendor access tokens among the replicas,
+	// the tokens are kept in memory if it is not configured.
+	TokenStore *token.Config `yaml:"token_store"`
+
+	// Routes route the devices to the provider instances by the pushers,
+	// they are matched before the app ids of the instances.
+	Routes *route.Config `yaml:"routes"`
 }
 
 // Validate validates the push config
 func (c *Config) Validate() error {
+	names := make(map[string]struct{}, len(c.Providers))
+	appIDs := make(map[string]string)
+	for i, instance := range c.Providers {
+		err := instance.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid provider %d: %v", i, err)
+		}
+
+		if _, ok := names[instance.Name]; ok {
+			return fmt.Errorf("duplicate provider name: %s", instance.Name)
+		}
+		names[instance.Name] = struct{}{}
+
+		for _, appID := range instance.AppIDs {
+			if name, ok := appIDs[appID]; ok {
+				return fmt.Errorf("app id %s served by both %s and %s", appID, name, instance.Name)
+			}
+			appIDs[appID] = instance.Name
+		}
+	}
+
 	err := config.ValidateConfig[config.Config](c)
 	if err != nil {
 		return fmt.Errorf("failed validate push config: %v", err)
 	}
+
+	if c.Routes != nil {
+		for i, rule := range c.Routes.Rules {
+			if _, ok := names[rule.Provider]; rule.Action == route.ActionPush && !ok {
+				return fmt.Errorf("unknown provider %s of rule %d", rule.Provider, i)
+			}
+		}
+		if _, ok := names[c.Routes.Fallback]; c.Routes.Fallback != "" && !ok {
+			return fmt.Errorf("unknown fallback provider %s", c.Routes.Fallback)
+		}
+	}
+	return nil
+}
+
+// Instance is a named instance of a registered provider. The vendor config
+// is decoded inline with the instance fields.
+type Instance struct {
+	// Name is the name of the instance, the push client is selected by it.
+	Name string `yaml:"name"`
+
+	// Type is the name of the registered provider.
+	// Default: Name
+	Type string `yaml:"type"`
+
+	// AppIDs are the pusher app ids served by the instance, so that the
+	// apps of the same vendor are pushed with their own credentials.
+	AppIDs []string `yaml:"app_ids"`
+
+	// Breaker fails fast when the vendor keeps failing,
+	// disabled if it is not configured.
+	Breaker *breaker.Config `yaml:"breaker"`
+
+	// RateLimit respects the QPS and the daily quota of the vendor,
+	// disabled if it is not configured.
+	RateLimit *limit.Config `yaml:"rate_limit"`
+
+	// Retry overrides the retry of the pusher for the instance,
+	// the retry of the pusher is used if it is not configured.
+	Retry *retry.Config `yaml:"retry"`
+
+	// Config is the vendor config of the provider.
+	Config provider.Config `yaml:"-"`
+}
+
+func (i *Instance) UnmarshalYAML(node *yaml.Node) error {
+	type plain Instance
+	err := node.Decode((*plain)(i))
+	if err != nil {
+		return err
+	}
+	if i.Type == "" {
+		i.Type = i.Name
+	}
+
+	p, err := provider.Lookup(i.Type)
+	if err != nil {
+		return fmt.Errorf("failed decode provider %s: %v", i.Name, err)
+	}
+
+	i.Config, err = p.Decode(node.Decode)
+	if err != nil {
+		return fmt.Errorf("failed decode provider %s: %v", i.Name, err)
+	}
+	return nil
+}
+
+func (i *Instance) Validate() error {
+	if i.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if i.Config == nil {
+		return fmt.Errorf("config of %s is missing", i.Name)
+	}
+
+	err := i.Config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid %s config: %v", i.Name, err)
+	}
+	if i.Breaker != nil {
+		if err := i.Breaker.Validate(); err != nil {
+			return fmt.Errorf("invalid breaker config: %v", err)
+		}
+	}
+	if i.RateLimit != nil {
+		if err := i.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("invalid rate limit config: %v", err)
+		}
+	}
+	if i.Retry != nil {
+		if err := i.Retry.Validate(); err != nil {
+			return fmt.Errorf("invalid retry config: %v", err)
+		}
+	}
 	return nil
 }
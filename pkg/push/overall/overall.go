@@ -2,60 +2,103 @@ package overall
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/eachchat/yiqia-push/pkg/metrics"
 	"github.com/eachchat/yiqia-push/pkg/push"
-	"github.com/eachchat/yiqia-push/pkg/push/getui"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/retry"
+	"github.com/eachchat/yiqia-push/pkg/push/route"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
+	"github.com/go-kit/log"
 )
 
 type OverAll struct {
-	set map[string]push.Push
+	set      map[string]push.Push
+	checkers map[string]push.Checker
+	// forwarders are the instances forwarding the Matrix notification
+	forwarders map[string]bool
+	// vendors maps the instances to their provider types
+	vendors map[string]string
+	// appIDs maps the pusher app ids to the provider instances
+	appIDs map[string]string
+	rules  *route.Config
 }
 
-func New(cfg *Config) (*OverAll, error) {
-	set := make(map[string]push.Push)
-	if cfg.GETUI != nil {
-		p, err := getui.New(cfg.GETUI)
-		if err != nil {
-			return nil, err
-		}
-		set["GETUI"] = p
+func New(cfg *Config, logger log.Logger) (*OverAll, error) {
+	o := &OverAll{
+		set:        make(map[string]push.Push),
+		checkers:   make(map[string]push.Checker),
+		forwarders: make(map[string]bool),
+		vendors:    make(map[string]string),
+		appIDs:     make(map[string]string),
+		rules:      cfg.Routes,
 	}
 
-	if cfg.HUAWEI != nil {
-		p, err := getui.New(cfg.GETUI)
+	var store token.TokenStore
+	if cfg.TokenStore != nil {
+		var err error
+		store, err = token.NewStore(cfg.TokenStore)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed create token store: %v", err)
 		}
-		set["huawei"] = p
 	}
 
-	if cfg.OPPO != nil {
-		p, err := getui.New(cfg.GETUI)
+	retries := make(map[string]*retry.Config, len(cfg.Providers))
+	rateLimits := make(map[string]*limit.Config, len(cfg.Providers))
+	for _, instance := range cfg.Providers {
+		p, err := provider.Lookup(instance.Type)
 		if err != nil {
 			return nil, err
 		}
-		set["oppo"] = p
-	}
 
-	if cfg.XIAOMI != nil {
-		p, err := getui.New(cfg.GETUI)
+		client, err := p.Factory(instance.Config, &provider.Options{
+			Name:       instance.Name,
+			Logger:     log.With(logger, "provider", instance.Name),
+			Breaker:    instance.Breaker,
+			RateLimit:  instance.RateLimit,
+			TokenStore: store,
+		})
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed create provider %s: %v", instance.Name, err)
+		}
+		o.add(instance.Name, client)
+		o.vendors[instance.Name] = instance.Type
+		rateLimits[instance.Name] = instance.RateLimit
+		retries[instance.Name] = cfg.Retry
+		if instance.Retry != nil {
+			retries[instance.Name] = instance.Retry
+		}
+		for _, appID := range instance.AppIDs {
+			o.appIDs[appID] = instance.Name
 		}
-		set["xiaomi"] = p
 	}
 
-	if cfg.VIVO != nil {
-		p, err := getui.New(cfg.GETUI)
-		if err != nil {
-			return nil, err
+	for name, p := range o.set {
+		if retries[name] != nil {
+			p = retry.Middleware(retries[name])(p)
 		}
-		set["vivo"] = p
+		// the daily quota is taken once per message, not by every retry
+		if rateLimits[name] != nil {
+			p = limit.Middleware(rateLimits[name])(p)
+		}
+		// the final status of the tokens is counted after the retries
+		o.set[name] = metrics.Middleware(o.vendors[name], name)(p)
 	}
 
-	return &OverAll{
-		set: set,
-	}, nil
+	return o, nil
+}
+
+// add adds the push client of the name.
+func (o *OverAll) add(name string, p push.Push) {
+	if checker, ok := p.(push.Checker); ok {
+		o.checkers[name] = checker
+	}
+	if forwarder, ok := p.(push.Forwarder); ok {
+		o.forwarders[name] = forwarder.Forwards()
+	}
+	o.set[name] = p
 }
 
 func (o *OverAll) GetPushClient(name string) (push.Push, error) {
@@ -65,3 +108,46 @@ func (o *OverAll) GetPushClient(name string) (push.Push, error) {
 	}
 	return p, nil
 }
+
+// Route returns the name of the provider instance pushing the devices of the
+// pusher. The routing rules are matched first, then the instance listing the
+// app id, then the instance named by the app id android_<name>, and at last
+// the fallback instance. It returns false if the devices are dropped by a rule
+// or no instance serves them.
+func (o *OverAll) Route(appID string, data map[string]interface{}) (string, bool) {
+	if o.rules != nil {
+		if rule, ok := o.rules.Match(appID, data); ok {
+			return rule.Provider, rule.Action == route.ActionPush
+		}
+	}
+
+	if name, ok := o.appIDs[appID]; ok {
+		return name, true
+	}
+
+	name := strings.TrimPrefix(appID, "android_")
+	if _, ok := o.set[name]; ok && name != appID {
+		return name, true
+	}
+
+	if o.rules != nil && o.rules.Fallback != "" {
+		return o.rules.Fallback, true
+	}
+	return "", false
+}
+
+// Forwards reports whether the instance of the name forwards the Matrix
+// notification to the devices.
+func (o *OverAll) Forwards(name string) bool {
+	return o.forwarders[name]
+}
+
+// Vendor returns the provider type of the instance of the name, e.g. huawei.
+func (o *OverAll) Vendor(name string) string {
+	return o.vendors[name]
+}
+
+// Checkers returns the push clients which can check their credentials, by name.
+func (o *OverAll) Checkers() map[string]push.Checker {
+	return o.checkers
+}
@@ -0,0 +1,211 @@
+package overall
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeConfig is the config of the fake provider
+type fakeConfig struct {
+	// Fail is the number of the pushes failing transiently at first
+	Fail int `yaml:"fail"`
+}
+
+func (c *fakeConfig) Validate() error {
+	return nil
+}
+
+// fake records the pushed tokens of the instances
+type fake struct {
+	cfg *fakeConfig
+
+	locker sync.Mutex
+	calls  int
+	pushed []string
+}
+
+var (
+	fakesLocker sync.Mutex
+	fakes       = make(map[string]*fake)
+)
+
+func init() {
+	provider.Register("fake", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(fakeConfig)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		f := &fake{cfg: cfg.(*fakeConfig)}
+		fakesLocker.Lock()
+		fakes[opts.Name] = f
+		fakesLocker.Unlock()
+		return f, nil
+	})
+}
+
+func (f *fake) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	f.calls++
+	if f.calls <= f.cfg.Fail {
+		return push.NewResult(message.DeviceTokens, push.StatusRetryable, "", "500", "server error"), nil
+	}
+	f.pushed = append(f.pushed, message.DeviceTokens...)
+	return push.NewResult(message.DeviceTokens, push.StatusDelivered, "", "", ""), nil
+}
+
+func newOverAll(t *testing.T, config string) *OverAll {
+	t.Helper()
+	cfg := new(Config)
+	if err := yaml.Unmarshal([]byte(config), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	o, err := New(cfg, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestQuotaTakenOncePerMessage(t *testing.T) {
+	o := newOverAll(t, `
+providers:
+  - name: quota
+    type: fake
+    fail: 2
+    rate_limit:
+      daily_quota: 2
+retry:
+  initial_backoff: 1ms
+  max_backoff: 1ms
+`)
+	p, err := o.GetPushClient("quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the retries of the message do not take the quota again
+	result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: []string{"a"}, Payload: &push.Payload{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Filter(push.StatusDelivered); len(got) != 1 {
+		t.Fatalf("first message: %+v, want delivered after the retries", result.Tokens)
+	}
+
+	result, err = p.PushNotice(context.Background(), &push.Message{DeviceTokens: []string{"b", "c"}, Payload: &push.Payload{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != 1 || len(result.Filter(push.StatusQuotaExceeded)) != 1 {
+		t.Errorf("second message: %+v, want 1 delivered and 1 quota exceeded", result.Tokens)
+	}
+}
+
+func TestInstanceRetryOverride(t *testing.T) {
+	o := newOverAll(t, `
+providers:
+  - name: default-retry
+    type: fake
+    fail: 1
+  - name: own-retry
+    type: fake
+    fail: 1
+    retry:
+      initial_backoff: 1ms
+      max_backoff: 1ms
+`)
+
+	tests := []struct {
+		name string
+		want push.Status
+	}{
+		// the pusher has no retry
+		{"default-retry", push.StatusRetryable},
+		{"own-retry", push.StatusDelivered},
+	}
+	for _, tt := range tests {
+		p, err := o.GetPushClient(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := p.PushNotice(context.Background(), &push.Message{DeviceTokens: []string{"a"}, Payload: &push.Payload{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.Tokens[0].Status; got != tt.want {
+			t.Errorf("%s: status = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	o := newOverAll(t, `
+providers:
+  - name: listed
+    type: fake
+    app_ids: [com.example.listed, com.example.ruled]
+  - name: ruled
+    type: fake
+  - name: named
+    type: fake
+  - name: fallback
+    type: fake
+routes:
+  rules:
+    - app_id: com.example.ruled
+      provider: ruled
+    - app_id: com.example.dropped
+      action: drop
+  fallback: fallback
+`)
+
+	tests := []struct {
+		appID string
+		want  string
+		ok    bool
+	}{
+		// the rules are matched before the listed app ids
+		{"com.example.ruled", "ruled", true},
+		{"com.example.dropped", "", false},
+		{"com.example.listed", "listed", true},
+		{"android_named", "named", true},
+		{"named", "fallback", true},
+		{"com.example.unknown", "fallback", true},
+	}
+	for _, tt := range tests {
+		name, ok := o.Route(tt.appID, nil)
+		if name != tt.want || ok != tt.ok {
+			t.Errorf("Route(%q) = %q, %v, want %q, %v", tt.appID, name, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestVendor(t *testing.T) {
+	o := newOverAll(t, `
+providers:
+  - name: fake_a
+    type: fake
+  - name: fake_b
+    type: fake
+`)
+
+	// the instances of a type share the workers of the vendor
+	for _, name := range []string{"fake_a", "fake_b"} {
+		if got := o.Vendor(name); got != "fake" {
+			t.Errorf("Vendor(%q) = %q, want fake", name, got)
+		}
+	}
+	if got := o.Vendor("unknown"); got != "" {
+		t.Errorf("Vendor(unknown) = %q, want empty", got)
+	}
+}
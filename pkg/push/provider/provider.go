@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
+	"github.com/go-kit/log"
+)
+
+// Config is the vendor config of a provider instance
+type Config interface {
+	Validate() error
+}
+
+// Options are the options of a provider instance shared by all the vendors
+type Options struct {
+	// Name is the name of the provider instance.
+	Name   string
+	Logger log.Logger
+
+	// Breaker fails fast when the vendor keeps failing,
+	// disabled if it is nil.
+	Breaker *breaker.Config
+	// RateLimit respects the QPS of the vendor, disabled if it is nil.
+	// The daily quota is enforced out of the provider.
+	RateLimit *limit.Config
+	// TokenStore shares the access token with the other replicas,
+	// the token is kept in memory if it is nil.
+	TokenStore token.TokenStore
+}
+
+// Decoder decodes the vendor config with unmarshal, which decodes the config
+// of the provider instance into the given value.
+type Decoder func(unmarshal func(interface{}) error) (Config, error)
+
+// Factory creates the push client of the vendor config.
+type Factory func(cfg Config, opts *Options) (push.Push, error)
+
+// Provider is a push vendor registered under its canonical name
+type Provider struct {
+	Name    string
+	Decode  Decoder
+	Factory Factory
+}
+
+var (
+	locker    sync.Mutex
+	providers = make(map[string]*Provider)
+)
+
+// Register registers the provider of the name, it is called in the init
+// function of the provider package. It panics if the name is registered twice.
+func Register(name string, decode Decoder, factory Factory) {
+	locker.Lock()
+	defer locker.Unlock()
+
+	if _, ok := providers[name]; ok {
+		panic(fmt.Sprintf("provider %s registered twice", name))
+	}
+	providers[name] = &Provider{
+		Name:    name,
+		Decode:  decode,
+		Factory: factory,
+	}
+}
+
+// Lookup returns the provider of the name.
+func Lookup(name string) (*Provider, error) {
+	locker.Lock()
+	defer locker.Unlock()
+
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s", name)
+	}
+	return p, nil
+}
+
+// Names returns the names of the registered providers, sorted.
+func Names() []string {
+	locker.Lock()
+	defer locker.Unlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
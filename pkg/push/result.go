@@ -0,0 +1,111 @@
+package push
+
+// Status is the push status of a device token
+type Status int
+
+const (
+	// StatusDelivered means the vendor accepted the message for the token
+	StatusDelivered Status = iota
+	// StatusRejected means the token is invalid or unregistered,
+	// the homeserver should remove its pusher
+	StatusRejected
+	// StatusRetryable means the push failed temporarily and may be retried
+	StatusRetryable
+	// StatusQuotaExceeded means the vendor quota of the app is exhausted
+	StatusQuotaExceeded
+	// StatusFailed means the push failed and should not be retried
+	StatusFailed
+	// StatusSuppressed means the notification is not sent on purpose, e.g.
+	// it is folded into the next email of the recipient
+	StatusSuppressed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusDelivered:
+		return "delivered"
+	case StatusRejected:
+		return "rejected"
+	case StatusRetryable:
+		return "retryable"
+	case StatusQuotaExceeded:
+		return "quota_exceeded"
+	case StatusFailed:
+		return "failed"
+	case StatusSuppressed:
+		return "suppressed"
+	}
+	return "unknown"
+}
+
+// TokenResult is the push result of a device token
+type TokenResult struct {
+	Token  string
+	Status Status
+	// MessageID is the message id or task id returned by the vendor
+	MessageID string
+	// Code is the raw result code returned by the vendor
+	Code string
+	// Reason is the description of the result returned by the vendor
+	Reason string
+}
+
+// Result is the push result of a message
+type Result struct {
+	Tokens []TokenResult
+}
+
+// NewResult returns a result with the same status for all the tokens.
+func NewResult(tokens []string, status Status, messageID string, code string, reason string) *Result {
+	result := &Result{
+		Tokens: make([]TokenResult, 0, len(tokens)),
+	}
+	for _, token := range tokens {
+		result.Tokens = append(result.Tokens, TokenResult{
+			Token:     token,
+			Status:    status,
+			MessageID: messageID,
+			Code:      code,
+			Reason:    reason,
+		})
+	}
+	return result
+}
+
+// SetStatus sets the status of the given tokens.
+func (r *Result) SetStatus(tokens []string, status Status) {
+	set := make(map[string]struct{}, len(tokens))
+	for _, token := range tokens {
+		set[token] = struct{}{}
+	}
+
+	for i := range r.Tokens {
+		if _, ok := set[r.Tokens[i].Token]; ok {
+			r.Tokens[i].Status = status
+		}
+	}
+}
+
+// Merge appends the token results of other to r.
+func (r *Result) Merge(other *Result) {
+	if other == nil {
+		return
+	}
+	r.Tokens = append(r.Tokens, other.Tokens...)
+}
+
+// Filter returns the tokens with the given status.
+func (r *Result) Filter(status Status) []string {
+	tokens := make([]string, 0)
+	for _, t := range r.Tokens {
+		if t.Status == status {
+			tokens = append(tokens, t.Token)
+		}
+	}
+	return tokens
+}
+
+// Rejected returns the tokens rejected by the vendor.
+func (r *Result) Rejected() []string {
+	return r.Filter(StatusRejected)
+}
@@ -0,0 +1,145 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+type Config struct {
+	// Deadline is the max duration to push a message, including the retries.
+	// Default: 30s
+	Deadline time.Duration `yaml:"deadline"`
+
+	// InitialBackoff is the backoff before the first retry, it doubles
+	// after every retry.
+	// Default: 500ms
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+
+	// RateLimitedBackoff is the backoff before the first retry
+	// of the rate limited failures.
+	// Default: 2s
+	RateLimitedBackoff time.Duration `yaml:"rate_limited_backoff"`
+
+	// MaxBackoff is the max backoff between the retries.
+	// Default: 10s
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (c *Config) Validate() error {
+	if c.Deadline == 0 {
+		c.Deadline = 30 * time.Second
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = 500 * time.Millisecond
+	}
+	if c.RateLimitedBackoff == 0 {
+		c.RateLimitedBackoff = 2 * time.Second
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 10 * time.Second
+	}
+	if c.Deadline < 0 || c.InitialBackoff < 0 || c.RateLimitedBackoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("durations must be positive")
+	}
+	return nil
+}
+
+// Middleware returns a middleware which retries the tokens failed with
+// transient or rate limited failures, with jittered exponential backoff.
+func Middleware(cfg *Config) push.Middleware {
+	return func(next push.Push) push.Push {
+		return &retry{
+			cfg:  cfg,
+			next: next,
+		}
+	}
+}
+
+type retry struct {
+	cfg  *Config
+	next push.Push
+}
+
+// PushNotice pushes the message until there is no retryable token or the
+// deadline is reached. The tokens still retryable are reported as is.
+func (r *retry) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Deadline)
+	defer cancel()
+
+	results := make(map[string]push.TokenResult, len(message.DeviceTokens))
+	pending := message
+	for attempt := 0; ; attempt++ {
+		kind := push.KindTransient
+		result, err := r.next.PushNotice(ctx, pending)
+		if err != nil {
+			kind = push.KindOf(err)
+			if attempt == 0 && kind == push.KindPermanent {
+				return nil, err
+			}
+			result = push.FailedResult(pending.DeviceTokens, err)
+		}
+
+		for _, token := range result.Tokens {
+			results[token.Token] = token
+		}
+
+		retryable := result.Filter(push.StatusRetryable)
+		if len(retryable) == 0 || !wait(ctx, r.backoff(attempt, kind)) {
+			break
+		}
+
+		next := *pending
+		next.DeviceTokens = retryable
+		pending = &next
+	}
+
+	result := &push.Result{
+		Tokens: make([]push.TokenResult, 0, len(message.DeviceTokens)),
+	}
+	for _, token := range message.DeviceTokens {
+		if t, ok := results[token]; ok {
+			result.Tokens = append(result.Tokens, t)
+		}
+	}
+	return result, nil
+}
+
+// backoff returns the jittered backoff before the next retry.
+func (r *retry) backoff(attempt int, kind push.Kind) time.Duration {
+	backoff := r.cfg.InitialBackoff
+	if kind == push.KindRateLimited {
+		backoff = r.cfg.RateLimitedBackoff
+	}
+
+	for i := 0; i < attempt && backoff < r.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.cfg.MaxBackoff {
+		backoff = r.cfg.MaxBackoff
+	}
+
+	// equal jitter: half of the backoff is random
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// wait sleeps for d, it returns false if the deadline is reached before.
+func wait(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+// pushFunc adapts a function to push.Push
+type pushFunc func(ctx context.Context, message *push.Message) (*push.Result, error)
+
+func (f pushFunc) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return f(ctx, message)
+}
+
+func newConfig(deadline time.Duration) *Config {
+	cfg := &Config{
+		Deadline:           deadline,
+		InitialBackoff:     time.Millisecond,
+		RateLimitedBackoff: 2 * time.Millisecond,
+		MaxBackoff:         4 * time.Millisecond,
+	}
+	_ = cfg.Validate()
+	return cfg
+}
+
+func newMessage(tokens ...string) *push.Message {
+	return &push.Message{DeviceTokens: tokens, Payload: &push.Payload{}}
+}
+
+func statuses(result *push.Result) map[string]push.Status {
+	m := make(map[string]push.Status, len(result.Tokens))
+	for _, token := range result.Tokens {
+		m[token.Token] = token.Status
+	}
+	return m
+}
+
+func TestRetryRetryableTokens(t *testing.T) {
+	attempts := make([][]string, 0)
+	next := pushFunc(func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		attempts = append(attempts, message.DeviceTokens)
+		result := push.NewResult(message.DeviceTokens, push.StatusDelivered, "", "", "")
+		if len(attempts) == 1 {
+			result.SetStatus([]string{"b"}, push.StatusRetryable)
+			result.SetStatus([]string{"c"}, push.StatusRejected)
+		}
+		return result, nil
+	})
+
+	result, err := Middleware(newConfig(time.Second))(next).PushNotice(context.Background(), newMessage("a", "b", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := [][]string{{"a", "b", "c"}, {"b"}}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("attempts = %v, want %v", attempts, want)
+	}
+	want := map[string]push.Status{"a": push.StatusDelivered, "b": push.StatusDelivered, "c": push.StatusRejected}
+	if got := statuses(result); !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	// the order of the tokens is kept
+	if result.Tokens[0].Token != "a" || result.Tokens[2].Token != "c" {
+		t.Errorf("tokens out of order: %+v", result.Tokens)
+	}
+}
+
+func TestRetryPermanentShortCircuit(t *testing.T) {
+	calls := 0
+	permanent := push.Permanent("400", errors.New("bad request"))
+	next := pushFunc(func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		calls++
+		return nil, permanent
+	})
+
+	_, err := Middleware(newConfig(time.Second))(next).PushNotice(context.Background(), newMessage("a"))
+	if !errors.Is(err, permanent) {
+		t.Errorf("err = %v, want %v", err, permanent)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestRetryErrorUntilDeadline(t *testing.T) {
+	calls := 0
+	next := pushFunc(func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		calls++
+		return nil, push.Transient("500", errors.New("server error"))
+	})
+
+	start := time.Now()
+	result, err := Middleware(newConfig(50*time.Millisecond))(next).PushNotice(context.Background(), newMessage("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("elapsed %v, want within the deadline", elapsed)
+	}
+	if calls < 2 {
+		t.Errorf("calls = %d, want retries", calls)
+	}
+	// the tokens still retryable after the deadline are reported as is
+	if got := statuses(result)["a"]; got != push.StatusRetryable {
+		t.Errorf("status = %v, want retryable", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := &retry{cfg: &Config{
+		InitialBackoff:     100 * time.Millisecond,
+		RateLimitedBackoff: time.Second,
+		MaxBackoff:         2 * time.Second,
+	}}
+	tests := []struct {
+		attempt int
+		kind    push.Kind
+		max     time.Duration
+	}{
+		{0, push.KindTransient, 100 * time.Millisecond},
+		{1, push.KindTransient, 200 * time.Millisecond},
+		{3, push.KindTransient, 800 * time.Millisecond},
+		{10, push.KindTransient, 2 * time.Second},
+		{0, push.KindRateLimited, time.Second},
+		{1, push.KindRateLimited, 2 * time.Second},
+		{5, push.KindRateLimited, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			// equal jitter: between the half and the full backoff
+			got := r.backoff(tt.attempt, tt.kind)
+			if got < tt.max/2 || got > tt.max {
+				t.Errorf("backoff(%d, %v) = %v, want in [%v, %v]", tt.attempt, tt.kind, got, tt.max/2, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestWaitStopsBeforeDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if wait(ctx, time.Second) {
+		t.Error("wait() = true, want false past the deadline")
+	}
+	if !wait(context.Background(), time.Millisecond) {
+		t.Error("wait() = false, want true without deadline")
+	}
+}
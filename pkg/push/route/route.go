@@ -0,0 +1,138 @@
+package route
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// match types of the app id
+const (
+	MatchExact = "exact"
+	MatchGlob  = "glob"
+	MatchRegex = "regex"
+)
+
+// actions of the rules
+const (
+	ActionPush = "push"
+	ActionDrop = "drop"
+)
+
+type Config struct {
+	// Rules are matched in order, the first matching rule routes the device.
+	Rules []*Rule `yaml:"rules"`
+
+	// Fallback is the provider instance of the devices matching no rule,
+	// the devices are not pushed if it is empty.
+	Fallback string `yaml:"fallback"`
+}
+
+func (c *Config) Validate() error {
+	for i, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("invalid rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Rule routes the devices of the matching pushers to a provider instance
+type Rule struct {
+	// AppID matches the pusher app id, the rule matches any app id if it
+	// is empty.
+	AppID string `yaml:"app_id"`
+
+	// Match is how the app id matches: exact, glob or regex. The regex
+	// matches the whole app id.
+	// Default: exact
+	Match string `yaml:"match"`
+
+	// Data matches the fields of the pusher data, the values are compared
+	// as strings.
+	Data map[string]string `yaml:"data"`
+
+	// Action is the action of the matching devices: push or drop.
+	// Default: push
+	Action string `yaml:"action"`
+
+	// Provider is the name of the provider instance pushing the devices,
+	// it is required by the push action.
+	Provider string `yaml:"provider"`
+
+	regex *regexp.Regexp
+}
+
+func (r *Rule) Validate() error {
+	if r.Match == "" {
+		r.Match = MatchExact
+	}
+	if r.Action == "" {
+		r.Action = ActionPush
+	}
+
+	switch r.Match {
+	case MatchExact:
+	case MatchGlob:
+		if _, err := path.Match(r.AppID, ""); err != nil {
+			return fmt.Errorf("invalid glob %s: %v", r.AppID, err)
+		}
+	case MatchRegex:
+		regex, err := regexp.Compile("^(?:" + r.AppID + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid regex %s: %v", r.AppID, err)
+		}
+		r.regex = regex
+	default:
+		return fmt.Errorf("unknown match: %s", r.Match)
+	}
+
+	switch r.Action {
+	case ActionPush:
+		if r.Provider == "" {
+			return fmt.Errorf("provider is required")
+		}
+	case ActionDrop:
+	default:
+		return fmt.Errorf("unknown action: %s", r.Action)
+	}
+	return nil
+}
+
+// Matches reports whether the rule matches the pusher.
+func (r *Rule) Matches(appID string, data map[string]interface{}) bool {
+	if r.AppID != "" {
+		switch r.Match {
+		case MatchExact:
+			if appID != r.AppID {
+				return false
+			}
+		case MatchGlob:
+			if ok, _ := path.Match(r.AppID, appID); !ok {
+				return false
+			}
+		case MatchRegex:
+			if !r.regex.MatchString(appID) {
+				return false
+			}
+		}
+	}
+
+	for key, expected := range r.Data {
+		value, ok := data[key]
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns the first rule matching the pusher.
+func (c *Config) Match(appID string, data map[string]interface{}) (*Rule, bool) {
+	for _, rule := range c.Rules {
+		if rule.Matches(appID, data) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
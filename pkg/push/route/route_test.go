@@ -0,0 +1,106 @@
+package route
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func newConfig(t *testing.T, config string) *Config {
+	t.Helper()
+	cfg := new(Config)
+	if err := yaml.Unmarshal([]byte(config), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestMatch(t *testing.T) {
+	cfg := newConfig(t, `
+rules:
+  - app_id: com.example.blocked
+    action: drop
+  - app_id: com.example.ios
+    data:
+      platform: ios
+      sandbox: "true"
+    provider: apns-sandbox
+  - app_id: com.example.ios
+    provider: apns
+  - app_id: com.example.*.android
+    match: glob
+    provider: fcm
+  - app_id: com\.tenant[0-9]+
+    match: regex
+    provider: huawei
+  - data:
+      vendor: xiaomi
+    provider: xiaomi
+`)
+
+	tests := []struct {
+		name     string
+		appID    string
+		data     map[string]interface{}
+		provider string
+		drop     bool
+		matched  bool
+	}{
+		{"exact", "com.example.ios", nil, "apns", false, true},
+		{"exact prefix", "com.example.ios.beta", nil, "", false, false},
+		{"data before app id", "com.example.ios", map[string]interface{}{"platform": "ios", "sandbox": true}, "apns-sandbox", false, true},
+		{"partial data", "com.example.ios", map[string]interface{}{"platform": "ios"}, "apns", false, true},
+		{"drop", "com.example.blocked", map[string]interface{}{"vendor": "xiaomi"}, "", true, true},
+		{"glob", "com.example.beta.android", nil, "fcm", false, true},
+		{"glob separator", "com.example.a/b.android", nil, "", false, false},
+		{"regex", "com.tenant42", nil, "huawei", false, true},
+		{"regex whole app id", "com.tenant42.ios", nil, "", false, false},
+		{"regex escaped dot", "comxtenant42", nil, "", false, false},
+		{"any app id", "org.other", map[string]interface{}{"vendor": "xiaomi"}, "xiaomi", false, true},
+		{"no match", "org.other", map[string]interface{}{"vendor": "oppo"}, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := cfg.Match(tt.appID, tt.data)
+			if ok != tt.matched {
+				t.Fatalf("Match() matched = %v, want %v", ok, tt.matched)
+			}
+			if !ok {
+				return
+			}
+			if drop := rule.Action == ActionDrop; drop != tt.drop {
+				t.Errorf("drop = %v, want %v", drop, tt.drop)
+			}
+			if rule.Provider != tt.provider {
+				t.Errorf("provider = %q, want %q", rule.Provider, tt.provider)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{"defaults", Rule{AppID: "com.example", Provider: "apns"}, false},
+		{"drop without provider", Rule{AppID: "com.example", Action: ActionDrop}, false},
+		{"push without provider", Rule{AppID: "com.example"}, true},
+		{"invalid glob", Rule{AppID: "com.[", Match: MatchGlob, Provider: "apns"}, true},
+		{"invalid regex", Rule{AppID: "com.(", Match: MatchRegex, Provider: "apns"}, true},
+		{"unknown match", Rule{AppID: "com.example", Match: "prefix", Provider: "apns"}, true},
+		{"unknown action", Rule{AppID: "com.example", Action: "forward", Provider: "apns"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileStore keeps the tokens in a directory, one file per key. The tokens
+// are shared by the replicas mounting the same directory.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed create token directory: %v", err)
+	}
+	return &FileStore{
+		dir: dir,
+	}, nil
+}
+
+// path returns the path of the file of the key with the extension.
+func (s *FileStore) path(key string, ext string) string {
+	return filepath.Join(s.dir, url.QueryEscape(key)+ext)
+}
+
+func (s *FileStore) Load(ctx context.Context, key string) (*Token, error) {
+	data, err := os.ReadFile(s.path(key, ".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed read token file: %v", err)
+	}
+
+	token := new(Token)
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed decode token file: %v", err)
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, nil
+	}
+	return token, nil
+}
+
+// Save writes the token to a temporary file and renames it, so that the
+// readers never see a partial token.
+func (s *FileStore) Save(ctx context.Context, key string, token *Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed encode token: %v", err)
+	}
+
+	fd, err := os.CreateTemp(s.dir, ".token-*")
+	if err != nil {
+		return fmt.Errorf("failed create token file: %v", err)
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write(data)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed write token file: %v", err)
+	}
+
+	err = os.Rename(fd.Name(), s.path(key, ".json"))
+	if err != nil {
+		return fmt.Errorf("failed rename token file: %v", err)
+	}
+	return nil
+}
+
+// Lock creates the lock file of the key exclusively, the lock file records
+// the owner and the expiry. An expired lock file is taken over.
+func (s *FileStore) Lock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	path := s.path(key, ".lock")
+	owner := uuid.New().String()
+	content := fmt.Sprintf("%s %d", owner, time.Now().Add(ttl).UnixNano())
+
+	for attempt := 0; attempt < 2; attempt++ {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = fd.WriteString(content)
+			if closeErr := fd.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return nil, false, fmt.Errorf("failed write lock file: %v", err)
+			}
+
+			return func() {
+				if data, err := os.ReadFile(path); err == nil && string(data) == content {
+					_ = os.Remove(path)
+				}
+			}, true, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, false, fmt.Errorf("failed create lock file: %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed read lock file: %v", err)
+		}
+
+		// the lock is held until it expires, the lock file being written
+		// by the owner is held too
+		if time.Now().Before(lockExpiry(path, data, ttl)) {
+			return nil, false, nil
+		}
+		_ = os.Remove(path)
+	}
+	return nil, false, nil
+}
+
+// lockExpiry returns the expiry recorded in the lock file, or the expiry
+// since the modification time if the lock file is partial.
+func lockExpiry(path string, data []byte, ttl time.Duration) time.Time {
+	fields := strings.Fields(string(data))
+	if len(fields) == 2 {
+		if expiry, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			return time.Unix(0, expiry)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime().Add(ttl)
+}
@@ -0,0 +1,220 @@
+package token
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// redisTimeout is the max duration of a redis command.
+const redisTimeout = 5 * time.Second
+
+// errNil is the nil reply of redis.
+var errNil = errors.New("redis: nil")
+
+// RedisStore keeps the tokens in redis, the tokens are shared by the
+// replicas connecting to the same redis. It speaks the RESP protocol with
+// GET, SET and DEL only, so that any redis compatible server works.
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+
+	locker sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisStore(addr string, password string, db int, prefix string) *RedisStore {
+	return &RedisStore{
+		addr:     addr,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+	}
+}
+
+func (s *RedisStore) Load(ctx context.Context, key string) (*Token, error) {
+	reply, err := s.do(ctx, "GET", s.prefix+key)
+	if errors.Is(err, errNil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed get token: %v", err)
+	}
+
+	token := new(Token)
+	err = json.Unmarshal([]byte(reply), token)
+	if err != nil {
+		return nil, fmt.Errorf("failed decode token: %v", err)
+	}
+	return token, nil
+}
+
+// Save sets the token which expires with the token itself.
+func (s *RedisStore) Save(ctx context.Context, key string, token *Token) error {
+	ttl := time.Until(token.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed encode token: %v", err)
+	}
+
+	_, err = s.do(ctx, "SET", s.prefix+key, string(data), "PX", strconv.FormatInt(ttl, 10))
+	if err != nil {
+		return fmt.Errorf("failed set token: %v", err)
+	}
+	return nil
+}
+
+// Lock sets the lock key only if it does not exist. The lock is released
+// only by its owner, the check and the delete are not atomic, but the lock
+// expires anyway.
+func (s *RedisStore) Lock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	lockKey := s.prefix + key + ":lock"
+	owner := uuid.New().String()
+
+	_, err := s.do(ctx, "SET", lockKey, owner, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if errors.Is(err, errNil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed set lock: %v", err)
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+
+		if value, err := s.do(ctx, "GET", lockKey); err == nil && value == owner {
+			_, _ = s.do(ctx, "DEL", lockKey)
+		}
+	}, true, nil
+}
+
+// do sends the command and returns the simple or bulk string reply.
+// The connection is dropped on any failure and dialed again next time.
+func (s *RedisStore) do(ctx context.Context, args ...string) (string, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	reply, err := s.command(ctx, args...)
+	var redisErr redisError
+	if err != nil && !errors.Is(err, errNil) && !errors.As(err, &redisErr) {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+// dial connects the redis server, authenticates and selects the db.
+func (s *RedisStore) dial(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed dial redis: %v", err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if s.password != "" {
+		_, err = s.command(ctx, "AUTH", s.password)
+	}
+	if err == nil && s.db != 0 {
+		_, err = s.command(ctx, "SELECT", strconv.Itoa(s.db))
+	}
+	if err != nil {
+		_ = conn.Close()
+		s.conn = nil
+		return fmt.Errorf("failed init redis connection: %v", err)
+	}
+	return nil
+}
+
+// command writes the command as a RESP array and reads the reply.
+func (s *RedisStore) command(ctx context.Context, args ...string) (string, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = s.conn.SetDeadline(deadline)
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := s.conn.Write(buf)
+	if err != nil {
+		return "", err
+	}
+	return readReply(s.reader)
+}
+
+// redisError is the error reply of redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply reads a simple string, error, integer or bulk string reply.
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: invalid reply: %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("redis: invalid bulk length: %q", line)
+		}
+		if n < 0 {
+			return "", errNil
+		}
+
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	}
+	return "", fmt.Errorf("redis: unexpected reply: %q", line)
+}
@@ -0,0 +1,223 @@
+package token
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves GET, SET and DEL on the server end of a pipe, it records
+// the raw requests.
+type fakeRedis struct {
+	values   map[string]string
+	requests chan string
+}
+
+// newPipeStore returns a redis store connected to the fake redis.
+func newPipeStore(t *testing.T) (*RedisStore, *fakeRedis) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	f := &fakeRedis{values: make(map[string]string), requests: make(chan string, 16)}
+	go f.serve(server)
+
+	s := NewRedisStore("", "", 0, "test:")
+	s.conn = client
+	s.reader = bufio.NewReader(client)
+	return s, f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		args, raw, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.requests <- raw
+
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			value, ok := f.values[args[1]]
+			if !ok {
+				reply = "$-1\r\n"
+				break
+			}
+			reply = "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+		case "SET":
+			if _, ok := f.values[args[1]]; ok && len(args) > 3 && args[3] == "NX" {
+				reply = "$-1\r\n"
+				break
+			}
+			f.values[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case "DEL":
+			delete(f.values, args[1])
+			reply = ":1\r\n"
+		default:
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, string, error) {
+	var raw strings.Builder
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	raw.WriteString(line)
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, "", err
+		}
+		raw.WriteString(line)
+		size, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return nil, "", err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, "", err
+		}
+		raw.Write(data)
+		args = append(args, string(data[:size]))
+	}
+	return args, raw.String(), nil
+}
+
+func TestRedisCommandEncoding(t *testing.T) {
+	s, f := newPipeStore(t)
+
+	if _, err := s.do(context.Background(), "SET", "key", "a b\r\nc", "PX", "1000"); err != nil {
+		t.Fatal(err)
+	}
+	want := "*5\r\n$3\r\nSET\r\n$3\r\nkey\r\n$6\r\na b\r\nc\r\n$2\r\nPX\r\n$4\r\n1000\r\n"
+	if got := <-f.requests; got != want {
+		t.Errorf("request = %q, want %q", got, want)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    string
+		wantErr error
+	}{
+		{"simple", "+OK\r\n", "OK", nil},
+		{"integer", ":42\r\n", "42", nil},
+		{"bulk", "$5\r\nhello\r\n", "hello", nil},
+		{"bulk with crlf", "$4\r\na\r\nb\r\n", "a\r\nb", nil},
+		{"empty bulk", "$0\r\n\r\n", "", nil},
+		{"nil", "$-1\r\n", "", errNil},
+		{"error", "-ERR wrong type\r\n", "", redisError("ERR wrong type")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readReply(bufio.NewReader(strings.NewReader(tt.reply)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readReply() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readReply() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadReplyInvalid(t *testing.T) {
+	replies := []string{
+		"OK\n",
+		"+OK\n",
+		"$abc\r\n",
+		"$5\r\nhel",
+		"*1\r\n$2\r\nOK\r\n",
+	}
+	for _, reply := range replies {
+		if _, err := readReply(bufio.NewReader(strings.NewReader(reply))); err == nil {
+			t.Errorf("readReply(%q) = nil error, want an error", reply)
+		}
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	s, f := newPipeStore(t)
+	ctx := context.Background()
+
+	token, err := s.Load(ctx, "key")
+	if err != nil || token != nil {
+		t.Fatalf("Load() of missing key = %+v, %v, want nil", token, err)
+	}
+
+	saved := &Token{Value: "token", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+	if err := s.Save(ctx, "key", saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.values["test:key"]; !ok {
+		t.Errorf("values = %v, want the prefixed key", f.values)
+	}
+	token, err = s.Load(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Value != saved.Value || !token.ExpiresAt.Equal(saved.ExpiresAt) {
+		t.Errorf("Load() = %+v, want %+v", token, saved)
+	}
+
+	// the expired token is not saved
+	if err := s.Save(ctx, "expired", &Token{Value: "token", ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.values["test:expired"]; ok {
+		t.Error("expired token saved")
+	}
+
+	// the lock is held by one owner only
+	unlock, ok, err := s.Lock(ctx, "key", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Lock() = %v, %v, want acquired", ok, err)
+	}
+	if _, ok, err := s.Lock(ctx, "key", time.Minute); err != nil || ok {
+		t.Errorf("Lock() while held = %v, %v, want not acquired", ok, err)
+	}
+	unlock()
+	if _, ok := f.values["test:key:lock"]; ok {
+		t.Error("lock not released")
+	}
+}
+
+func TestRedisErrorKeepsConnection(t *testing.T) {
+	s, _ := newPipeStore(t)
+
+	_, err := s.do(context.Background(), "INCR", "key")
+	var redisErr redisError
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("do() error = %v, want a redis error", err)
+	}
+	if s.conn == nil {
+		t.Error("connection dropped on the error reply")
+	}
+}
@@ -0,0 +1,140 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TokenStore keeps the access tokens, it may be shared by the replicas of
+// the gateway so that only one of them authenticates with the vendor.
+type TokenStore interface {
+	// Load returns the token of the key, or nil if there is none.
+	Load(ctx context.Context, key string) (*Token, error)
+
+	// Save saves the token of the key until it expires.
+	Save(ctx context.Context, key string, token *Token) error
+
+	// Lock acquires the refresh lock of the key for ttl. It reports false
+	// without waiting if the lock is held by another owner. The returned
+	// unlock function releases the lock if it is still held.
+	Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(), ok bool, err error)
+}
+
+// store types
+const (
+	StoreMemory = "memory"
+	StoreFile   = "file"
+	StoreRedis  = "redis"
+)
+
+type Config struct {
+	// Type is the type of the store: memory, file or redis.
+	// Default: memory
+	Type string `yaml:"type"`
+
+	// Path is the directory of the file store, it should be shared by
+	// the replicas, e.g. a mounted volume.
+	Path string `yaml:"path"`
+
+	// Addr is the address of the redis server.
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+
+	// Prefix is the prefix of the redis keys.
+	// Default: yiqia-push:token:
+	Prefix string `yaml:"prefix"`
+}
+
+func (c *Config) Validate() error {
+	if c.Type == "" {
+		c.Type = StoreMemory
+	}
+	if c.Prefix == "" {
+		c.Prefix = "yiqia-push:token:"
+	}
+
+	switch c.Type {
+	case StoreMemory:
+	case StoreFile:
+		if c.Path == "" {
+			return fmt.Errorf("path is required")
+		}
+	case StoreRedis:
+		if c.Addr == "" {
+			return fmt.Errorf("addr is required")
+		}
+	default:
+		return fmt.Errorf("unknown store type: %s", c.Type)
+	}
+	return nil
+}
+
+// NewStore returns the token store of the config.
+func NewStore(cfg *Config) (TokenStore, error) {
+	switch cfg.Type {
+	case StoreFile:
+		return NewFileStore(cfg.Path)
+	case StoreRedis:
+		return NewRedisStore(cfg.Addr, cfg.Password, cfg.DB, cfg.Prefix), nil
+	}
+	return NewMemoryStore(), nil
+}
+
+// MemoryStore keeps the tokens in memory, the tokens are not shared.
+type MemoryStore struct {
+	locker sync.Mutex
+	tokens map[string]*Token
+	locks  map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens: make(map[string]*Token),
+		locks:  make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryStore) Load(ctx context.Context, key string) (*Token, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	token, ok := s.tokens[key]
+	if !ok || time.Now().After(token.ExpiresAt) {
+		return nil, nil
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *MemoryStore) Save(ctx context.Context, key string, token *Token) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	copied := *token
+	s.tokens[key] = &copied
+	return nil
+}
+
+func (s *MemoryStore) Lock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	now := time.Now()
+	if expiry, ok := s.locks[key]; ok && now.Before(expiry) {
+		return nil, false, nil
+	}
+
+	expiry := now.Add(ttl)
+	s.locks[key] = expiry
+	return func() {
+		s.locker.Lock()
+		defer s.locker.Unlock()
+
+		if s.locks[key].Equal(expiry) {
+			delete(s.locks, key)
+		}
+	}, true, nil
+}
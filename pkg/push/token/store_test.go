@@ -0,0 +1,170 @@
+package token
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	token, err := s.Load(ctx, "huawei:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != nil {
+		t.Errorf("Load() before Save = %+v, want nil", token)
+	}
+
+	saved := &Token{
+		Value:     "token",
+		ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second),
+		FetchedAt: time.Now().Truncate(time.Second),
+	}
+	if err := s.Save(ctx, "huawei:app", saved); err != nil {
+		t.Fatal(err)
+	}
+	token, err = s.Load(ctx, "huawei:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Value != saved.Value || !token.ExpiresAt.Equal(saved.ExpiresAt) || !token.FetchedAt.Equal(saved.FetchedAt) {
+		t.Errorf("Load() = %+v, want %+v", token, saved)
+	}
+
+	// no temporary file is left behind
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files = %d, want 1", len(entries))
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	file, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]TokenStore{
+		"memory": NewMemoryStore(),
+		"file":   file,
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			expired := &Token{Value: "expired", ExpiresAt: time.Now().Add(-time.Second)}
+			if err := s.Save(ctx, "key", expired); err != nil {
+				t.Fatal(err)
+			}
+			token, err := s.Load(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != nil {
+				t.Errorf("Load() = %+v, want nil for the expired token", token)
+			}
+		})
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	file, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]TokenStore{
+		"memory": NewMemoryStore(),
+		"file":   file,
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			unlock, ok, err := s.Lock(ctx, "key", time.Minute)
+			if err != nil || !ok {
+				t.Fatalf("Lock() = %v, %v, want acquired", ok, err)
+			}
+			if _, ok, err := s.Lock(ctx, "key", time.Minute); err != nil || ok {
+				t.Errorf("Lock() while held = %v, %v, want not acquired", ok, err)
+			}
+			if _, ok, err := s.Lock(ctx, "other", time.Minute); err != nil || !ok {
+				t.Errorf("Lock() of another key = %v, %v, want acquired", ok, err)
+			}
+
+			unlock()
+			unlock, ok, err = s.Lock(ctx, "key", time.Minute)
+			if err != nil || !ok {
+				t.Fatalf("Lock() after unlock = %v, %v, want acquired", ok, err)
+			}
+			unlock()
+		})
+	}
+}
+
+func TestStoreLockExpiry(t *testing.T) {
+	file, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]TokenStore{
+		"memory": NewMemoryStore(),
+		"file":   file,
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			stale, ok, err := s.Lock(ctx, "key", 10*time.Millisecond)
+			if err != nil || !ok {
+				t.Fatalf("Lock() = %v, %v, want acquired", ok, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+
+			// the expired lock is taken over
+			unlock, ok, err := s.Lock(ctx, "key", time.Minute)
+			if err != nil || !ok {
+				t.Fatalf("Lock() after expiry = %v, %v, want acquired", ok, err)
+			}
+			// the stale owner does not release the lock of the new owner
+			stale()
+			if _, ok, err := s.Lock(ctx, "key", time.Minute); err != nil || ok {
+				t.Errorf("Lock() after the stale unlock = %v, %v, want not acquired", ok, err)
+			}
+			unlock()
+		})
+	}
+}
+
+func TestFileStorePartialLock(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a lock file being written by its owner is held until the ttl since
+	// its modification
+	if err := os.WriteFile(s.path("key", ".lock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.Lock(context.Background(), "key", time.Minute); err != nil || ok {
+		t.Errorf("Lock() = %v, %v, want not acquired", ok, err)
+	}
+
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(s.path("key", ".lock"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlock, ok, err := s.Lock(context.Background(), "key", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("Lock() of the stale partial lock = %v, %v, want acquired", ok, err)
+	}
+	unlock()
+}
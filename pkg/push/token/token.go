@@ -0,0 +1,320 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/log"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// expiryMargin is the margin before the expiry, within which the token
+	// is not used any more.
+	expiryMargin = 30 * time.Second
+	// renewBefore is the max duration before the expiry to renew the token
+	// in the background, at most half of the token lifetime.
+	renewBefore = 5 * time.Minute
+	// retryInterval is the interval to retry the failed background renewal.
+	retryInterval = 10 * time.Second
+	// fetchTimeout is the max duration to fetch a token from the vendor,
+	// it is also the ttl of the refresh lock.
+	fetchTimeout = 30 * time.Second
+	// lockPollInterval is the interval to check the store for the token
+	// while the refresh lock is held by another replica.
+	lockPollInterval = 200 * time.Millisecond
+)
+
+// ErrUnauthorized is wrapped by the failures of the vendor requests
+// rejected because of an invalid or expired access token.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Unauthorized wraps err as a failure caused by the access token.
+func Unauthorized(err error) error {
+	return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+}
+
+// Token is an access token of a vendor
+type Token struct {
+	Value string `json:"value"`
+	// ExpiresAt is the expiry returned by the vendor
+	ExpiresAt time.Time `json:"expires_at"`
+	// FetchedAt is the time when the token was fetched
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// valid reports whether the token is usable at now.
+func (t *Token) valid(now time.Time) bool {
+	return t != nil && now.Before(t.ExpiresAt.Add(-expiryMargin))
+}
+
+// renewAt returns the time to renew the token in the background.
+func (t *Token) renewAt() time.Time {
+	before := t.ExpiresAt.Sub(t.FetchedAt) / 2
+	if before > renewBefore {
+		before = renewBefore
+	}
+	return t.ExpiresAt.Add(-before)
+}
+
+// Fetcher fetches a new access token from the vendor.
+type Fetcher func(ctx context.Context) (*Token, error)
+
+// Manager caches the access token of a vendor. The concurrent refreshes are
+// merged into one vendor request, and the token is renewed in the background
+// before it expires. The token is shared with the other replicas through
+// the store, only the replica holding the refresh lock fetches a new one.
+type Manager struct {
+	key    string
+	fetch  Fetcher
+	store  TokenStore
+	logger log.Logger
+
+	group singleflight.Group
+
+	locker  sync.Mutex
+	token   *Token
+	invalid string
+	updated chan struct{}
+}
+
+// New returns the manager of the token of the key, the key identifies the
+// credentials in the store. The token is not shared if store is nil.
+func New(key string, fetch Fetcher, store TokenStore, logger log.Logger) *Manager {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Manager{
+		key:     key,
+		fetch:   fetch,
+		store:   store,
+		logger:  log.With(logger, "token", key),
+		updated: make(chan struct{}, 1),
+	}
+}
+
+// Start renews the token in the background until ctx is done.
+func (m *Manager) Start(ctx context.Context) {
+	go m.renew(ctx)
+}
+
+// Get returns the cached token, a new token is fetched if the cached one is
+// missing or about to expire. It stops waiting for the fetch when ctx is done.
+func (m *Manager) Get(ctx context.Context) (string, error) {
+	m.locker.Lock()
+	token := m.token
+	m.locker.Unlock()
+	if token.valid(time.Now()) {
+		return token.Value, nil
+	}
+
+	token, err := m.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	return token.Value, nil
+}
+
+// Invalidate drops the cached token if it is the given one, so that the
+// next Get fetches a new token.
+func (m *Manager) Invalidate(value string) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	m.invalid = value
+	if m.token != nil && m.token.Value == value {
+		level.Warn(m.logger).Log("msg", "invalidate access token")
+		m.token = nil
+	}
+}
+
+// fresh reports whether the token is usable and not to be renewed yet.
+func (m *Manager) fresh(token *Token) bool {
+	m.locker.Lock()
+	invalid := m.invalid
+	m.locker.Unlock()
+
+	now := time.Now()
+	return token.valid(now) && token.Value != invalid && now.Before(token.renewAt())
+}
+
+// refresh fetches a new token, the concurrent calls share the same fetch.
+func (m *Manager) refresh(ctx context.Context) (*Token, error) {
+	ch := m.group.DoChan("", func() (interface{}, error) {
+		// the fetch is shared, it is not canceled with the caller
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*fetchTimeout)
+		defer cancel()
+
+		token, err := m.obtain(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		m.locker.Lock()
+		m.token = token
+		m.locker.Unlock()
+
+		select {
+		case m.updated <- struct{}{}:
+		default:
+		}
+		return token, nil
+	})
+
+	select {
+	case result := <-ch:
+		if result.Err != nil {
+			return nil, fmt.Errorf("failed fetch %s token: %w", m.key, result.Err)
+		}
+		return result.Val.(*Token), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// obtain returns the fresh token in the store, or fetches a new one while
+// holding the refresh lock. It waits for the token to be saved while the
+// lock is held by another replica. The token is fetched without the lock
+// if the store is unavailable.
+func (m *Manager) obtain(ctx context.Context) (*Token, error) {
+	for {
+		token, err := m.store.Load(ctx, m.key)
+		if err != nil {
+			level.Warn(m.logger).Log("msg", "fail load access token", "err", err)
+			return m.fetchAndSave(ctx, nil)
+		}
+		if m.fresh(token) {
+			return token, nil
+		}
+
+		unlock, ok, err := m.store.Lock(ctx, m.key, fetchTimeout)
+		if err != nil {
+			level.Warn(m.logger).Log("msg", "fail lock access token", "err", err)
+			return m.fetchAndSave(ctx, token)
+		}
+		if ok {
+			defer unlock()
+
+			// the token may be saved just before the lock is acquired
+			token, err := m.store.Load(ctx, m.key)
+			if err == nil && m.fresh(token) {
+				return token, nil
+			}
+			return m.fetchAndSave(ctx, token)
+		}
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fetchAndSave fetches a new token from the vendor and saves it to the store.
+// The stored token is used if the fetch fails while it is still valid.
+func (m *Manager) fetchAndSave(ctx context.Context, stored *Token) (*Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	token, err := m.fetch(ctx)
+	if err != nil {
+		m.locker.Lock()
+		invalid := m.invalid
+		m.locker.Unlock()
+
+		if stored.valid(time.Now()) && stored.Value != invalid {
+			level.Warn(m.logger).Log("msg", "fail fetch access token, use the stored one", "err", err)
+			return stored, nil
+		}
+		return nil, err
+	}
+	if token.FetchedAt.IsZero() {
+		token.FetchedAt = time.Now()
+	}
+
+	err = m.store.Save(ctx, m.key, token)
+	if err != nil {
+		level.Warn(m.logger).Log("msg", "fail save access token", "err", err)
+	}
+	return token, nil
+}
+
+// renew refreshes the token before it expires. Nothing is renewed until the
+// first token is fetched on demand.
+func (m *Manager) renew(ctx context.Context) {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-m.updated:
+		case <-timer:
+			if _, err := m.refresh(ctx); err != nil {
+				level.Error(m.logger).Log("msg", "fail renew access token", "err", err)
+				timer = time.After(retryInterval)
+				continue
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		m.locker.Lock()
+		token := m.token
+		m.locker.Unlock()
+
+		timer = nil
+		if token != nil {
+			wait := time.Until(token.renewAt())
+			if wait < retryInterval {
+				wait = retryInterval
+			}
+			timer = time.After(wait)
+		}
+	}
+}
+
+// Middleware returns an endpoint middleware which gets the token before the
+// request, the request encoder reads it with FromContext. When the request
+// fails with ErrUnauthorized, the token is invalidated and the request is
+// sent once more with a new token.
+func (m *Manager) Middleware() endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			var (
+				response interface{}
+				err      error
+			)
+			for attempt := 0; attempt < 2; attempt++ {
+				var value string
+				value, err = m.Get(ctx)
+				if err != nil {
+					return nil, err
+				}
+
+				response, err = next(NewContext(ctx, value), request)
+				if !errors.Is(err, ErrUnauthorized) {
+					return response, err
+				}
+				m.Invalidate(value)
+			}
+			return response, err
+		}
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the access token.
+func NewContext(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, contextKey{}, value)
+}
+
+// FromContext returns the access token carried by ctx.
+func FromContext(ctx context.Context) (string, bool) {
+	value, ok := ctx.Value(contextKey{}).(string)
+	return value, ok
+}
@@ -0,0 +1,91 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/log"
+)
+
+func TestManagerGetKeepsFetchErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind push.Kind
+	}{
+		{"transient", push.Transient("500", errors.New("server error")), push.KindTransient},
+		{"rate limited", push.RateLimited("429", errors.New("too many requests")), push.KindRateLimited},
+		{"permanent", push.Permanent("400", errors.New("bad request")), push.KindPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New("test", func(ctx context.Context) (*Token, error) {
+				return nil, tt.err
+			}, nil, log.NewNopLogger())
+
+			_, err := m.Get(context.Background())
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if kind := push.KindOf(err); kind != tt.kind {
+				t.Errorf("KindOf() = %v, want %v", kind, tt.kind)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error %v does not wrap %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestManagerGetCachesToken(t *testing.T) {
+	fetched := 0
+	m := New("test", func(ctx context.Context) (*Token, error) {
+		fetched++
+		return &Token{Value: "token", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}, nil, log.NewNopLogger())
+
+	for i := 0; i < 3; i++ {
+		value, err := m.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "token" {
+			t.Errorf("Get() = %q, want %q", value, "token")
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("fetched %d times, want 1", fetched)
+	}
+}
+
+func TestManagerMiddlewareRetriesUnauthorized(t *testing.T) {
+	fetched := 0
+	m := New("test", func(ctx context.Context) (*Token, error) {
+		fetched++
+		return &Token{Value: string(rune('a' + fetched - 1)), ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}, nil, log.NewNopLogger())
+
+	var used []string
+	endpoint := m.Middleware()(func(ctx context.Context, request interface{}) (interface{}, error) {
+		value, _ := FromContext(ctx)
+		used = append(used, value)
+		if value == "a" {
+			return nil, Unauthorized(errors.New("expired"))
+		}
+		return "ok", nil
+	})
+
+	response, err := endpoint(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "ok" {
+		t.Errorf("response = %v, want ok", response)
+	}
+	if len(used) != 2 || used[0] != "a" || used[1] != "b" {
+		t.Errorf("used tokens = %v, want [a b]", used)
+	}
+}
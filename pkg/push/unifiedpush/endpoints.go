@@ -0,0 +1,149 @@
+package unifiedpush
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// eventIDOnlyFields are the fields of the notification in the
+// event_id_only format.
+var eventIDOnlyFields = []string{"event_id", "room_id", "counts", "prio"}
+
+type Endpoints struct {
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, cfg *Config, client *http.Client, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+
+	// the request is sent to the endpoint of the pushkey
+	tgt := &url.URL{Scheme: "https"}
+
+	var endpoints *Endpoints
+	options := []httptransport.ClientOption{
+		httptransport.SetClient(client),
+	}
+
+	endpoints = &Endpoints{
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*push.Message)
+			pushKey := req.DeviceTokens[0]
+
+			var err error
+			r.URL, err = url.Parse(pushKey)
+			if err != nil {
+				return push.Permanent("", fmt.Errorf("invalid endpoint: %v", err))
+			}
+			r.Host = r.URL.Host
+
+			body, err := notification(cfg, req, pushKey)
+			if err != nil {
+				return err
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Type", "application/json")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			defer resp.Body.Close()
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+			body := &pushNoticeResponse{
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			}
+			switch {
+			case resp.StatusCode >= 200 && resp.StatusCode < 300:
+				return body, nil
+			case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+				// the endpoint is unregistered by the distributor
+				return body, nil
+			}
+			return nil, push.HTTPError(resp)
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("unifiedpush", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// notification returns the body forwarded to the endpoint of the pushkey,
+// the notification of the push gateway api with the device of the pushkey.
+// more info: https://spec.matrix.org/latest/push-gateway-api/#post_matrixpushv1notify
+func notification(cfg *Config, message *push.Message, pushKey string) ([]byte, error) {
+	fields := make(map[string]interface{})
+	if len(message.Payload.Notification) > 0 {
+		err := json.Unmarshal(message.Payload.Notification, &fields)
+		if err != nil {
+			return nil, push.Permanent("", fmt.Errorf("failed decode notification: %v", err))
+		}
+	}
+
+	data := message.DeviceData[pushKey]
+	format := cfg.Format
+	if value, ok := data["format"].(string); ok && value != "" {
+		format = value
+	}
+	if format == FormatEventIDOnly {
+		selected := make(map[string]interface{}, len(eventIDOnlyFields))
+		for _, field := range eventIDOnlyFields {
+			if value, ok := fields[field]; ok {
+				selected[field] = value
+			}
+		}
+		fields = selected
+	}
+
+	device := map[string]interface{}{
+		"app_id":  message.AppID,
+		"pushkey": pushKey,
+	}
+	if len(data) > 0 {
+		device["data"] = data
+	}
+	fields["devices"] = []interface{}{device}
+
+	return json.Marshal(map[string]interface{}{
+		"notification": fields,
+	})
+}
+
+type pushNoticeResponse struct {
+	StatusCode int
+	Status     string
+}
+
+// result returns the push result of the pushkeys, the endpoints not found
+// or gone are rejected.
+func (r *pushNoticeResponse) result(pushKeys []string) *push.Result {
+	result := push.NewResult(pushKeys, push.StatusDelivered, "", strconv.Itoa(r.StatusCode), r.Status)
+	if r.StatusCode == http.StatusNotFound || r.StatusCode == http.StatusGone {
+		result.SetStatus(pushKeys, push.StatusRejected)
+	}
+	return result
+}
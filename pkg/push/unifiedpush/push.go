@@ -0,0 +1,142 @@
+package unifiedpush
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type UnifiedPush struct {
+	cfg       *Config
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("unifiedpush", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		// the redirects are not followed, they may lead out of the allowed hosts
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	endpoints, err := newEndpoints(context.Background(), cfg, client, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create UnifiedPush endpoints: %v", err)
+	}
+	return &UnifiedPush{
+		cfg:       cfg,
+		endpoints: endpoints,
+	}, nil
+}
+
+// Forwards reports true, the notification is forwarded to the endpoints.
+func (p *UnifiedPush) Forwards() bool {
+	return true
+}
+
+// the pushkey is the endpoint of the device.
+const maxBatchSize = 1
+
+// codeNotAllowed is the code of the pushkeys of the endpoints not allowed.
+const codeNotAllowed = "endpoint_not_allowed"
+
+// PushNotice forwards the notification to the endpoints of the pushkeys,
+// the pushkeys of the endpoints not allowed fail without a request. They
+// are not rejected, the endpoint may be allowed later.
+func (p *UnifiedPush) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	allowed := make([]string, 0, len(message.DeviceTokens))
+	result := &push.Result{}
+	for _, pushKey := range message.DeviceTokens {
+		if err := push.AllowEndpoint(pushKey, p.cfg.AllowedHosts, p.cfg.AllowHTTP); err != nil {
+			result.Merge(push.NewResult([]string{pushKey}, push.StatusFailed, "", codeNotAllowed, err.Error()))
+			continue
+		}
+		allowed = append(allowed, pushKey)
+	}
+	if len(allowed) == 0 {
+		return result, nil
+	}
+
+	chunk := *message
+	chunk.DeviceTokens = allowed
+	r, err := push.Batch(ctx, &chunk, maxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+	if err != nil && len(result.Tokens) == 0 {
+		return nil, err
+	}
+	if err != nil {
+		r = push.FailedResult(allowed, err)
+	}
+	result.Merge(r)
+	return result, nil
+}
+
+// formats of the forwarded notification
+const (
+	// FormatFull forwards the whole notification
+	FormatFull = "full"
+	// FormatEventIDOnly forwards the event id, the room id, the counts and
+	// the priority only, the pusher data format takes precedence
+	FormatEventIDOnly = "event_id_only"
+)
+
+type Config struct {
+	// AllowedHosts are the hosts of the endpoints allowed to be requested,
+	// e.g. ntfy.sh, or *.example.com for the subdomains of example.com.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+
+	// AllowHTTP allows the http endpoints besides https, e.g. for a local
+	// distributor in testing.
+	AllowHTTP bool `yaml:"allow_http"`
+
+	// Format is the format of the notification: full or event_id_only.
+	// Default: full
+	Format string `yaml:"format"`
+
+	// Timeout is the timeout of a request.
+	// Default: 10s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *Config) Validate() error {
+	if c.Format == "" {
+		c.Format = FormatFull
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	if len(c.AllowedHosts) == 0 {
+		return fmt.Errorf("allowed hosts are required")
+	}
+	for i, host := range c.AllowedHosts {
+		c.AllowedHosts[i] = strings.ToLower(host)
+	}
+	if c.Format != FormatFull && c.Format != FormatEventIDOnly {
+		return fmt.Errorf("unknown format: %s", c.Format)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
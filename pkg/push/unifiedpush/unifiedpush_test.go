@@ -0,0 +1,150 @@
+package unifiedpush
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// newUnifiedPush returns the UnifiedPush client allowing the local endpoints.
+func newUnifiedPush(t *testing.T) push.Push {
+	t.Helper()
+	cfg := &Config{AllowedHosts: []string{"127.0.0.1"}, AllowHTTP: true}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, &provider.Options{Name: "unifiedpush", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newMessage(pushKeys ...string) *push.Message {
+	return &push.Message{
+		AppID:        "im.app",
+		DeviceTokens: pushKeys,
+		Payload: &push.Payload{
+			Notification: json.RawMessage(`{"event_id":"$event","room_id":"!room","counts":{"unread":2}}`),
+		},
+	}
+}
+
+func TestPushNoticeForwarded(t *testing.T) {
+	var body struct {
+		Notification map[string]json.RawMessage `json:"notification"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	pushKey := srv.URL + "/up?token=abc"
+	result, err := newUnifiedPush(t).PushNotice(context.Background(), newMessage(pushKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Tokens[0].Status != push.StatusDelivered {
+		t.Errorf("status = %v, want delivered", result.Tokens[0].Status)
+	}
+
+	if got := string(body.Notification["event_id"]); got != `"$event"` {
+		t.Errorf("event_id = %s, want the notification forwarded", got)
+	}
+	var devices []map[string]interface{}
+	_ = json.Unmarshal(body.Notification["devices"], &devices)
+	if len(devices) != 1 || devices[0]["pushkey"] != pushKey || devices[0]["app_id"] != "im.app" {
+		t.Errorf("devices = %v, want the device of the pushkey", devices)
+	}
+}
+
+func TestPushNoticeStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		want push.Status
+	}{
+		{http.StatusOK, push.StatusDelivered},
+		{http.StatusNotFound, push.StatusRejected},
+		{http.StatusGone, push.StatusRejected},
+		{http.StatusTooManyRequests, push.StatusRetryable},
+		{http.StatusServiceUnavailable, push.StatusRetryable},
+		{http.StatusBadRequest, push.StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			message := newMessage(srv.URL + "/up")
+			result, err := newUnifiedPush(t).PushNotice(context.Background(), message)
+			if err != nil {
+				result = push.FailedResult(message.DeviceTokens, err)
+			}
+			if got := result.Tokens[0].Status; got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushNoticeNotAllowed(t *testing.T) {
+	requested := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer target.Close()
+
+	// the redirect leads to a host not allowed
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(target.URL, "127.0.0.1", "localhost", 1), http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	p := newUnifiedPush(t)
+
+	notAllowed := strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/up"
+	allowed := target.URL + "/up"
+	result, err := p.PushNotice(context.Background(), newMessage(notAllowed, allowed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Tokens) != 2 {
+		t.Fatalf("result = %+v, want both pushkeys", result.Tokens)
+	}
+	for _, token := range result.Tokens {
+		switch token.Token {
+		case notAllowed:
+			// not rejected, the host may be allowed later
+			if token.Status != push.StatusFailed || token.Code != codeNotAllowed {
+				t.Errorf("result = %+v, want failed as not allowed", token)
+			}
+		case allowed:
+			if token.Status != push.StatusDelivered {
+				t.Errorf("result = %+v, want delivered", token)
+			}
+		}
+	}
+	requested = false
+
+	message := newMessage(redirect.URL + "/up")
+	result, err = p.PushNotice(context.Background(), message)
+	if err != nil {
+		result = push.FailedResult(message.DeviceTokens, err)
+	}
+	if result.Tokens[0].Status == push.StatusDelivered {
+		t.Errorf("status = %v, want the redirect not followed", result.Tokens[0].Status)
+	}
+	if requested {
+		t.Error("redirect followed to the host not allowed")
+	}
+}
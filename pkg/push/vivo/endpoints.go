@@ -6,23 +6,23 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/eachchat/yiqia-push/pkg/metrics"
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/token"
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
-)
-
-const (
-	skipAuthKey = "X-Skip-Auth"
+	"github.com/google/uuid"
 )
 
 const (
@@ -30,14 +30,16 @@ const (
 )
 
 type Endpoints struct {
-	locker sync.Mutex
-	token  *Token
+	tokens *token.Manager
 
-	GetTokenEndpoint   endpoint.Endpoint
-	PushNoticeEndpoint endpoint.Endpoint
+	GetTokenEndpoint        endpoint.Endpoint
+	PushNoticeEndpoint      endpoint.Endpoint
+	SaveListPayloadEndpoint endpoint.Endpoint
+	PushToListEndpoint      endpoint.Endpoint
 }
 
-func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
+func newEndpoints(ctx context.Context, cfg *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
 	tgt, err := url.Parse(host)
 	if err != nil {
 		return nil, err
@@ -52,17 +54,9 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 
 	options := []httptransport.ClientOption{
 		httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
-			if r.Header.Get(skipAuthKey) != "" {
-				r.Header.Del(skipAuthKey)
-				return ctx
-			}
-
-			token, err := endpoints.getToken(ctx)
-			if err != nil {
-				fmt.Println(err)
+			if value, ok := token.FromContext(ctx); ok {
+				r.Header.Set("authToken", value)
 			}
-
-			r.Header.Set("authToken", token)
 			return ctx
 		}),
 	}
@@ -81,18 +75,17 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			}
 
 			var buf bytes.Buffer
-			err = json.NewEncoder(&buf).Encode(body)
+			err := json.NewEncoder(&buf).Encode(body)
 			if err != nil {
 				return err
 			}
 
 			r.Body = io.NopCloser(&buf)
 			r.Header.Set("Content-Type", "application/json")
-			r.Header.Add(skipAuthKey, "True")
 			return nil
 		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
 			if resp.StatusCode != http.StatusOK {
-				return nil, errors.New(resp.Status)
+				return nil, push.HTTPError(resp)
 			}
 			defer resp.Body.Close()
 
@@ -108,49 +101,24 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			}
 
 			if body.Result != 0 {
-				return nil, fmt.Errorf("failed decode token: %v", body.Desc)
+				return nil, classify(body.Result, fmt.Errorf("failed decode token: %v", body.Desc))
 			}
-			return body.AuthToken, nil
+			// vivo does not return the expiry, the token expires in 24 hours
+			now := time.Now()
+			return &token.Token{
+				Value:     body.AuthToken,
+				ExpiresAt: now.Add(24 * time.Hour),
+				FetchedAt: now,
+			}, nil
 		}, options...).Endpoint(),
 		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
 			req := request.(*push.Message)
 
-			// more info: https://dev.vivo.com.cn/documentCenter/doc/362#w2-98542835
-			body := struct {
-				AppID           int               `json:"appId"`
-				RegID           string            `json:"regId"`
-				NotifyType      int               `json:"notifyType"`
-				Title           string            `json:"title"`
-				Content         string            `json:"content"`
-				TimeToLive      int               `json:"timeToLive"`
-				SkipType        int               `json:"skipType"`
-				SkipContent     string            `json:"skipContent"`
-				Classification  int               `json:"classification"`
-				NetworkType     string            `json:"networkType"`
-				ClientCustomMap map[string]string `json:"clientCustomMap"`
-				Extra           map[string]string `json:"extra"`
-				RequestID       string            `json:"requestId"`
-				Category        string            `json:"category"`
-			}{
-				AppID: appID,
-				RegID: strings.Join(req.DeviceTokens, ","),
-				// 通知类型 1:无，2:响铃，3:振动，4:响铃和振动
-				NotifyType: 1,
-				// 消息缓存时间，单位是秒。在用户设备没有网络时，消息在Push服务器进行缓存，在消息缓存时间内用户设备重新连接网络，消息会下发，超过缓存时间后消息会丢弃。
-				// 取值至少60秒，最长7天。
-				TimeToLive: 60 * 60 * 24,
-				Title:      req.Payload.Title,
-				Content:    req.Payload.Content,
-				// 点击跳转类型 1：打开APP首页 2：打开链接 3：自定义 4:打开app内指定页面
-				SkipType: 1,
-				// 消息类型 0：运营类消息，1：系统类消息。不填默认为0
-				Classification: 1,
-				RequestID:      req.Payload.BusinessID,
-				Category:       "IM",
-			}
+			body := newNotice(appID, req)
+			body.RegID = strings.Join(req.DeviceTokens, ",")
 
 			var buf bytes.Buffer
-			err = json.NewEncoder(&buf).Encode(body)
+			err := json.NewEncoder(&buf).Encode(body)
 			if err != nil {
 				return err
 			}
@@ -159,57 +127,244 @@ func newEndpoints(ctx context.Context, cfg *Config) (*Endpoints, error) {
 			r.URL.Path = "/message/send"
 			r.Header.Set("Content-Type", "application/json")
 			return nil
+		}, decodePushNoticeResponse, options...).Endpoint(),
+		// more info: https://dev.vivo.com.cn/documentCenter/doc/362#w2-67805227
+		SaveListPayloadEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*push.Message)
+
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(newNotice(appID, req))
+			if err != nil {
+				return err
+			}
+
+			r.Body = io.NopCloser(&buf)
+			r.URL.Path = "/message/saveListPayload"
+			r.Header.Set("Content-Type", "application/json")
+			return nil
+		}, decodePushNoticeResponse, options...).Endpoint(),
+		// more info: https://dev.vivo.com.cn/documentCenter/doc/362#w2-08833929
+		PushToListEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*pushToListRequest)
+
+			body := map[string]interface{}{
+				"regIds":    req.RegIDs,
+				"taskId":    req.TaskID,
+				"requestId": req.RequestID,
+			}
+
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(body)
+			if err != nil {
+				return err
+			}
+
+			r.Body = io.NopCloser(&buf)
+			r.URL.Path = "/message/pushToList"
+			r.Header.Set("Content-Type", "application/json")
+			return nil
 		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
 			if resp.StatusCode != http.StatusOK {
-				return nil, errors.New(resp.Status)
+				return nil, push.HTTPError(resp)
 			}
 			defer resp.Body.Close()
 
-			body := &struct {
-				Result int    `json:"result,omitempty"`
-				Desc   string `json:"desc,omitempty"`
-				TaskID string `json:"taskId,omitempty"`
-			}{}
-
+			body := new(pushToListResponse)
 			err = json.NewDecoder(resp.Body).Decode(body)
 			if err != nil {
 				return nil, fmt.Errorf("failed decode push result: %v", err)
 			}
 
-			if body.Result != 0 {
-				return nil, fmt.Errorf("failed push notice: %s, taskID: %s", body.Desc, body.TaskID)
+			if _, ok := resultStatus[body.Result]; !ok {
+				return nil, classify(body.Result, fmt.Errorf("failed push notice: %s, taskID: %s", body.Desc, body.TaskID))
 			}
 			return body, nil
 		}, options...).Endpoint(),
 	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("vivo", "push")(endpoints.PushNoticeEndpoint)
+	endpoints.SaveListPayloadEndpoint = metrics.EndpointMiddleware("vivo", "save_list_payload")(endpoints.SaveListPayloadEndpoint)
+	endpoints.PushToListEndpoint = metrics.EndpointMiddleware("vivo", "push_to_list")(endpoints.PushToListEndpoint)
+	endpoints.GetTokenEndpoint = metrics.TokenMiddleware("vivo")(endpoints.GetTokenEndpoint)
+
+	endpoints.tokens = token.New("vivo:"+cfg.AppID, endpoints.fetchToken, opts.TokenStore, logger)
+	endpoints.tokens.Start(ctx)
+	endpoints.PushNoticeEndpoint = endpoints.tokens.Middleware()(endpoints.PushNoticeEndpoint)
+	endpoints.SaveListPayloadEndpoint = endpoints.tokens.Middleware()(endpoints.SaveListPayloadEndpoint)
+	endpoints.PushToListEndpoint = endpoints.tokens.Middleware()(endpoints.PushToListEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+		endpoints.SaveListPayloadEndpoint = pushBreaker(endpoints.SaveListPayloadEndpoint)
+		endpoints.PushToListEndpoint = pushBreaker(endpoints.PushToListEndpoint)
+		endpoints.GetTokenEndpoint = breaker.Middleware(opts.Name+".token", opts.Breaker, logger)(endpoints.GetTokenEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+		endpoints.SaveListPayloadEndpoint = limiter(endpoints.SaveListPayloadEndpoint)
+		endpoints.PushToListEndpoint = limiter(endpoints.PushToListEndpoint)
+	}
+
 	return endpoints, nil
 }
 
-type Token struct {
-	AccessToken string
-	ExpiresIn   int64
+// result codes of the push api.
+// more info: https://dev.vivo.com.cn/documentCenter/doc/365
+const (
+	resultSuccess            = 0
+	resultAuthFailed         = 10000
+	resultDailyLimitExceeded = 10070
+	resultInvalidRegID       = 10302
+)
+
+// resultStatus maps the result codes to the push status of the regids.
+var resultStatus = map[int]push.Status{
+	resultSuccess:            push.StatusDelivered,
+	resultDailyLimitExceeded: push.StatusQuotaExceeded,
+	resultInvalidRegID:       push.StatusRejected,
 }
 
-func (endpoints *Endpoints) getToken(ctx context.Context) (string, error) {
-	if endpoints.token == nil || time.Now().Add(time.Minute*5).Unix() > endpoints.token.ExpiresIn {
-		if !endpoints.locker.TryLock() {
-			<-time.After(time.Millisecond * 500)
-			return endpoints.getToken(ctx)
-		}
+// resultKinds classifies the failure codes of the api,
+// the codes not listed are permanent.
+var resultKinds = map[int]push.Kind{
+	resultAuthFailed: push.KindTransient,
+}
 
-		token, err := endpoints.GetTokenEndpoint(ctx, nil)
-		if err != nil {
-			endpoints.locker.Unlock()
-			return "", fmt.Errorf("failed get token: %v", err)
-		}
-		endpoints.token = &Token{
-			AccessToken: token.(string),
-			// default token expires in 24 hours
-			ExpiresIn: time.Now().Unix() + 60*60*24,
+// classify returns the push failure of the result code.
+func classify(result int, err error) error {
+	if result == resultAuthFailed {
+		err = token.Unauthorized(err)
+	}
+	return &push.Error{
+		Kind: resultKinds[result],
+		Code: strconv.Itoa(result),
+		Err:  err,
+	}
+}
+
+type pushNoticeResponse struct {
+	Result int    `json:"result,omitempty"`
+	Desc   string `json:"desc,omitempty"`
+	TaskID string `json:"taskId,omitempty"`
+}
+
+// result returns the push result of the regids.
+func (r *pushNoticeResponse) result(regIDs []string) *push.Result {
+	return push.NewResult(regIDs, resultStatus[r.Result], r.TaskID, strconv.Itoa(r.Result), r.Desc)
+}
+
+type pushToListRequest struct {
+	RegIDs    []string
+	TaskID    string
+	RequestID string
+}
+
+type pushToListResponse struct {
+	pushNoticeResponse
+	InvalidUsers []struct {
+		// 1: regId not exist, 2: app uninstalled or push closed,
+		// 3: offline for a long time, 4: not a test user
+		Status int    `json:"status"`
+		UserID string `json:"userid"`
+	} `json:"invalidUsers,omitempty"`
+}
+
+// invalidUserNotExist is the status of the invalid user whose regId does not exist.
+const invalidUserNotExist = 1
+
+// result returns the push result of the regids.
+func (r *pushToListResponse) result(regIDs []string) *push.Result {
+	result := r.pushNoticeResponse.result(regIDs)
+	for _, user := range r.InvalidUsers {
+		status := push.StatusFailed
+		if user.Status == invalidUserNotExist {
+			status = push.StatusRejected
 		}
-		endpoints.locker.Unlock()
+		result.SetStatus([]string{user.UserID}, status)
+	}
+	return result
+}
+
+func decodePushNoticeResponse(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, push.HTTPError(resp)
+	}
+	defer resp.Body.Close()
+
+	body := new(pushNoticeResponse)
+	err = json.NewDecoder(resp.Body).Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed decode push result: %v", err)
+	}
+
+	if _, ok := resultStatus[body.Result]; !ok {
+		return nil, classify(body.Result, fmt.Errorf("failed push notice: %s, taskID: %s", body.Desc, body.TaskID))
+	}
+	return body, nil
+}
+
+// notice is the message body of the push api.
+// more info: https://dev.vivo.com.cn/documentCenter/doc/362#w2-98542835
+type notice struct {
+	AppID           int               `json:"appId"`
+	RegID           string            `json:"regId,omitempty"`
+	NotifyType      int               `json:"notifyType"`
+	Title           string            `json:"title"`
+	Content         string            `json:"content"`
+	TimeToLive      int               `json:"timeToLive"`
+	SkipType        int               `json:"skipType"`
+	SkipContent     string            `json:"skipContent"`
+	Classification  int               `json:"classification"`
+	NetworkType     string            `json:"networkType"`
+	ClientCustomMap map[string]string `json:"clientCustomMap"`
+	Extra           map[string]string `json:"extra"`
+	RequestID       string            `json:"requestId"`
+	Category        string            `json:"category"`
+}
+
+func newNotice(appID int, req *push.Message) *notice {
+	return &notice{
+		AppID: appID,
+		// 通知类型 1:无，2:响铃，3:振动，4:响铃和振动
+		NotifyType: 1,
+		// 消息缓存时间，单位是秒。在用户设备没有网络时，消息在Push服务器进行缓存，在消息缓存时间内用户设备重新连接网络，消息会下发，超过缓存时间后消息会丢弃。
+		// 取值至少60秒，最长7天。
+		TimeToLive: 60 * 60 * 24,
+		Title:      req.Payload.Title,
+		Content:    req.Payload.Content,
+		// 点击跳转类型 1：打开APP首页 2：打开链接 3：自定义 4:打开app内指定页面
+		SkipType: 1,
+		// 消息类型 0：运营类消息，1：系统类消息。不填默认为0
+		Classification: 1,
+		RequestID:      requestID(req),
+		Category:       "IM",
+	}
+}
+
+// requestNamespace is the namespace of the request ids.
+var requestNamespace = uuid.MustParse("27038199-d5ce-446e-b712-6e42aecacf8e")
+
+// requestID returns the requestId of the batch of the message, vivo drops
+// the requests of a requestId already pushed. It is derived from the message
+// id and the regids of the batch, so that the retries of the batch are not
+// pushed twice while the other batches of the message have their own.
+func requestID(message *push.Message) string {
+	if message.ID == "" {
+		return strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+	name := message.ID + "\n" + strings.Join(message.DeviceTokens, "\n")
+	return strings.ReplaceAll(uuid.NewSHA1(requestNamespace, []byte(name)).String(), "-", "")
+}
+
+// fetchToken fetches the auth token from the vivo server.
+func (endpoints *Endpoints) fetchToken(ctx context.Context) (*token.Token, error) {
+	resp, err := endpoints.GetTokenEndpoint(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed get token: %w", err)
 	}
-	return endpoints.token.AccessToken, nil
+	return resp.(*token.Token), nil
 }
 
 func (endpoints *Endpoints) sign(ctx context.Context, conf *Config, timestamp int64) string {
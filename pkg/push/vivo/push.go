@@ -5,14 +5,24 @@ import (
 	"fmt"
 
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
 )
 
 type VIVO struct {
 	endpoints *Endpoints
 }
 
-func NewPushClient(cfg *Config) (push.Push, error) {
-	endpoints, err := newEndpoints(context.Background(), cfg)
+func init() {
+	provider.Register("vivo", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return NewPushClient(cfg.(*Config), opts)
+	})
+}
+
+func NewPushClient(cfg *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), cfg, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed create VIVO endpoints: %v", err)
 	}
@@ -21,11 +31,50 @@ func NewPushClient(cfg *Config) (push.Push, error) {
 	}, nil
 }
 
-func (p *VIVO) PushNotice(ctx context.Context, message *push.Message) error {
-	_, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+// Check fetches the access token of VIVO.
+func (p *VIVO) Check(ctx context.Context) error {
+	_, err := p.endpoints.tokens.Get(ctx)
 	return err
 }
 
+// maxBatchSize is the max number of regids in a pushToList request.
+const maxBatchSize = 1000
+
+func (p *VIVO) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, maxBatchSize, p.pushNotice)
+}
+
+// pushNotice pushes the message with the single push api if there is only
+// one regid, otherwise with the list push api which needs at least two regids.
+func (p *VIVO) pushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	if len(message.DeviceTokens) == 1 {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	}
+
+	resp, err := p.endpoints.SaveListPayloadEndpoint(ctx, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed save list payload: %w", err)
+	}
+	payload := resp.(*pushNoticeResponse)
+	if payload.Result != resultSuccess {
+		return payload.result(message.DeviceTokens), nil
+	}
+
+	resp, err = p.endpoints.PushToListEndpoint(ctx, &pushToListRequest{
+		RegIDs:    message.DeviceTokens,
+		TaskID:    payload.TaskID,
+		RequestID: requestID(message),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pushToListResponse).result(message.DeviceTokens), nil
+}
+
 type Config struct {
 	AppID     string `yaml:"app_id"`
 	AppKey    string `yaml:"app_key"`
@@ -0,0 +1,89 @@
+package vivo
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+func TestRequestID(t *testing.T) {
+	message := &push.Message{ID: "message", DeviceTokens: []string{"a", "b"}}
+	id := requestID(message)
+	if len(id) != 32 {
+		t.Errorf("requestId %q, want 32 characters", id)
+	}
+	// the retries of a batch keep its requestId
+	if got := requestID(&push.Message{ID: "message", DeviceTokens: []string{"a", "b"}}); got != id {
+		t.Errorf("requestId %q of the retry, want %q", got, id)
+	}
+	// the other batches of the message have their own
+	if got := requestID(&push.Message{ID: "message", DeviceTokens: []string{"c", "d"}}); got == id {
+		t.Errorf("requestId %q shared by the batches of the message", got)
+	}
+	if got := requestID(&push.Message{ID: "other", DeviceTokens: []string{"a", "b"}}); got == id {
+		t.Errorf("requestId %q shared by another message", got)
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want push.Status
+	}{
+		{"success", `{"result":0,"desc":"请求成功","taskId":"task"}`, push.StatusDelivered},
+		{"daily limit exceeded", `{"result":10070,"desc":"超过当日推送量"}`, push.StatusQuotaExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(pushNoticeResponse)
+			if err := json.Unmarshal([]byte(tt.data), resp); err != nil {
+				t.Fatal(err)
+			}
+			for _, token := range resp.result([]string{"a", "b"}).Tokens {
+				if token.Status != tt.want || token.Code != strconv.Itoa(resp.Result) || token.MessageID != resp.TaskID {
+					t.Errorf("result = %+v, want %v with the code and the task id", token, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPushToListResult(t *testing.T) {
+	resp := new(pushToListResponse)
+	data := `{"result":0,"desc":"请求成功","taskId":"task","invalidUsers":[{"status":2,"userid":"b"}]}`
+	if err := json.Unmarshal([]byte(data), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []push.Status{push.StatusDelivered, push.StatusFailed}
+	for i, token := range resp.result([]string{"a", "b"}).Tokens {
+		if token.Status != want[i] || token.MessageID != "task" {
+			t.Errorf("result = %+v, want %v with the task id", token, want[i])
+		}
+	}
+}
+
+func TestResultRejected(t *testing.T) {
+	resp := new(pushNoticeResponse)
+	if err := json.Unmarshal([]byte(`{"result":10302,"desc":"regId不合法"}`), resp); err != nil {
+		t.Fatal(err)
+	}
+	if token := resp.result([]string{"a"}).Tokens[0]; token.Status != push.StatusRejected {
+		t.Errorf("result = %+v, want rejected", token)
+	}
+
+	list := new(pushToListResponse)
+	data := `{"result":0,"desc":"请求成功","taskId":"task","invalidUsers":[{"status":1,"userid":"b"}]}`
+	if err := json.Unmarshal([]byte(data), list); err != nil {
+		t.Fatal(err)
+	}
+	want := []push.Status{push.StatusDelivered, push.StatusRejected}
+	for i, token := range list.result([]string{"a", "b"}).Tokens {
+		if token.Status != want[i] {
+			t.Errorf("result = %+v, want %v", token, want[i])
+		}
+	}
+}
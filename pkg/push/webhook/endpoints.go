@@ -0,0 +1,237 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log/level"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/google/uuid"
+)
+
+// headers of the webhook requests
+const (
+	// HeaderDelivery is the unique id of the delivery, it is the same for
+	// the retries of the request
+	HeaderDelivery = "X-Yiqia-Push-Delivery"
+	// HeaderTimestamp is the unix time in seconds when the request is signed
+	HeaderTimestamp = "X-Yiqia-Push-Timestamp"
+	// HeaderSignature is sha256=<hex HMAC-SHA256 of "timestamp.body">
+	HeaderSignature = "X-Yiqia-Push-Signature"
+)
+
+// maxResponseSize is the max size of the response read.
+const maxResponseSize = 1 << 20
+
+type Endpoints struct {
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, cfg *Config, client *http.Client, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+	tgt, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints *Endpoints
+	options := []httptransport.ClientOption{
+		httptransport.SetClient(client),
+	}
+
+	endpoints = &Endpoints{
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*push.Message)
+			body, err := json.Marshal(newRequest(req))
+			if err != nil {
+				return err
+			}
+
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			for key, value := range cfg.Headers {
+				r.Header.Set(key, value)
+			}
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set(HeaderDelivery, deliveryID(req))
+			r.Header.Set(HeaderTimestamp, timestamp)
+			r.Header.Set(HeaderSignature, "sha256="+sign(cfg.Secret, timestamp, body))
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			defer resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				return nil, push.HTTPError(resp)
+			}
+
+			data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+			if err != nil {
+				return nil, push.Transient(strconv.Itoa(resp.StatusCode), fmt.Errorf("failed read response: %v", err))
+			}
+
+			body := &pushNoticeResponse{
+				Code:   strconv.Itoa(resp.StatusCode),
+				Status: resp.Status,
+			}
+			// the tokens are delivered by the 2xx response even if the
+			// rejected tokens in its body are not understood
+			body.Rejected, err = rejectedOf(data, cfg.RejectedField)
+			if err != nil {
+				level.Warn(logger).Log("msg", "fail read rejected tokens of webhook response", "err", err)
+			}
+			return body, nil
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("webhook", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// deliveryNamespace is the namespace of the delivery ids.
+var deliveryNamespace = uuid.MustParse("7f3c9a52-2d4e-4b8a-9c61-5e0f1d2a8b37")
+
+// deliveryID returns the delivery id of the batch of the message. It is
+// derived from the message id and the device tokens of the batch, so that
+// the retries of the batch have the same id while the other batches of the
+// message have their own.
+func deliveryID(message *push.Message) string {
+	if message.ID == "" {
+		return uuid.New().String()
+	}
+	name := message.ID + "\n" + strings.Join(message.DeviceTokens, "\n")
+	return uuid.NewSHA1(deliveryNamespace, []byte(name)).String()
+}
+
+// sign returns the hex HMAC-SHA256 of the timestamp and the body joined by
+// a dot, the timestamp is signed so that the request can't be replayed
+// later with a new timestamp.
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// request is the JSON rendering of the message posted to the webhook
+type request struct {
+	AppID        string                            `json:"app_id"`
+	DeviceTokens []string                          `json:"device_tokens"`
+	DeviceData   map[string]map[string]interface{} `json:"device_data,omitempty"`
+	Payload      requestPayload                    `json:"payload"`
+}
+
+type requestPayload struct {
+	BusinessID    string          `json:"business_id,omitempty"`
+	Title         string          `json:"title,omitempty"`
+	Content       string          `json:"content,omitempty"`
+	CallBack      string          `json:"callback,omitempty"`
+	CallbackParam string          `json:"callback_param,omitempty"`
+	CollapseID    string          `json:"collapse_id,omitempty"`
+	Priority      string          `json:"priority,omitempty"`
+	Notification  json.RawMessage `json:"notification,omitempty"`
+}
+
+func newRequest(message *push.Message) *request {
+	req := &request{
+		AppID:        message.AppID,
+		DeviceTokens: message.DeviceTokens,
+	}
+	for _, token := range message.DeviceTokens {
+		if data, ok := message.DeviceData[token]; ok {
+			if req.DeviceData == nil {
+				req.DeviceData = make(map[string]map[string]interface{})
+			}
+			req.DeviceData[token] = data
+		}
+	}
+	if payload := message.Payload; payload != nil {
+		req.Payload = requestPayload{
+			BusinessID:    payload.BusinessID,
+			Title:         payload.Title,
+			Content:       payload.Content,
+			CallBack:      payload.CallBack,
+			CallbackParam: payload.CallbackParam,
+			CollapseID:    payload.CollapseID,
+			Priority:      payload.Priority,
+			Notification:  payload.Notification,
+		}
+	}
+	return req
+}
+
+// rejectedOf returns the rejected device tokens in the field of the
+// response, there is none if the response is empty or the field is missing.
+func rejectedOf(data []byte, field string) ([]string, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("failed decode response: %v", err)
+	}
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		value = object[key]
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s of response is not an array", field)
+	}
+	rejected := make([]string, 0, len(values))
+	for _, v := range values {
+		if token, ok := v.(string); ok {
+			rejected = append(rejected, token)
+		}
+	}
+	return rejected, nil
+}
+
+type pushNoticeResponse struct {
+	Code     string
+	Status   string
+	Rejected []string
+}
+
+// result returns the push result of the tokens.
+func (r *pushNoticeResponse) result(tokens []string) *push.Result {
+	result := push.NewResult(tokens, push.StatusDelivered, "", r.Code, r.Status)
+	result.SetStatus(r.Rejected, push.StatusRejected)
+	return result
+}
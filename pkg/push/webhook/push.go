@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type Webhook struct {
+	cfg       *Config
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("webhook", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+	}
+
+	endpoints, err := newEndpoints(context.Background(), cfg, client, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create webhook endpoints: %v", err)
+	}
+	return &Webhook{
+		cfg:       cfg,
+		endpoints: endpoints,
+	}, nil
+}
+
+// Forwards reports true, the notification is posted to the webhook.
+func (p *Webhook) Forwards() bool {
+	return true
+}
+
+func (p *Webhook) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, message, p.cfg.MaxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+}
+
+type Config struct {
+	// URL is the URL of the webhook. The receiver of the URL answers for
+	// the tokens of the requests, e.g. lists the rejected ones, so there is
+	// one per instance; the other receivers are other instances selected
+	// by their app ids.
+	URL string `yaml:"url"`
+
+	// Secret is the key signing the requests with HMAC-SHA256.
+	Secret string `yaml:"secret"`
+
+	// Timeout is the timeout of a request.
+	// Default: 10s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxBatchSize is the max number of device tokens in a request.
+	// Default: 100
+	MaxBatchSize int `yaml:"max_batch_size"`
+
+	// RejectedField is the field of the response listing the rejected
+	// device tokens, the nested field is separated by dots, e.g. data.rejected.
+	// Default: rejected
+	RejectedField string `yaml:"rejected_field"`
+
+	// Headers are the extra headers of the requests.
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (c *Config) Validate() error {
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.MaxBatchSize == 0 {
+		c.MaxBatchSize = 100
+	}
+	if c.RejectedField == "" {
+		c.RejectedField = "rejected"
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: %s", c.URL)
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if c.MaxBatchSize < 0 {
+		return fmt.Errorf("max batch size must be positive")
+	}
+	if strings.Contains(c.RejectedField, "..") {
+		return fmt.Errorf("invalid rejected field: %s", c.RejectedField)
+	}
+	return nil
+}
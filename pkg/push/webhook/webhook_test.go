@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/eachchat/yiqia-push/pkg/push/retry"
+	"github.com/go-kit/log"
+)
+
+// delivery is a request received by the webhook
+type delivery struct {
+	id        string
+	timestamp string
+	signature string
+	body      []byte
+}
+
+// receiver records the deliveries and fails the first ones
+type receiver struct {
+	fail int
+	// response is the body of the 2xx responses
+	response string
+
+	locker     sync.Mutex
+	deliveries []*delivery
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.locker.Lock()
+	defer rc.locker.Unlock()
+	rc.deliveries = append(rc.deliveries, &delivery{
+		id:        r.Header.Get(HeaderDelivery),
+		timestamp: r.Header.Get(HeaderTimestamp),
+		signature: r.Header.Get(HeaderSignature),
+		body:      body,
+	})
+	if len(rc.deliveries) <= rc.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = io.WriteString(w, rc.response)
+}
+
+func newWebhook(t *testing.T, rc *receiver, maxBatchSize int) push.Push {
+	t.Helper()
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{URL: srv.URL, Secret: "secret", MaxBatchSize: maxBatchSize}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, &provider.Options{Name: "webhook", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retryCfg := &retry.Config{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if err := retryCfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return retry.Middleware(retryCfg)(p)
+}
+
+func TestDeliveryIDKeptAcrossRetries(t *testing.T) {
+	rc := &receiver{fail: 2}
+	p := newWebhook(t, rc, 0)
+
+	result, err := p.PushNotice(context.Background(), &push.Message{ID: "message", DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != 2 {
+		t.Fatalf("result = %+v, want delivered after the retries", result.Tokens)
+	}
+
+	if len(rc.deliveries) != 3 {
+		t.Fatalf("deliveries = %d, want 3", len(rc.deliveries))
+	}
+	for _, d := range rc.deliveries {
+		if d.id != rc.deliveries[0].id {
+			t.Errorf("delivery id %q, want %q on every attempt", d.id, rc.deliveries[0].id)
+		}
+		// every attempt is signed with its own timestamp
+		if d.signature != "sha256="+sign("secret", d.timestamp, d.body) {
+			t.Errorf("signature %q not verified", d.signature)
+		}
+	}
+
+	// another message has its own delivery id
+	if _, err := p.PushNotice(context.Background(), &push.Message{ID: "other", DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{}}); err != nil {
+		t.Fatal(err)
+	}
+	if id := rc.deliveries[3].id; id == rc.deliveries[0].id {
+		t.Errorf("delivery id %q reused by another message", id)
+	}
+}
+
+func TestDeliveryIDOfBatches(t *testing.T) {
+	rc := new(receiver)
+	p := newWebhook(t, rc, 1)
+
+	message := &push.Message{ID: "message", DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{}}
+	if _, err := p.PushNotice(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.deliveries) != 2 {
+		t.Fatalf("deliveries = %d, want 2", len(rc.deliveries))
+	}
+	if rc.deliveries[0].id == rc.deliveries[1].id {
+		t.Error("batches of the message share the delivery id")
+	}
+
+	// the batch pushed again, e.g. from the queue, keeps its delivery id
+	retried := &push.Message{ID: "message", DeviceTokens: []string{"b"}, Payload: &push.Payload{}}
+	if _, err := p.PushNotice(context.Background(), retried); err != nil {
+		t.Fatal(err)
+	}
+	if rc.deliveries[2].id != rc.deliveries[1].id {
+		t.Errorf("delivery id %q, want %q of the batch", rc.deliveries[2].id, rc.deliveries[1].id)
+	}
+}
+
+func TestRejectedOfResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     []push.Status
+	}{
+		{"rejected", `{"rejected": ["b"]}`, []push.Status{push.StatusDelivered, push.StatusRejected}},
+		{"empty", ``, []push.Status{push.StatusDelivered, push.StatusDelivered}},
+		{"no field", `{"ok": true}`, []push.Status{push.StatusDelivered, push.StatusDelivered}},
+		{"not json", `OK`, []push.Status{push.StatusDelivered, push.StatusDelivered}},
+		{"not an array", `{"rejected": "b"}`, []push.Status{push.StatusDelivered, push.StatusDelivered}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newWebhook(t, &receiver{response: tt.response}, 0)
+
+			result, err := p.PushNotice(context.Background(), &push.Message{ID: "message", DeviceTokens: []string{"a", "b"}, Payload: &push.Payload{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, token := range result.Tokens {
+				if token.Status != tt.want[i] {
+					t.Errorf("status of %s = %v, want %v", token.Token, token.Status, tt.want[i])
+				}
+			}
+		})
+	}
+}
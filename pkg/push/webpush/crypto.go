@@ -0,0 +1,171 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// recordSize is the record size of the aes128gcm content coding, the
+// payload is encrypted in a single record.
+const recordSize = 4096
+
+// maxPayloadSize is the max size of the payload in a single record, less
+// the header, the padding delimiter and the authentication tag.
+const maxPayloadSize = recordSize - 86 - 1 - 16
+
+// vapidLifetime is the lifetime of the VAPID JWT, which is at most 24 hours.
+const vapidLifetime = 12 * time.Hour
+
+// decodeBase64 decodes the base64url value with or without the padding.
+func decodeBase64(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// parseVAPIDKey parses the base64url encoded P-256 private key.
+func parseVAPIDKey(value string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeBase64(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed decode vapid private key: %v", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vapid private key: %v", err)
+	}
+
+	// the public key is the uncompressed point 0x04 || x || y
+	public := key.PublicKey().Bytes()
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}, nil
+}
+
+// vapid returns the Authorization header of the push service of the
+// audience, a JWT signed with ES256 and the public key.
+// more info: https://www.rfc-editor.org/rfc/rfc8292
+func vapid(key *ecdsa.PrivateKey, audience string, subject string) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"typ": "JWT",
+		"alg": "ES256",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"exp": time.Now().Add(vapidLifetime).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed sign vapid token: %v", err)
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	public, err := key.PublicKey.ECDH()
+	if err != nil {
+		return "", fmt.Errorf("invalid vapid public key: %v", err)
+	}
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, encoding.EncodeToString(signature), encoding.EncodeToString(public.Bytes())), nil
+}
+
+// encrypt encrypts the payload for the user agent with the aes128gcm
+// content coding, the key of the user agent is its p256dh key.
+// more info: https://www.rfc-editor.org/rfc/rfc8291
+func encrypt(payload []byte, p256dh []byte, authSecret []byte) ([]byte, error) {
+	if len(payload) > maxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d bytes", len(payload))
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return seal(payload, p256dh, authSecret, asPrivate, salt)
+}
+
+// seal encrypts the payload with the key pair of the application server and
+// the salt, which are new for every message.
+func seal(payload []byte, p256dh []byte, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaPublic, err := ecdh.P256().NewPublicKey(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %v", err)
+	}
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("failed ecdh: %v", err)
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append([]byte("WebPush: info\x00"), p256dh...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the header is salt || rs || idlen || keyid, the keyid is as_public
+	header := make([]byte, 0, 21+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// the last record is delimited by 0x02
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// hkdf derives the key of length at most 32 bytes with HMAC-SHA-256, the
+// output is a single block of HKDF-Expand.
+func hkdf(salt []byte, ikm []byte, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)[:length]
+}
@@ -0,0 +1,181 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+// fields of the subscription in the pusher data
+const (
+	dataEndpoint = "endpoint"
+	dataAuth     = "auth"
+	// the p256dh key is the pushkey if it is not in the data
+	dataP256dh = "p256dh"
+)
+
+type Endpoints struct {
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, cfg *Config, key *ecdsa.PrivateKey, client *http.Client, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+
+	// the request is sent to the endpoint of the subscription
+	tgt := &url.URL{Scheme: "https"}
+
+	var endpoints *Endpoints
+	options := []httptransport.ClientOption{
+		httptransport.SetClient(client),
+	}
+
+	endpoints = &Endpoints{
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*push.Message)
+			sub, err := subscriptionOf(req, req.DeviceTokens[0])
+			if err != nil {
+				return push.Permanent("", err)
+			}
+
+			// the endpoint is checked against the allowed hosts before
+			r.URL, err = url.Parse(sub.endpoint)
+			if err != nil {
+				return push.Permanent("", fmt.Errorf("invalid subscription endpoint: %v", err))
+			}
+			r.Host = r.URL.Host
+
+			payload, err := json.Marshal(map[string]string{
+				"title": req.Payload.Title,
+				"body":  req.Payload.Content,
+				"tag":   req.Payload.CollapseID,
+			})
+			if err != nil {
+				return err
+			}
+			body, err := encrypt(payload, sub.p256dh, sub.auth)
+			if err != nil {
+				return push.Permanent("", fmt.Errorf("failed encrypt payload: %v", err))
+			}
+
+			authorization, err := vapid(key, r.URL.Scheme+"://"+r.URL.Host, cfg.VAPIDSubject)
+			if err != nil {
+				return err
+			}
+
+			urgency := "high"
+			if req.Payload.Priority == "low" {
+				urgency = "normal"
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Type", "application/octet-stream")
+			r.Header.Set("Content-Encoding", "aes128gcm")
+			r.Header.Set("TTL", strconv.FormatInt(int64(cfg.TTL/time.Second), 10))
+			r.Header.Set("Urgency", urgency)
+			r.Header.Set("Authorization", authorization)
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			defer resp.Body.Close()
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+			body := &pushNoticeResponse{
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+				Location:   resp.Header.Get("Location"),
+			}
+			switch {
+			case resp.StatusCode >= 200 && resp.StatusCode < 300:
+				return body, nil
+			case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+				// the subscription is expired or unsubscribed
+				return body, nil
+			}
+			return nil, push.HTTPError(resp)
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("webpush", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// subscription is the Web Push subscription of a pushkey
+type subscription struct {
+	endpoint string
+	p256dh   []byte
+	auth     []byte
+}
+
+// subscriptionOf returns the subscription of the pushkey in the pusher data.
+func subscriptionOf(message *push.Message, pushKey string) (*subscription, error) {
+	data := message.DeviceData[pushKey]
+	endpoint, _ := data[dataEndpoint].(string)
+	if endpoint == "" {
+		return nil, errors.New("endpoint is missing in pusher data")
+	}
+	auth, _ := data[dataAuth].(string)
+	if auth == "" {
+		return nil, errors.New("auth is missing in pusher data")
+	}
+	p256dh, _ := data[dataP256dh].(string)
+	if p256dh == "" {
+		p256dh = pushKey
+	}
+
+	sub := &subscription{
+		endpoint: endpoint,
+	}
+	var err error
+	sub.p256dh, err = decodeBase64(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("failed decode p256dh key: %v", err)
+	}
+	sub.auth, err = decodeBase64(auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed decode auth secret: %v", err)
+	}
+	return sub, nil
+}
+
+type pushNoticeResponse struct {
+	StatusCode int
+	Status     string
+	// Location is the URI of the push message resource
+	Location string
+}
+
+// result returns the push result of the pushkeys, the subscriptions not
+// found or gone are rejected.
+func (r *pushNoticeResponse) result(pushKeys []string) *push.Result {
+	result := push.NewResult(pushKeys, push.StatusDelivered, r.Location, strconv.Itoa(r.StatusCode), r.Status)
+	if r.StatusCode == http.StatusNotFound || r.StatusCode == http.StatusGone {
+		result.SetStatus(pushKeys, push.StatusRejected)
+	}
+	return result
+}
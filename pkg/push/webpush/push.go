@@ -0,0 +1,159 @@
+package webpush
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type WebPush struct {
+	cfg       *Config
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("webpush", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return New(cfg.(*Config), opts)
+	})
+}
+
+func New(cfg *Config, opts *provider.Options) (push.Push, error) {
+	key, err := parseVAPIDKey(cfg.VAPIDPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		// the redirects are not followed, they may lead out of the allowed hosts
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	endpoints, err := newEndpoints(context.Background(), cfg, key, client, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create Web Push endpoints: %v", err)
+	}
+	return &WebPush{
+		cfg:       cfg,
+		endpoints: endpoints,
+	}, nil
+}
+
+// every subscription has its own push service endpoint.
+const maxBatchSize = 1
+
+// codeNotAllowed is the code of the pushkeys of the endpoints not allowed.
+const codeNotAllowed = "endpoint_not_allowed"
+
+// PushNotice pushes the notification to the push services of the
+// subscriptions, the pushkeys of the endpoints not allowed fail without a
+// request. They are not rejected, the endpoint may be allowed later.
+func (p *WebPush) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	allowed := make([]string, 0, len(message.DeviceTokens))
+	result := &push.Result{}
+	for _, pushKey := range message.DeviceTokens {
+		endpoint, _ := message.DeviceData[pushKey][dataEndpoint].(string)
+		if err := push.AllowEndpoint(endpoint, p.cfg.AllowedHosts, p.cfg.AllowHTTP); err != nil {
+			result.Merge(push.NewResult([]string{pushKey}, push.StatusFailed, "", codeNotAllowed, err.Error()))
+			continue
+		}
+		allowed = append(allowed, pushKey)
+	}
+	if len(allowed) == 0 {
+		return result, nil
+	}
+
+	chunk := *message
+	chunk.DeviceTokens = allowed
+	r, err := push.Batch(ctx, &chunk, maxBatchSize, func(ctx context.Context, message *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+	})
+	if err != nil && len(result.Tokens) == 0 {
+		return nil, err
+	}
+	if err != nil {
+		r = push.FailedResult(allowed, err)
+	}
+	result.Merge(r)
+	return result, nil
+}
+
+// defaultAllowedHosts are the push services of the major browsers.
+var defaultAllowedHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"web.push.apple.com",
+	"*.notify.windows.com",
+}
+
+type Config struct {
+	// VAPIDPrivateKey is the base64url encoded P-256 private key identifying
+	// the application server, its public key is the applicationServerKey of
+	// the subscriptions.
+	VAPIDPrivateKey string `yaml:"vapid_private_key"`
+
+	// VAPIDSubject is the contact of the application server, a mailto: or
+	// https: URI.
+	VAPIDSubject string `yaml:"vapid_subject"`
+
+	// TTL is how long the push service keeps the messages while the user
+	// agents are offline.
+	// Default: 24h
+	TTL time.Duration `yaml:"ttl"`
+
+	// AllowedHosts are the hosts of the subscription endpoints allowed to
+	// be requested, *.example.com allows the subdomains of example.com.
+	// Default: the push services of Chrome, Firefox, Safari and Edge
+	AllowedHosts []string `yaml:"allowed_hosts"`
+
+	// AllowHTTP allows the http endpoints besides https, e.g. for a local
+	// push service in testing.
+	AllowHTTP bool `yaml:"allow_http"`
+
+	// Timeout is the timeout of a request.
+	// Default: 10s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *Config) Validate() error {
+	if c.TTL == 0 {
+		c.TTL = 24 * time.Hour
+	}
+	if len(c.AllowedHosts) == 0 {
+		c.AllowedHosts = append([]string(nil), defaultAllowedHosts...)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	for i, host := range c.AllowedHosts {
+		c.AllowedHosts[i] = strings.ToLower(host)
+	}
+
+	if c.VAPIDPrivateKey == "" {
+		return fmt.Errorf("vapid private key is required")
+	}
+	if !strings.HasPrefix(c.VAPIDSubject, "mailto:") && !strings.HasPrefix(c.VAPIDSubject, "https:") {
+		return fmt.Errorf("vapid subject must be a mailto: or https: URI")
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+func mustDecode(t *testing.T, value string) []byte {
+	t.Helper()
+	data, err := decodeBase64(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// decrypt decrypts the aes128gcm body as the user agent.
+func decrypt(body []byte, uaPrivate *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("header too short")
+	}
+	salt := body[:16]
+	rs := binary.BigEndian.Uint32(body[16:20])
+	idlen := int(body[20])
+	if len(body) < 21+idlen || int(rs) < len(body)-21-idlen {
+		return nil, errors.New("invalid header")
+	}
+	asPublic := body[21 : 21+idlen]
+
+	public, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := uaPrivate.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, body[21+idlen:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the padding of the last record ends with the 0x02 delimiter
+	i := bytes.LastIndexByte(plaintext, 0x02)
+	if i < 0 || len(bytes.Trim(plaintext[i+1:], "\x00")) != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return plaintext[:i], nil
+}
+
+// the example of the RFC 8291 section 5.
+// more info: https://www.rfc-editor.org/rfc/rfc8291#section-5
+const (
+	rfcPlaintext  = "V2hlbiBJIGdyb3cgdXAsIEkgd2FudCB0byBiZSBhIHdhdGVybWVsb24"
+	rfcASPrivate  = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfcUAPublic   = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfcUAPrivate  = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfcSalt       = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfcAuthSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfcBody       = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func TestEncryptRFC8291(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(mustDecode(t, rfcASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPrivate, err := ecdh.P256().NewPrivateKey(mustDecode(t, rfcUAPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := mustDecode(t, rfcPlaintext)
+
+	body, err := seal(plaintext, mustDecode(t, rfcUAPublic), mustDecode(t, rfcAuthSecret), asPrivate, mustDecode(t, rfcSalt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(body); got != rfcBody {
+		t.Errorf("body = %s, want %s", got, rfcBody)
+	}
+
+	decrypted, err := decrypt(mustDecode(t, rfcBody), uaPrivate, mustDecode(t, rfcAuthSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted %q, want %q", decrypted, plaintext)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	_, _ = rand.Read(authSecret)
+
+	payload := []byte(`{"title":"title","body":"body"}`)
+	body, err := encrypt(payload, uaPrivate.PublicKey().Bytes(), authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := decrypt(body, uaPrivate, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, payload) {
+		t.Errorf("decrypted %q, want %q", decrypted, payload)
+	}
+
+	if _, err := encrypt(make([]byte, maxPayloadSize+1), uaPrivate.PublicKey().Bytes(), authSecret); err == nil {
+		t.Error("encrypt() of a payload larger than a record succeeded")
+	}
+}
+
+// newVAPIDKey returns the base64url encoded VAPID private key.
+func newVAPIDKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+// verifyVAPID verifies the VAPID Authorization header and returns the claims.
+func verifyVAPID(t *testing.T, authorization string) map[string]interface{} {
+	t.Helper()
+	var jwt, k string
+	for _, param := range strings.Split(strings.TrimPrefix(authorization, "vapid "), ", ") {
+		switch {
+		case strings.HasPrefix(param, "t="):
+			jwt = param[2:]
+		case strings.HasPrefix(param, "k="):
+			k = param[2:]
+		}
+	}
+
+	public := mustDecode(t, k)
+	if len(public) != 65 || public[0] != 0x04 {
+		t.Fatalf("k = %s, want an uncompressed P-256 point", k)
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(public[1:33]),
+		Y:     new(big.Int).SetBytes(public[33:]),
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("t = %s, want a JWT", jwt)
+	}
+	signature := mustDecode(t, parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(signature) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		t.Fatal("VAPID signature not verified")
+	}
+
+	header := make(map[string]string)
+	if err := json.Unmarshal(mustDecode(t, parts[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header["alg"] != "ES256" || header["typ"] != "JWT" {
+		t.Errorf("header = %v, want ES256 JWT", header)
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(mustDecode(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestVAPID(t *testing.T) {
+	key, err := parseVAPIDKey(newVAPIDKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorization, err := vapid(key, "https://push.example.com", "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := verifyVAPID(t, authorization)
+	if claims["aud"] != "https://push.example.com" || claims["sub"] != "mailto:admin@example.com" {
+		t.Errorf("claims = %v", claims)
+	}
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	if exp.Before(time.Now()) || exp.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("exp = %v, want within 24 hours", exp)
+	}
+}
+
+func TestDefaultAllowedHosts(t *testing.T) {
+	cfg := &Config{VAPIDPrivateKey: "key", VAPIDSubject: "mailto:admin@example.com"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	endpoints := []string{
+		"https://fcm.googleapis.com/fcm/send/abc",
+		"https://updates.push.services.mozilla.com/wpush/v2/abc",
+		"https://web.push.apple.com/abc",
+		"https://wns2-bl2p.notify.windows.com/w/?token=abc",
+	}
+	for _, endpoint := range endpoints {
+		if err := push.AllowEndpoint(endpoint, cfg.AllowedHosts, cfg.AllowHTTP); err != nil {
+			t.Errorf("allow(%q) = %v", endpoint, err)
+		}
+	}
+}
+
+// subscriber is a user agent subscribed to the push service.
+type subscriber struct {
+	private    *ecdh.PrivateKey
+	authSecret []byte
+}
+
+func newSubscriber(t *testing.T) *subscriber {
+	t.Helper()
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	_, _ = rand.Read(authSecret)
+	return &subscriber{private: private, authSecret: authSecret}
+}
+
+// message returns the message to the subscription of the endpoint.
+func (s *subscriber) message(endpoint string, payload *push.Payload) *push.Message {
+	pushKey := base64.RawURLEncoding.EncodeToString(s.private.PublicKey().Bytes())
+	return &push.Message{
+		DeviceTokens: []string{pushKey},
+		DeviceData: map[string]map[string]interface{}{
+			pushKey: {
+				dataEndpoint: endpoint,
+				dataAuth:     base64.RawURLEncoding.EncodeToString(s.authSecret),
+			},
+		},
+		Payload: payload,
+	}
+}
+
+// newWebPush returns the Web Push client allowing the local push service.
+func newWebPush(t *testing.T) push.Push {
+	t.Helper()
+	cfg := &Config{
+		VAPIDPrivateKey: newVAPIDKey(t),
+		VAPIDSubject:    "mailto:admin@example.com",
+		AllowedHosts:    []string{"127.0.0.1"},
+		AllowHTTP:       true,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, &provider.Options{Name: "webpush", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPushNoticeRequest(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	s := newSubscriber(t)
+	result, err := newWebPush(t).PushNotice(context.Background(), s.message(srv.URL+"/sub", &push.Payload{
+		Title:      "title",
+		Content:    "content",
+		CollapseID: "!room:example.org",
+		Priority:   "low",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Tokens[0].Status != push.StatusDelivered {
+		t.Errorf("status = %v, want delivered", result.Tokens[0].Status)
+	}
+
+	headers := map[string]string{
+		"Content-Encoding": "aes128gcm",
+		"TTL":              "86400",
+		"Urgency":          "normal",
+	}
+	for name, want := range headers {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if aud := verifyVAPID(t, req.Header.Get("Authorization"))["aud"]; aud != srv.URL {
+		t.Errorf("aud = %v, want %s", aud, srv.URL)
+	}
+
+	plaintext, err := decrypt(body, s.private, s.authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["title"] != "title" || payload["body"] != "content" || payload["tag"] != "!room:example.org" {
+		t.Errorf("payload = %v", payload)
+	}
+}
+
+func TestPushNoticeStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		want push.Status
+	}{
+		{http.StatusCreated, push.StatusDelivered},
+		{http.StatusNotFound, push.StatusRejected},
+		{http.StatusGone, push.StatusRejected},
+		{http.StatusTooManyRequests, push.StatusRetryable},
+		{http.StatusInternalServerError, push.StatusRetryable},
+		{http.StatusServiceUnavailable, push.StatusRetryable},
+		{http.StatusBadRequest, push.StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			message := newSubscriber(t).message(srv.URL, &push.Payload{})
+			result, err := newWebPush(t).PushNotice(context.Background(), message)
+			if err != nil {
+				result = push.FailedResult(message.DeviceTokens, err)
+			}
+			if got := result.Tokens[0].Status; got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushNoticeNotAllowed(t *testing.T) {
+	requested := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer target.Close()
+
+	// the redirect leads to a host not allowed
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(target.URL, "127.0.0.1", "localhost", 1), http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	p := newWebPush(t)
+	s := newSubscriber(t)
+
+	result, err := p.PushNotice(context.Background(), s.message(strings.Replace(target.URL, "127.0.0.1", "localhost", 1), &push.Payload{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := result.Tokens[0]; token.Status != push.StatusFailed || token.Code != codeNotAllowed {
+		t.Errorf("result = %+v, want failed as not allowed", token)
+	}
+
+	message := s.message(redirect.URL, &push.Payload{})
+	result, err = p.PushNotice(context.Background(), message)
+	if err != nil {
+		result = push.FailedResult(message.DeviceTokens, err)
+	}
+	if result.Tokens[0].Status == push.StatusDelivered {
+		t.Errorf("status = %v, want the redirect not followed", result.Tokens[0].Status)
+	}
+	if requested {
+		t.Error("redirect followed to the host not allowed")
+	}
+}
@@ -0,0 +1,135 @@
+package wecom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	defaultHost = "https://qyapi.weixin.qq.com"
+	sendPath    = "/cgi-bin/webhook/send"
+)
+
+type Endpoints struct {
+	PushNoticeEndpoint endpoint.Endpoint
+}
+
+func newEndpoints(ctx context.Context, conf *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
+	tgt, err := url.Parse(conf.Host + sendPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints *Endpoints
+	options := []httptransport.ClientOption{}
+
+	endpoints = &Endpoints{
+		PushNoticeEndpoint: httptransport.NewClient("POST", tgt, func(ctx context.Context, r *http.Request, request interface{}) error {
+			req := request.(*push.Message)
+
+			// the webhook key authenticates the request of the group bot
+			query := url.Values{}
+			query.Set("key", conf.Key)
+			r.URL.RawQuery = query.Encode()
+
+			body, err := json.Marshal(message(conf, req))
+			if err != nil {
+				return err
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Type", "application/json")
+			return nil
+		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
+			if resp.StatusCode != http.StatusOK {
+				return nil, push.HTTPError(resp)
+			}
+			defer resp.Body.Close()
+
+			body := new(pushNoticeResponse)
+			err = json.NewDecoder(resp.Body).Decode(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed decode body: %v", err)
+			}
+
+			if body.ErrCode != codeSuccess {
+				return nil, &push.Error{
+					Kind: codeKinds[body.ErrCode],
+					Code: strconv.Itoa(body.ErrCode),
+					Err:  fmt.Errorf("failed push notice: %s", body.ErrMsg),
+				}
+			}
+			return body, nil
+		}, options...).Endpoint(),
+	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("wecom", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
+	return endpoints, nil
+}
+
+// message returns the bot message of the message type.
+func message(conf *Config, req *push.Message) interface{} {
+	if conf.MessageType == MessageMarkdown {
+		return map[string]interface{}{
+			"msgtype": MessageMarkdown,
+			"markdown": map[string]string{
+				"content": "### " + push.EscapeMarkdown(req.Payload.Title) + "\n" + push.EscapeMarkdown(req.Payload.Content),
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"msgtype": MessageText,
+		"text": map[string]string{
+			"content": req.Payload.Title + "\n" + req.Payload.Content,
+		},
+	}
+}
+
+const codeSuccess = 0
+
+// codeKinds classifies the failure codes of the webhook api, the codes not
+// listed are permanent, e.g. 93000 of the invalid webhook key of the
+// instance, which is not a fault of the pushers.
+var codeKinds = map[int]push.Kind{
+	// system busy
+	-1: push.KindTransient,
+	// api freq out of limit
+	45009: push.KindRateLimited,
+}
+
+type pushNoticeResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// result returns the push result of the pushkeys, the message sent to the
+// bot is delivered to all of them.
+func (r *pushNoticeResponse) result(pushKeys []string) *push.Result {
+	return push.NewResult(pushKeys, push.StatusDelivered, "", strconv.Itoa(r.ErrCode), r.ErrMsg)
+}
@@ -0,0 +1,80 @@
+package wecom
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+)
+
+type WeCom struct {
+	endpoints *Endpoints
+}
+
+func init() {
+	provider.Register("wecom", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return NewPushClient(cfg.(*Config), opts)
+	})
+}
+
+func NewPushClient(cfg *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), cfg, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed create WeCom endpoints: %v", err)
+	}
+	return &WeCom{
+		endpoints: endpoints,
+	}, nil
+}
+
+// PushNotice sends the message once to the bot of the instance, the
+// pushkeys of the message share it.
+func (p *WeCom) PushNotice(ctx context.Context, message *push.Message) (*push.Result, error) {
+	resp, err := p.endpoints.PushNoticeEndpoint(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pushNoticeResponse).result(message.DeviceTokens), nil
+}
+
+// message types
+const (
+	// MessageText is the plain text of the title and the content
+	MessageText = "text"
+	// MessageMarkdown is the markdown with the title as the heading
+	MessageMarkdown = "markdown"
+)
+
+type Config struct {
+	// Host is the host of the WeCom api.
+	// Default: https://qyapi.weixin.qq.com
+	Host string `yaml:"host"`
+
+	// Key is the key of the webhook URL of the group bot.
+	Key string `yaml:"key"`
+
+	// MessageType is the type of the messages: text or markdown.
+	// Default: text
+	MessageType string `yaml:"message_type"`
+}
+
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		c.Host = defaultHost
+	}
+	if c.MessageType == "" {
+		c.MessageType = MessageText
+	}
+
+	if c.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if c.MessageType != MessageText && c.MessageType != MessageMarkdown {
+		return fmt.Errorf("unknown message type: %s", c.MessageType)
+	}
+	return nil
+}
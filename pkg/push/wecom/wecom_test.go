@@ -0,0 +1,120 @@
+package wecom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
+	"github.com/go-kit/log"
+)
+
+// bot is a stand-in of the WeCom webhook api
+type bot struct {
+	errCode int
+
+	requests int
+	query    url.Values
+	body     map[string]interface{}
+}
+
+func (b *bot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != sendPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b.requests++
+	b.query = r.URL.Query()
+	_ = json.NewDecoder(r.Body).Decode(&b.body)
+	fmt.Fprintf(w, `{"errcode":%d,"errmsg":"message"}`, b.errCode)
+}
+
+func newWeCom(t *testing.T, b *bot, cfg *Config) push.Push {
+	t.Helper()
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+
+	cfg.Host = srv.URL
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPushClient(cfg, &provider.Options{Name: "wecom", Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newMessage() *push.Message {
+	return &push.Message{
+		DeviceTokens: []string{"a", "b"},
+		Payload:      &push.Payload{Title: "Alice", Content: "<font>hi</font>"},
+	}
+}
+
+func TestKey(t *testing.T) {
+	b := new(bot)
+	p := newWeCom(t, b, &Config{Key: "key"})
+
+	result, err := p.PushNotice(context.Background(), newMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Filter(push.StatusDelivered)) != 2 {
+		t.Errorf("result = %+v, want the pushkeys delivered", result.Tokens)
+	}
+	// the pushkeys share the message sent to the bot
+	if b.requests != 1 {
+		t.Errorf("requests = %d, want 1", b.requests)
+	}
+	if got := b.query.Get("key"); got != "key" {
+		t.Errorf("key = %q, want the key of the instance", got)
+	}
+}
+
+func TestMarkdownEscaped(t *testing.T) {
+	b := new(bot)
+	p := newWeCom(t, b, &Config{Key: "key", MessageType: MessageMarkdown})
+
+	if _, err := p.PushNotice(context.Background(), newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	markdown := b.body["markdown"].(map[string]interface{})
+	if content := markdown["content"]; content != "### Alice\n&lt;font&gt;hi&lt;/font&gt;" {
+		t.Errorf("content = %q, want the content escaped", content)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		errCode int
+		want    push.Kind
+	}{
+		{"system busy", -1, push.KindTransient},
+		{"api freq out of limit", 45009, push.KindRateLimited},
+		{"invalid webhook url", 93000, push.KindPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newWeCom(t, &bot{errCode: tt.errCode}, &Config{Key: "key"})
+
+			_, err := p.PushNotice(context.Background(), newMessage())
+			if err == nil {
+				t.Fatal("err = nil, want the failure of the code")
+			}
+			if got := push.KindOf(err); got != tt.want {
+				t.Errorf("KindOf() = %v, want %v", got, tt.want)
+			}
+			// the pushers are not rejected for a failure of the bot
+			if got := push.FailedResult([]string{"a"}, err).Filter(push.StatusRejected); len(got) != 0 {
+				t.Errorf("rejected = %v, want none", got)
+			}
+		})
+	}
+}
@@ -3,14 +3,18 @@ package xiaomi
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/eachchat/yiqia-push/pkg/metrics"
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/breaker"
+	"github.com/eachchat/yiqia-push/pkg/push/limit"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
 )
@@ -23,7 +27,8 @@ type Endpoints struct {
 	PushNoticeEndpoint endpoint.Endpoint
 }
 
-func newEndpoints(ctx context.Context, conf *Config) (*Endpoints, error) {
+func newEndpoints(ctx context.Context, conf *Config, opts *provider.Options) (*Endpoints, error) {
+	logger := opts.Logger
 	tgt, err := url.Parse(host)
 	if err != nil {
 		return nil, err
@@ -58,28 +63,66 @@ func newEndpoints(ctx context.Context, conf *Config) (*Endpoints, error) {
 			return nil
 		}, func(ctx context.Context, resp *http.Response) (response interface{}, err error) {
 			if resp.StatusCode != http.StatusOK {
-				return nil, errors.New(resp.Status)
+				return nil, push.HTTPError(resp)
 			}
 			defer resp.Body.Close()
 
-			body := &struct {
-				Result      string            `json:"result,omitempty"`
-				Description string            `json:"description,omitempty"`
-				Data        map[string]string `json:"data,omitempty"`
-				Code        int               `json:"code,omitempty"`
-				Info        string            `json:"info,omitempty"`
-				Reason      string            `json:"reason,omitempty"`
-			}{}
+			body := new(pushNoticeResponse)
 			err = json.NewDecoder(resp.Body).Decode(body)
 			if err != nil {
 				return nil, fmt.Errorf("failed decode body: %v", err)
 			}
 
 			if body.Code != 0 {
-				return nil, fmt.Errorf("failed push notice: %s, info: %s", body.Reason, body.Info)
+				return nil, &push.Error{
+					Kind: codeKinds[body.Code],
+					Code: strconv.Itoa(body.Code),
+					Err:  fmt.Errorf("failed push notice: %s, info: %s", body.Reason, body.Info),
+				}
 			}
 			return body, nil
 		}, options...).Endpoint(),
 	}
+	// the latency is observed without the breaker and the limiter
+	endpoints.PushNoticeEndpoint = metrics.EndpointMiddleware("xiaomi", "push")(endpoints.PushNoticeEndpoint)
+
+	if opts.Breaker != nil {
+		pushBreaker := breaker.Middleware(opts.Name+".push", opts.Breaker, logger)
+		endpoints.PushNoticeEndpoint = pushBreaker(endpoints.PushNoticeEndpoint)
+	}
+	if opts.RateLimit != nil {
+		limiter := limit.EndpointMiddleware(opts.RateLimit)
+		endpoints.PushNoticeEndpoint = limiter(endpoints.PushNoticeEndpoint)
+	}
+
 	return endpoints, nil
 }
+
+// codeKinds classifies the failure codes of the push api,
+// the codes not listed are permanent.
+// more info: https://dev.mi.com/console/doc/detail?pId=1163#_4_0
+var codeKinds = map[int]push.Kind{
+	// system busy
+	10001: push.KindTransient,
+	// the qps of the app exceeds the limit
+	200001: push.KindRateLimited,
+}
+
+type pushNoticeResponse struct {
+	Result      string            `json:"result,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Data        map[string]string `json:"data,omitempty"`
+	Code        int               `json:"code,omitempty"`
+	Info        string            `json:"info,omitempty"`
+	Reason      string            `json:"reason,omitempty"`
+}
+
+// result returns the push result of the regids.
+// more info: https://dev.mi.com/console/doc/detail?pId=1163#_3_0
+func (r *pushNoticeResponse) result(regIDs []string) *push.Result {
+	result := push.NewResult(regIDs, push.StatusDelivered, r.Data["id"], strconv.Itoa(r.Code), r.Info)
+	if badRegIDs := r.Data["bad_regids"]; badRegIDs != "" {
+		result.SetStatus(strings.Split(badRegIDs, ","), push.StatusRejected)
+	}
+	return result
+}
@@ -5,14 +5,24 @@ import (
 	"fmt"
 
 	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/eachchat/yiqia-push/pkg/push/provider"
 )
 
 type XIAOMI struct {
 	endpoints *Endpoints
 }
 
-func NewPushClient(cfg *Config) (push.Push, error) {
-	endpoints, err := newEndpoints(context.Background(), cfg)
+func init() {
+	provider.Register("xiaomi", func(unmarshal func(interface{}) error) (provider.Config, error) {
+		cfg := new(Config)
+		return cfg, unmarshal(cfg)
+	}, func(cfg provider.Config, opts *provider.Options) (push.Push, error) {
+		return NewPushClient(cfg.(*Config), opts)
+	})
+}
+
+func NewPushClient(cfg *Config, opts *provider.Options) (push.Push, error) {
+	endpoints, err := newEndpoints(context.Background(), cfg, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed create XIAOMI endpoints: %v", err)
 	}
@@ -21,9 +31,17 @@ func NewPushClient(cfg *Config) (push.Push, error) {
 	}, nil
 }
 
-func (p *XIAOMI) PushNotice(ctx context.Context, pushRequest *push.Message) error {
-	_, err := p.endpoints.PushNoticeEndpoint(ctx, pushRequest)
-	return err
+// maxBatchSize is the max number of regids in a push request.
+const maxBatchSize = 1000
+
+func (p *XIAOMI) PushNotice(ctx context.Context, pushRequest *push.Message) (*push.Result, error) {
+	return push.Batch(ctx, pushRequest, maxBatchSize, func(ctx context.Context, pushRequest *push.Message) (*push.Result, error) {
+		resp, err := p.endpoints.PushNoticeEndpoint(ctx, pushRequest)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pushNoticeResponse).result(pushRequest.DeviceTokens), nil
+	})
 }
 
 type Config struct {
@@ -0,0 +1,38 @@
+package xiaomi
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+)
+
+func TestResult(t *testing.T) {
+	resp := new(pushNoticeResponse)
+	data := `{"result":"ok","code":0,"data":{"id":"message"},"description":"success","info":"Received push messages for 2 REGID"}`
+	if err := json.Unmarshal([]byte(data), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	result := resp.result([]string{"a", "b"})
+	for _, token := range result.Tokens {
+		if token.Status != push.StatusDelivered || token.MessageID != "message" || token.Code != "0" {
+			t.Errorf("result = %+v, want delivered with the message id and the code", token)
+		}
+	}
+}
+
+func TestResultRejected(t *testing.T) {
+	resp := new(pushNoticeResponse)
+	data := `{"result":"ok","code":0,"data":{"id":"message","bad_regids":"b,c"},"info":"Received push messages for 1 REGID"}`
+	if err := json.Unmarshal([]byte(data), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []push.Status{push.StatusDelivered, push.StatusRejected, push.StatusRejected}
+	for i, token := range resp.result([]string{"a", "b", "c"}).Tokens {
+		if token.Status != want[i] {
+			t.Errorf("result = %+v, want %v", token, want[i])
+		}
+	}
+}
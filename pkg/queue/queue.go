@@ -0,0 +1,495 @@
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/metrics"
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// jobsBucket stores the jobs waiting for delivery, keyed by the job id
+	jobsBucket = []byte("jobs")
+	// rejectedBucket stores the pushkeys rejected by the vendors,
+	// until they are reported to the homeserver or older than the max age
+	rejectedBucket = []byte("rejected")
+)
+
+// pollInterval is the interval to look for jobs without enqueue signal.
+const pollInterval = time.Second
+
+// sweepInterval is the interval to remove the expired rejected pushkeys.
+const sweepInterval = time.Hour
+
+// ErrClosed is returned when enqueueing jobs to a closed queue.
+var ErrClosed = errors.New("queue closed")
+
+type Config struct {
+	// Path is the path of the queue database file.
+	// The queue is disabled if the path is empty.
+	Path string `yaml:"path"`
+
+	// Workers is the number of the delivery workers.
+	// Default: 16
+	Workers int `yaml:"workers"`
+
+	// RetryInterval is the interval before the first redelivery of a job
+	// left for retry, it doubles after every redelivery.
+	// Default: 30s
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// MaxRetryInterval is the max interval between the redeliveries.
+	// Default: 10m
+	MaxRetryInterval time.Duration `yaml:"max_retry_interval"`
+
+	// MaxAge is the max age of a job, the job is dropped instead of
+	// being retried once it is older. The rejected pushkeys not reported
+	// to the homeserver within it are forgotten.
+	// Default: 24h
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c *Config) Validate() error {
+	if c.Workers == 0 {
+		c.Workers = 16
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("workers must be positive")
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 30 * time.Second
+	}
+	if c.MaxRetryInterval == 0 {
+		c.MaxRetryInterval = 10 * time.Minute
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 24 * time.Hour
+	}
+	if c.RetryInterval < 0 || c.MaxRetryInterval < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("durations must be positive")
+	}
+	return nil
+}
+
+// Enabled reports whether the queue is configured.
+func (c *Config) Enabled() bool {
+	return c.Path != ""
+}
+
+// Job is a push message waiting for delivery.
+type Job struct {
+	ID uint64 `json:"-"`
+
+	// Vendor is the name of the push client to deliver the message.
+	Vendor    string        `json:"vendor"`
+	Message   *push.Message `json:"message"`
+	CreatedAt time.Time     `json:"created_at"`
+
+	// Attempts is the number of the deliveries.
+	Attempts int `json:"attempts"`
+	// NotBefore is the time before which the job is not redelivered.
+	NotBefore time.Time `json:"not_before"`
+}
+
+// Handler delivers the job, it returns true if the job should be retried.
+// The handler may narrow the device tokens of the job message to the ones
+// to be retried.
+type Handler func(ctx context.Context, job *Job) bool
+
+// Queue persists the jobs on the disk and delivers them with the handler
+// in the background. The jobs left in the database are delivered after restart.
+type Queue struct {
+	cfg     *Config
+	db      *bolt.DB
+	handler Handler
+	logger  log.Logger
+
+	locker   sync.Mutex
+	closed   bool
+	inflight map[uint64]struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	signal chan struct{}
+	stop   chan struct{}
+	jobs   chan *Job
+	wg     sync.WaitGroup
+}
+
+func New(cfg *Config, handler Handler, logger log.Logger) (*Queue, error) {
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed open queue database: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{jobsBucket, rejectedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed create queue buckets: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		cfg:      cfg,
+		db:       db,
+		handler:  handler,
+		logger:   logger,
+		inflight: make(map[uint64]struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		signal:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		jobs:     make(chan *Job),
+	}, nil
+}
+
+// Start starts the dispatcher and the workers of the queue.
+func (q *Queue) Start() {
+	q.wg.Add(1)
+	go q.dispatch()
+
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Enqueue persists the jobs, they are delivered in the background.
+func (q *Queue) Enqueue(jobs ...*Job) error {
+	q.locker.Lock()
+	closed := q.closed
+	q.locker.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		for _, job := range jobs {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			job.ID = id
+
+			value, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(itob(id), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed persist jobs: %v", err)
+	}
+
+	q.notify()
+	return nil
+}
+
+// Reject remembers the pushkeys rejected by the vendors.
+func (q *Queue) Reject(pushKeys []string) error {
+	if len(pushKeys) == 0 {
+		return nil
+	}
+
+	now := itob(uint64(time.Now().Unix()))
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rejectedBucket)
+		for _, pushKey := range pushKeys {
+			if err := b.Put([]byte(pushKey), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Rejected returns the remembered rejected pushkeys among the given ones,
+// and forgets them as they are going to be reported to the homeserver.
+func (q *Queue) Rejected(pushKeys []string) ([]string, error) {
+	rejected := make([]string, 0)
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rejectedBucket)
+		for _, pushKey := range pushKeys {
+			if b.Get([]byte(pushKey)) == nil {
+				continue
+			}
+			if err := b.Delete([]byte(pushKey)); err != nil {
+				return err
+			}
+			rejected = append(rejected, pushKey)
+		}
+		return nil
+	})
+	return rejected, err
+}
+
+// sweep removes the rejected pushkeys remembered longer than the max age.
+func (q *Queue) sweep(now time.Time) error {
+	expiry := uint64(now.Add(-q.cfg.MaxAge).Unix())
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rejectedBucket)
+		expired := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || binary.BigEndian.Uint64(v) < expiry {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close stops accepting jobs and waits for the queued jobs to be delivered
+// until ctx is done. The jobs not delivered are kept for the next start.
+func (q *Queue) Close(ctx context.Context) error {
+	q.locker.Lock()
+	q.closed = true
+	q.locker.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+drain:
+	for {
+		empty, err := q.empty()
+		if err != nil {
+			level.Error(q.logger).Log("msg", "fail check queue", "err", err)
+			break
+		}
+		if empty {
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			level.Warn(q.logger).Log("msg", "queue not drained before shutdown", "err", ctx.Err())
+			break drain
+		}
+	}
+
+	close(q.stop)
+	q.cancel()
+	q.wg.Wait()
+	return q.db.Close()
+}
+
+// empty reports whether all the jobs are delivered.
+func (q *Queue) empty() (bool, error) {
+	q.locker.Lock()
+	inflight := len(q.inflight)
+	q.locker.Unlock()
+	if inflight > 0 {
+		return false, nil
+	}
+
+	var n int
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(jobsBucket).Stats().KeyN
+		return nil
+	})
+	return n == 0, err
+}
+
+// observe updates the metric of the number of the queued jobs.
+func (q *Queue) observe() error {
+	return q.db.View(func(tx *bolt.Tx) error {
+		metrics.QueueDepth.Set(float64(tx.Bucket(jobsBucket).Stats().KeyN))
+		return nil
+	})
+}
+
+// dispatch sends the pending jobs to the workers.
+func (q *Queue) dispatch() {
+	defer q.wg.Done()
+	defer close(q.jobs)
+
+	var swept time.Time
+	for {
+		if time.Since(swept) >= sweepInterval {
+			swept = time.Now()
+			if err := q.sweep(swept); err != nil {
+				level.Error(q.logger).Log("msg", "fail sweep rejected pushkeys", "err", err)
+			}
+		}
+
+		jobs, err := q.pending()
+		if err != nil {
+			level.Error(q.logger).Log("msg", "fail load pending jobs", "err", err)
+		}
+
+		if err := q.observe(); err != nil {
+			level.Error(q.logger).Log("msg", "fail observe queue depth", "err", err)
+		}
+
+		for _, job := range jobs {
+			select {
+			case q.jobs <- job:
+			case <-q.stop:
+				return
+			}
+		}
+
+		if len(jobs) > 0 {
+			continue
+		}
+
+		select {
+		case <-q.signal:
+		case <-time.After(pollInterval):
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// pending returns the jobs not being delivered, in the enqueue order.
+func (q *Queue) pending() ([]*Job, error) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	jobs := make([]*Job, 0)
+	corrupted := make([][]byte, 0)
+	err := q.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		c := tx.Bucket(jobsBucket).Cursor()
+		for k, v := c.First(); k != nil && len(jobs) < q.cfg.Workers; k, v = c.Next() {
+			id := binary.BigEndian.Uint64(k)
+			if _, ok := q.inflight[id]; ok {
+				continue
+			}
+
+			job := new(Job)
+			if err := json.Unmarshal(v, job); err != nil {
+				level.Error(q.logger).Log("msg", "fail decode job, drop it", "id", id, "err", err)
+				corrupted = append(corrupted, itob(id))
+				continue
+			}
+			job.ID = id
+
+			if job.NotBefore.After(now) {
+				continue
+			}
+
+			q.inflight[id] = struct{}{}
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil || len(corrupted) == 0 {
+		return jobs, err
+	}
+
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		for _, k := range corrupted {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// work delivers the jobs from the dispatcher.
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for job := range q.jobs {
+		retry := q.handler(q.ctx, job)
+		q.done(job, retry)
+	}
+}
+
+// done removes the delivered job, or reschedules it if it should be retried.
+// The job is kept for the next start if the delivery is interrupted by
+// the shutdown.
+func (q *Queue) done(job *Job, retry bool) {
+	if q.ctx.Err() == nil {
+		err := q.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(jobsBucket)
+			if !retry {
+				return b.Delete(itob(job.ID))
+			}
+
+			if time.Since(job.CreatedAt) > q.cfg.MaxAge {
+				level.Warn(q.logger).Log("msg", "drop expired job", "id", job.ID, "attempts", job.Attempts+1)
+				return b.Delete(itob(job.ID))
+			}
+
+			metrics.QueueRetries.With("vendor", job.Vendor).Add(1)
+			job.Attempts++
+			job.NotBefore = time.Now().Add(q.retryInterval(job.Attempts))
+			value, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			return b.Put(itob(job.ID), value)
+		})
+		if err != nil {
+			level.Error(q.logger).Log("msg", "fail update job", "id", job.ID, "err", err)
+		}
+	}
+
+	q.locker.Lock()
+	delete(q.inflight, job.ID)
+	q.locker.Unlock()
+
+	q.notify()
+}
+
+// notify wakes up the dispatcher to look for the pending jobs.
+func (q *Queue) notify() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// retryInterval returns the interval before the redelivery of the attempts.
+func (q *Queue) retryInterval(attempts int) time.Duration {
+	interval := q.cfg.RetryInterval
+	for i := 1; i < attempts && interval < q.cfg.MaxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > q.cfg.MaxRetryInterval {
+		interval = q.cfg.MaxRetryInterval
+	}
+	return interval
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eachchat/yiqia-push/pkg/push"
+	"github.com/go-kit/log"
+)
+
+func newTestQueue(t *testing.T, path string, handler Handler) *Queue {
+	t.Helper()
+	cfg := &Config{Path: path, Workers: 2, RetryInterval: time.Millisecond, MaxRetryInterval: 10 * time.Millisecond}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(cfg, handler, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func newJob(tokens ...string) *Job {
+	return &Job{
+		Vendor:    "test",
+		Message:   &push.Message{AppID: "app", DeviceTokens: tokens, Payload: &push.Payload{}},
+		CreatedAt: time.Now(),
+	}
+}
+
+func TestQueueDeliversAndDrainsOnClose(t *testing.T) {
+	var locker sync.Mutex
+	delivered := make([]string, 0)
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), func(ctx context.Context, job *Job) bool {
+		locker.Lock()
+		delivered = append(delivered, job.Message.DeviceTokens...)
+		locker.Unlock()
+		return false
+	})
+	q.Start()
+
+	if err := q.Enqueue(newJob("a"), newJob("b"), newJob("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(delivered)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("delivered = %v, want %v", delivered, want)
+	}
+	if err := q.Enqueue(newJob("d")); err != ErrClosed {
+		t.Errorf("Enqueue() after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestQueueRetriesNarrowedTokens(t *testing.T) {
+	var locker sync.Mutex
+	attempts := make([][]string, 0)
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), func(ctx context.Context, job *Job) bool {
+		locker.Lock()
+		defer locker.Unlock()
+		attempts = append(attempts, append([]string(nil), job.Message.DeviceTokens...))
+		if job.Attempts == 0 {
+			job.Message.DeviceTokens = []string{"b"}
+			return true
+		}
+		return false
+	})
+	q.Start()
+
+	if err := q.Enqueue(newJob("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"a", "b"}, {"b"}}
+	if !reflect.DeepEqual(attempts, want) {
+		t.Errorf("attempts = %v, want %v", attempts, want)
+	}
+}
+
+func TestQueueKeepsJobsForNextStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	// the queue is closed without delivering
+	q := newTestQueue(t, path, func(ctx context.Context, job *Job) bool {
+		t.Error("unexpected delivery")
+		return false
+	})
+	if err := q.Enqueue(newJob("a")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = q.Close(ctx)
+
+	delivered := make(chan string, 1)
+	q = newTestQueue(t, path, func(ctx context.Context, job *Job) bool {
+		delivered <- job.Message.DeviceTokens[0]
+		return false
+	})
+	q.Start()
+	defer q.Close(context.Background())
+
+	select {
+	case token := <-delivered:
+		if token != "a" {
+			t.Errorf("delivered %q, want a", token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not delivered after restart")
+	}
+}
+
+func TestQueueRejected(t *testing.T) {
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), func(ctx context.Context, job *Job) bool {
+		return false
+	})
+	defer q.Close(context.Background())
+
+	if err := q.Reject([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := q.Rejected([]string{"a", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("Rejected() = %v, want %v", rejected, want)
+	}
+
+	// the reported pushkeys are forgotten
+	rejected, err = q.Rejected([]string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 0 {
+		t.Errorf("Rejected() again = %v, want none", rejected)
+	}
+
+	// the pushkeys not reported within the max age are swept
+	if err := q.sweep(time.Now().Add(q.cfg.MaxAge - time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if rejected, _ := q.Rejected([]string{"b"}); len(rejected) != 1 {
+		t.Errorf("Rejected() before expiry = %v, want [b]", rejected)
+	}
+	if err := q.Reject([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.sweep(time.Now().Add(q.cfg.MaxAge + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if rejected, _ := q.Rejected([]string{"b"}); len(rejected) != 0 {
+		t.Errorf("Rejected() after expiry = %v, want none", rejected)
+	}
+}
+
+func TestRetryInterval(t *testing.T) {
+	q := &Queue{cfg: &Config{RetryInterval: time.Second, MaxRetryInterval: 5 * time.Second}}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := q.retryInterval(tt.attempts); got != tt.want {
+			t.Errorf("retryInterval(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}